@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/akabos/multiproxy/pkg/config"
+)
+
+// loadConfig returns configuration built from command line flags and the -config file. Settings found in the file
+// override the flags.
+func loadConfig() (*config.Config, error) {
+	c, err := flagConfig()
+	if err != nil {
+		return nil, err
+	}
+	if *optConfig != "" {
+		return c, c.Load(*optConfig)
+	}
+	return c, c.Validate()
+}
+
+func flagConfig() (*config.Config, error) {
+	c := &config.Config{
+		Listen:          *optListen,
+		SocksListen:     *optSocksListen,
+		AdminListen:     *optAdminListen,
+		ShutdownTimeout: *optShutdownTimeout,
+		Log: config.Log{
+			Level:            *optLogLevel,
+			Access:           !*optNoAccessLog,
+			WebSocket:        *optWebSocketLog,
+			WebSocketPayload: *optWebSocketPayload,
+		},
+		ACL: *optACL,
+		Auth: config.Auth{
+			Htpasswd: *optAuthHtpasswd,
+			Realm:    *optAuthRealm,
+			Digest:   *optAuthDigest,
+		},
+		Headers: config.Headers{
+			Via:           !*optNoVia,
+			XForwardedFor: !*optNoXForwardedFor,
+		},
+		Cache: config.Cache{
+			Enabled:       *optCache,
+			MemorySize:    *optCacheSize,
+			Dir:           *optCacheDir,
+			DirSize:       *optCacheDirSize,
+			MaxObjectSize: *optCacheObjectSize,
+		},
+		Tunnel: config.Tunnel{
+			IdleTimeout: *optTunnelIdle,
+			MaxLifetime: *optTunnelLifetime,
+		},
+		Throttle: config.Throttle{
+			Latency: *optThrottleLatency,
+			Global:  config.Bandwidth{Download: *optThrottleDown, Upload: *optThrottleUp},
+			Client:  config.Bandwidth{Download: *optThrottleClDown, Upload: *optThrottleClUp},
+		},
+		HAR: config.HAR{
+			Enabled:     *optHAR,
+			Dir:         *optHARDir,
+			MaxBodySize: *optHARBodySize,
+			MaxEntries:  *optHAREntries,
+		},
+		Upstream: config.Upstream{
+			Proxy:         *optUpstreamProxy,
+			CA:            splitList(*optUpstreamCA),
+			Insecure:      splitList(*optUpstreamInsecure),
+			VerifyFailure: *optUpstreamFailure,
+		},
+		MITM: config.MITM{
+			CACert:         *optCACert,
+			CAKey:          *optCAKey,
+			CAGenerate:     *optCAGenerate,
+			CAKeyAlgorithm: *optCAKeyAlgorithm,
+			KeyAlgorithm:   *optCertKeyAlgorithm,
+			KeyBits:        *optCertKeyBits,
+			KeyPool:        *optCertKeyPool,
+			CacheSize:      *optCertCacheSize,
+			CacheDir:       *optCertCacheDir,
+			Naming:         *optCertNaming,
+			Mirror:         *optCertMirror,
+			HTTP2:          !*optNoHTTP2,
+		},
+	}
+
+	mitm, tunnel := splitList(*optMitmHostnames), splitList(*optTunnelHostnames)
+	if len(mitm) == 0 && len(tunnel) == 0 {
+		tunnel = []string{"*"}
+	}
+	if len(mitm) > 0 {
+		c.Routes = append(c.Routes, config.Route{Hosts: mitm, Action: config.ActionMITM})
+	}
+	if len(tunnel) > 0 {
+		c.Routes = append(c.Routes, config.Route{Hosts: tunnel, Action: config.ActionTunnel})
+	}
+
+	if *optRateLimit != 0 || *optRateLimitBurst != 0 || *optMaxConcurrent != 0 {
+		c.RateLimits = append(c.RateLimits, config.RateLimit{
+			Key:           "client",
+			Rate:          *optRateLimit,
+			Burst:         *optRateLimitBurst,
+			MaxConcurrent: *optMaxConcurrent,
+		})
+	}
+
+	for _, item := range splitList(*optAuthUsers) {
+		i := strings.IndexByte(item, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid user %q, expected user:password", item)
+		}
+		c.Auth.Users = append(c.Auth.Users, config.User{Name: item[:i], Password: item[i+1:]})
+	}
+	for _, item := range splitList(*optUpstreamRules) {
+		i := strings.IndexByte(item, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid parent proxy rule %q, expected host=proxy", item)
+		}
+		c.Upstream.Rules = append(c.Upstream.Rules, config.ProxyRule{Hosts: []string{item[:i]}, Proxy: item[i+1:]})
+	}
+	return c, nil
+}
+
+// restartRequired returns names of the settings which changed but only take effect after restart.
+func restartRequired(old, c *config.Config) []string {
+	var changed []string
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	check("listen", old.Listen, c.Listen)
+	check("socks_listen", old.SocksListen, c.SocksListen)
+	check("admin_listen", old.AdminListen, c.AdminListen)
+	check("cache", old.Cache, c.Cache)
+	check("har", old.HAR, c.HAR)
+	if c.SocksListen != "" {
+		// SOCKS5 clients are asked for credentials only if authentication was enabled on start
+		check("auth", authEnabled(old.Auth), authEnabled(c.Auth))
+	}
+
+	// certificate policies apply to new connections, the CA and certificate storage don't change
+	mitm := old.MITM
+	mitm.Naming, mitm.Mirror, mitm.HTTP2 = c.MITM.Naming, c.MITM.Mirror, c.MITM.HTTP2
+	check("mitm", mitm, c.MITM)
+	return changed
+}
+
+func authEnabled(c config.Auth) bool {
+	return c.Htpasswd != "" || len(c.Users) > 0
+}
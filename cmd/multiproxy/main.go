@@ -1,133 +1,636 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/justinas/alice"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/akabos/multiproxy/pkg/certcache"
+	"github.com/akabos/multiproxy/pkg/config"
 	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/issuer"
+	"github.com/akabos/multiproxy/pkg/metrics"
+	"github.com/akabos/multiproxy/pkg/middleware/acl"
+	"github.com/akabos/multiproxy/pkg/middleware/auth"
+	"github.com/akabos/multiproxy/pkg/middleware/cache"
+	"github.com/akabos/multiproxy/pkg/middleware/drain"
+	"github.com/akabos/multiproxy/pkg/middleware/har"
 	"github.com/akabos/multiproxy/pkg/middleware/log"
+	mwmetrics "github.com/akabos/multiproxy/pkg/middleware/metrics"
+	"github.com/akabos/multiproxy/pkg/middleware/ratelimit"
+	"github.com/akabos/multiproxy/pkg/middleware/throttle"
 	"github.com/akabos/multiproxy/pkg/middleware/via"
+	"github.com/akabos/multiproxy/pkg/middleware/websocket"
 	"github.com/akabos/multiproxy/pkg/router"
+	"github.com/akabos/multiproxy/pkg/socks"
+	"github.com/akabos/multiproxy/pkg/upstream"
 )
 
+// caExpiryWarning is how long before the CA certificate expires the proxy starts warning about it.
+const caExpiryWarning = 30 * 24 * time.Hour
+
 var (
-	optListen          = flag.String("listen", "127.0.0.1:8080", "interface and port to bind server to")
-	optNoVia           = flag.Bool("novia", false, "proxy will not add/update Via header")
-	optNoXForwardedFor = flag.Bool("noxforwardedfor", false, "proxy will not add/update X-Forwarded-For header")
-	optNoAccessLog     = flag.Bool("noaccesslog", false, "disable access logging")
-	optMitmHostnames   = flag.String("mitm", "", "coma-separated list of hostnames CONNECT requests to which will be handled with MITM proxy")
-	optTunnelHostnames = flag.String("tunnel", "", "coma-separated list of host names CONNECT requests to which will be handled with tunnel proxy")
+	optConfig           = flag.String("config", "", "YAML, JSON or TOML (.toml extension) configuration file, settings found in it override command line flags, reloaded on SIGHUP")
+	optListen           = flag.String("listen", "127.0.0.1:8080", "interface and port to bind server to")
+	optAdminListen      = flag.String("admin-listen", "", "interface and port to bind admin server to, serves Prometheus metrics at /metrics, disabled if not set")
+	optSocksListen      = flag.String("socks-listen", "", "interface and port to bind SOCKS5 server to, SOCKS5 is disabled if not set")
+	optACL              = flag.String("acl", "", "file with access control rules, see README for the format")
+	optAuthHtpasswd     = flag.String("auth-htpasswd", "", "htpasswd file with users allowed to use the proxy, enables proxy authentication")
+	optAuthUsers        = flag.String("auth-users", "", "coma-separated list of user:password pairs allowed to use the proxy, enables proxy authentication")
+	optAuthRealm        = flag.String("auth-realm", auth.DefaultRealm, "proxy authentication realm")
+	optAuthDigest       = flag.Bool("auth-digest", false, "offer Digest authentication in addition to Basic, only works with -auth-users")
+	optCache            = flag.Bool("cache", false, "cache responses to plain HTTP and MITM intercepted requests")
+	optCacheSize        = flag.Int64("cache-size", cache.DefaultMemorySize, "maximum size of in-memory response cache in bytes")
+	optCacheDir         = flag.String("cache-dir", "", "directory to store cached responses in instead of memory, so they survive restarts")
+	optCacheDirSize     = flag.Int64("cache-dir-size", cache.DefaultDirSize, "maximum size of -cache-dir in bytes")
+	optCacheObjectSize  = flag.Int64("cache-max-object-size", cache.DefaultMaxObjectSize, "maximum size of cached response body in bytes")
+	optHAR              = flag.Bool("har", false, "record plain HTTP and MITM intercepted requests in HAR format, served at /har of the admin server")
+	optHARDir           = flag.String("har-dir", "", "directory to write HAR file of each MITM intercepted connection and plain HTTP request to")
+	optHARBodySize      = flag.Int64("har-max-body-size", har.DefaultMaxBodySize, "number of bytes of request and response bodies recorded in HAR")
+	optHAREntries       = flag.Int("har-max-entries", har.DefaultMaxEntries, "number of the most recent requests kept in memory for /har of the admin server")
+	optShutdownTimeout  = flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for requests and tunnels in flight to finish on SIGTERM or SIGINT before cutting them off")
+	optNoVia            = flag.Bool("novia", false, "proxy will not add/update Via header")
+	optNoXForwardedFor  = flag.Bool("noxforwardedfor", false, "proxy will not add/update X-Forwarded-For header")
+	optLogLevel         = flag.String("log-level", "info", "server log level: debug, info, warn or error")
+	optWebSocketLog     = flag.Bool("websocket-log", false, "log WebSocket messages of plain HTTP and MITM intercepted connections")
+	optWebSocketPayload = flag.Int("websocket-log-payload", 0, "number of bytes of WebSocket text message payload to log")
+	optNoAccessLog      = flag.Bool("noaccesslog", false, "disable access logging")
+	optNoHTTP2          = flag.Bool("nohttp2", false, "disable HTTP/2 for clients of MITM intercepted connections")
+	optMitmHostnames    = flag.String("mitm", "", "coma-separated list of hostnames CONNECT requests to which will be handled with MITM proxy")
+	optTunnelHostnames  = flag.String("tunnel", "", "coma-separated list of host names CONNECT requests to which will be handled with tunnel proxy")
+	optRateLimit        = flag.Float64("ratelimit-client-rate", 0, "limit the number of requests per second of each client address, excess requests get 429")
+	optRateLimitBurst   = flag.Int("ratelimit-client-burst", 0, "number of requests each client is allowed to make at once over -ratelimit-client-rate")
+	optMaxConcurrent    = flag.Int("ratelimit-client-concurrent", 0, "limit the number of requests and tunnels each client address has open at once, excess requests get 429")
+	optThrottleDown     = flag.Int64("throttle-download", 0, "limit download bandwidth of all clients together, in bytes per second")
+	optThrottleUp       = flag.Int64("throttle-upload", 0, "limit upload bandwidth of all clients together, in bytes per second")
+	optThrottleClDown   = flag.Int64("throttle-client-download", 0, "limit download bandwidth of each client address, in bytes per second")
+	optThrottleClUp     = flag.Int64("throttle-client-upload", 0, "limit upload bandwidth of each client address, in bytes per second")
+	optThrottleLatency  = flag.Duration("throttle-latency", 0, "delay every request to simulate slow networks")
+	optTunnelIdle       = flag.Duration("tunnel-idle-timeout", 10*time.Minute, "time after which tunnels with no data going through are closed, 0 disables the timeout")
+	optTunnelLifetime   = flag.Duration("tunnel-max-lifetime", 0, "time after which tunnels are closed regardless of activity, 0 disables the limit")
+	optUpstreamCA       = flag.String("upstream-ca", "", "coma-separated list of PEM files with CA certificates to trust in addition to system ones when verifying target servers")
+	optUpstreamInsecure = flag.String("upstream-insecure", "", "coma-separated list of host names certificates of which will not be verified, '*' disables verification")
+	optUpstreamFailure  = flag.String("upstream-verify-failure", "reject", "what to do if target server certificate fails verification: reject (respond with 502) or warn (log and proceed)")
+	optUpstreamProxy    = flag.String("upstream-proxy", "", "parent proxy URL (http://, https:// or socks5://, credentials in user info) or 'direct', by default taken from HTTP_PROXY/HTTPS_PROXY environment variables")
+	optUpstreamRules    = flag.String("upstream-proxy-rules", "", "coma-separated list of host=proxy rules overriding -upstream-proxy for matching target hosts, e.g. '.corp.example.com=direct'")
+	optCACert           = flag.String("ca-cert", "", "PEM file with CA certificate to sign MITM certificates with")
+	optCAKey            = flag.String("ca-key", "", "PEM file with CA private key, if not specified it is expected to be found in -ca-cert file")
+	optCAGenerate       = flag.Bool("ca-generate", false, "generate CA certificate and save it into -ca-cert and -ca-key files if they don't exist")
+	optCAKeyAlgorithm   = flag.String("ca-key-algorithm", "rsa", "key algorithm for generated CA certificate: rsa, ecdsa-p256, ecdsa-p384 or ed25519")
+	optCertKeyAlgorithm = flag.String("cert-key-algorithm", "rsa", "key algorithm for MITM certificates: rsa, ecdsa-p256, ecdsa-p384 or ed25519")
+	optCertKeyBits      = flag.Int("cert-key-bits", issuer.DefaultIssuerBitSize, "RSA key size for MITM certificates")
+	optCertCacheSize    = flag.Int("cert-cache-size", certcache.DefaultSize, "number of MITM certificates to keep in memory")
+	optCertCacheDir     = flag.String("cert-cache-dir", "", "directory to store MITM certificates in, so they survive restarts, requires -ca-cert")
+	optCertNaming       = flag.String("cert-naming", "exact", "MITM certificate naming policy: exact, parent (*.parent wildcard) or etld1 (registrable domain wildcard)")
+	optCertMirror       = flag.Bool("cert-mirror", false, "copy subject, names and validity of target server certificates into MITM certificates")
+	optCertKeyPool      = flag.Int("cert-key-pool", issuer.DefaultKeyPoolSize, "number of MITM certificate keys to pre-generate in background, 0 disables the pool")
 )
 
-func init() {
+func main() {
 	flag.Parse()
-	if *optMitmHostnames == "" && *optTunnelHostnames == "" {
-		*optTunnelHostnames = "*"
+	var (
+		level = zap.NewAtomicLevel()
+		l     = zap.New(zapcore.NewCore(
+			zapcore.NewConsoleEncoder(log.DefaultServerLogEncoderConfig()),
+			zapcore.AddSync(os.Stderr),
+			level,
+		)).Named("cli")
+	)
+
+	c, err := loadConfig()
+	if err != nil {
+		l.Fatal("failed to load configuration", zap.Error(err))
 	}
-}
+	_ = level.UnmarshalText([]byte(c.Log.Level))
+
+	p := &proxy{logger: l}
+	err = p.init(c)
+	if err != nil {
+		l.Fatal("", zap.Error(err))
+	}
+	rt, err := p.build(c)
+	if err != nil {
+		l.Fatal("", zap.Error(err))
+	}
+	p.routing.Store(rt)
 
-func main() {
 	var (
-		accessw io.Writer = os.Stdout
-		serverw io.Writer = os.Stderr
+		mux         = &router.Swappable{}
+		drainer     = &drain.Drain{Logger: l.Named("drain")}
+		server      = &http.Server{Addr: c.Listen, Handler: drainer.Middleware(mux)}
+		socksServer *socks.Server
 	)
-	if *optNoAccessLog {
-		accessw = ioutil.Discard
+	mux.Store(rt.router)
+
+	if c.SocksListen != "" {
+		socksServer = &socks.Server{
+			Handler: drainer.Middleware(mux),
+			Logger:  l.Named("socks"),
+		}
+		if rt.authenticator != nil {
+			// credentials are verified once again by the middleware, the same way they are for HTTP clients
+			socksServer.Authenticate = p.authenticate
+		}
+		l.Info("starting SOCKS5", zap.String("listen", c.SocksListen))
+		go func() {
+			err := socksServer.ListenAndServe(c.SocksListen)
+			if err != socks.ErrServerClosed {
+				l.Fatal("", zap.Error(err))
+			}
+		}()
+	}
+
+	var admin *http.Server
+	if p.registry != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", p.registry)
+		if p.har != nil {
+			mux.Handle("/har", p.har)
+		}
+		admin = &http.Server{Addr: c.AdminListen, Handler: mux}
+		l.Info("starting admin server", zap.String("listen", c.AdminListen))
+		go func() {
+			err := admin.ListenAndServe()
+			if err != http.ErrServerClosed {
+				l.Fatal("", zap.Error(err))
+			}
+		}()
+	}
+
+	l.Info("starting", zap.String("listen", c.Listen))
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			l.Fatal("", zap.Error(err))
+		}
+	}()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	var sig os.Signal
+	for sig = range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		// routes and middleware are rebuilt, requests in flight finish with the router they started with
+		nc, err := loadConfig()
+		if err != nil {
+			l.Error("failed to reload configuration, keeping the current one", zap.Error(err))
+			continue
+		}
+		nrt, err := p.build(nc)
+		if err != nil {
+			l.Error("failed to reload configuration, keeping the current one", zap.Error(err))
+			continue
+		}
+		if changed := restartRequired(c, nc); len(changed) > 0 {
+			l.Warn("changed settings take effect after restart", zap.Strings("settings", changed))
+		}
+		_ = level.UnmarshalText([]byte(nc.Log.Level))
+		p.routing.Store(nrt)
+		mux.Store(nrt.router)
+		rt.close()
+		c, rt = nc, nrt
+		l.Info("configuration reloaded")
 	}
 
+	l.Info("shutting down", zap.Stringer("signal", sig), zap.Int("active", drainer.Len()),
+		zap.Duration("timeout", c.ShutdownTimeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	go func() {
+		// the second signal cuts off whatever is left
+		for {
+			select {
+			case sig := <-signals:
+				if sig != syscall.SIGHUP {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// stop accepting, http.Server waits for regular requests, hijacked connections are waited for by drainer
+	if socksServer != nil {
+		_ = socksServer.Close()
+	}
+	_ = server.Shutdown(ctx)
+	err = drainer.Shutdown(ctx)
+	if err != nil {
+		_ = server.Close()
+		l.Warn("shutdown timed out, requests in flight were cut off", zap.Error(err))
+	}
+	if admin != nil {
+		_ = admin.Close()
+	}
+	l.Info("stopped")
+}
+
+// proxy holds the parts of the proxy living as long as the process does. Routes and middleware are rebuilt from
+// configuration on reload, see build.
+type proxy struct {
+	logger   *zap.Logger
+	registry *metrics.Registry
+	metrics  func(string) func(http.Handler) http.Handler
+	issuer   issuer.Issuer
+	certs    certcache.Cache
+	cache    *cache.Cache
+	har      *har.Recorder
+
+	routing atomic.Value // *routing
+}
+
+// routing is the part of the proxy rebuilt on configuration reload.
+type routing struct {
+	router        *router.Router
+	transport     *handlers.VerifyingTransport
+	authenticator auth.Authenticator
+}
+
+// close releases resources of the routing once it's replaced. Idle upstream connections are closed, the busy ones are
+// closed after they become idle for the transport's IdleConnTimeout.
+func (rt *routing) close() {
+	rt.transport.CloseIdleConnections()
+}
+
+func (p *proxy) init(c *config.Config) error {
+	p.metrics = func(string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	if c.AdminListen != "" {
+		p.registry = &metrics.Registry{}
+		p.metrics = (&mwmetrics.Metrics{Registry: p.registry}).Middleware
+	}
+
+	if c.Cache.Enabled {
+		p.cache = &cache.Cache{
+			Storage:       &cache.Memory{MaxSize: c.Cache.MemorySize},
+			MaxObjectSize: c.Cache.MaxObjectSize,
+		}
+		if c.Cache.Dir != "" {
+			p.cache.Storage = &cache.Dir{Path: c.Cache.Dir, MaxSize: c.Cache.DirSize}
+		}
+	}
+
+	if c.HAR.Enabled {
+		p.har = &har.Recorder{
+			Dir:         c.HAR.Dir,
+			MaxBodySize: c.HAR.MaxBodySize,
+			MaxEntries:  c.HAR.MaxEntries,
+		}
+	}
+
+	// validated by config.Config.Validate
+	certKeyAlgorithm, _ := issuer.ParseKeyAlgorithm(c.MITM.KeyAlgorithm)
+	caKeyAlgorithm, _ := issuer.ParseKeyAlgorithm(c.MITM.CAKeyAlgorithm)
 	var (
 		err error
-		l   = zap.New(zapcore.NewCore(
-			zapcore.NewConsoleEncoder(log.DefaultServerLogEncoderConfig()),
-			zapcore.AddSync(serverw),
-			zapcore.InfoLevel,
-		)).Named("cli")
-		lmw = log.Middleware(accessw, serverw, zapcore.InfoLevel)
+		ca  = &issuer.SelfSignedCA{
+			KeyAlgorithm:     certKeyAlgorithm,
+			BitSize:          c.MITM.KeyBits,
+			RootKeyAlgorithm: caKeyAlgorithm,
+		}
 	)
+	switch {
+	case c.MITM.CACert != "" && c.MITM.CAGenerate:
+		err = ca.LoadOrGenerateFiles(c.MITM.CACert, c.MITM.CAKey)
+	case c.MITM.CACert != "":
+		err = ca.LoadFiles(c.MITM.CACert, c.MITM.CAKey)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load CA certificate: %w", err)
+	}
+	if ca.Cert != nil && time.Until(ca.Cert.Leaf.NotAfter) < caExpiryWarning {
+		p.logger.Warn("CA certificate expires soon, MITM intercepted connections will fail after that",
+			zap.String("file", c.MITM.CACert), zap.Time("not-after", ca.Cert.Leaf.NotAfter))
+	}
 
-	var httpMiddleware = []alice.Constructor{
-		lmw,
-		func(next http.Handler) http.Handler {
-			return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
-				log.Named(rq, "http")
-				next.ServeHTTP(rw, rq)
-			})
-		},
+	p.issuer = ca
+	if c.MITM.KeyPool > 0 {
+		pool := &issuer.KeyPool{
+			CA:   ca,
+			Size: c.MITM.KeyPool,
+		}
+		for _, route := range c.Routes {
+			if route.Action == config.ActionMITM {
+				pool.Start()
+			}
+		}
+		p.issuer = pool
+	}
+
+	var certMemCache = &certcache.ARC{Size: c.MITM.CacheSize}
+	p.certs = certMemCache
+	if c.MITM.CacheDir != "" {
+		// certificates are kept apart for each CA, so they are not served after the CA is replaced
+		fingerprint := sha256.Sum256(ca.Cert.Certificate[0])
+		p.certs = certcache.Tiered{p.certs, &certcache.Dir{
+			Path: filepath.Join(c.MITM.CacheDir, hex.EncodeToString(fingerprint[:])),
+		}}
 	}
-	if !*optNoVia {
-		httpMiddleware = append(httpMiddleware, via.Via)
+
+	if p.registry != nil {
+		lookups := p.registry.Counter("multiproxy_cert_cache_lookups_total",
+			"Number of MITM certificate cache lookups.", "result")
+		p.certs = &metrics.CertCache{Cache: p.certs, Hits: lookups.With("hit"), Misses: lookups.With("miss")}
+		p.registry.GaugeFunc("multiproxy_cert_cache_size", "Number of MITM certificates cached in memory.",
+			func() float64 { return float64(certMemCache.Len()) })
+		p.issuer = &metrics.Issuer{
+			Issuer: p.issuer,
+			Duration: p.registry.Histogram("multiproxy_cert_issue_duration_seconds",
+				"Time taken to issue MITM certificates.", nil).With(),
+		}
 	}
-	var mux = &router.Router{
-		Default: alice.New(httpMiddleware...).Then(&handlers.HTTPHandler{
-			NoXForwardedFor: *optNoXForwardedFor,
-		}),
+	return nil
+}
+
+// build creates router, handlers and middleware according to the configuration.
+func (p *proxy) build(c *config.Config) (*routing, error) {
+	var accessw io.Writer = os.Stdout
+	if !c.Log.Access {
+		accessw = ioutil.Discard
 	}
+	var level zapcore.Level
+	_ = level.UnmarshalText([]byte(c.Log.Level))
+	lmw := log.Middleware(accessw, os.Stderr, level)
 
-	var mitmHandler http.Handler = &handlers.MITMHandler{
-		Handler: alice.New(httpMiddleware...).Then(&handlers.HTTPHandler{
-			NoXForwardedFor: *optNoXForwardedFor,
-		}),
+	authenticator, err := proxyAuthenticator(c.Auth)
+	if err != nil {
+		return nil, err
+	}
+	var authmw = func(next http.Handler) http.Handler { return next }
+	if authenticator != nil {
+		authmw = (&auth.Auth{
+			Authenticator: authenticator,
+			Realm:         c.Auth.Realm,
+			Digest:        c.Auth.Digest,
+		}).Middleware
+	}
+
+	var aclmw = func(next http.Handler) http.Handler { return next }
+	if c.ACL != "" {
+		rules, err := acl.Load(c.ACL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load access control rules: %w", err)
+		}
+		aclmw = rules.Middleware
+	}
+
+	throttlemw, err := throttleMiddleware(c.Throttle)
+	if err != nil {
+		return nil, err
 	}
-	var mitmMiddleware = []alice.Constructor{
-		lmw,
-		func(next http.Handler) http.Handler {
-			return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
-				log.Named(rq, "mitm")
-				next.ServeHTTP(rw, rq)
+
+	var ratelimitmw = func(next http.Handler) http.Handler { return next }
+	if len(c.RateLimits) > 0 {
+		limiter := &ratelimit.Limiter{}
+		for _, r := range c.RateLimits {
+			key, _ := ratelimit.ParseKey(r.Key) // validated by config.Config.Validate
+			limiter.Rules = append(limiter.Rules, ratelimit.Rule{
+				Key:           key,
+				Rate:          r.Rate,
+				Burst:         r.Burst,
+				MaxConcurrent: r.MaxConcurrent,
 			})
-		},
+		}
+		ratelimitmw = limiter.Middleware
+	}
+
+	chain := func(name string) alice.Chain {
+		return alice.New(
+			lmw,
+			func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+					log.Named(rq, name)
+					next.ServeHTTP(rw, rq)
+				})
+			},
+			p.metrics(name),
+			aclmw,
+			authmw,
+			ratelimitmw,
+			throttlemw,
+		)
+	}
+
+	// plain HTTP requests and requests intercepted with MITM are served the same way, but told apart in logs and metrics
+	requestChain := func(name string) alice.Chain {
+		ch := chain(name)
+		if p.har != nil {
+			// requests are recorded as they pass access control, authentication and limits, before via modifies them
+			ch = ch.Append(p.har.Middleware)
+		}
+		if c.Headers.Via {
+			ch = ch.Append(via.Via)
+		}
+		if p.cache != nil {
+			ch = ch.Append(p.cache.Middleware)
+		}
+		if c.Log.WebSocket {
+			ch = ch.Append((&websocket.Inspector{MaxPayload: c.Log.WebSocketPayload}).Middleware)
+		}
+		return ch
+	}
+	httpChain, mitmRequestChain, mitmChain := requestChain("http"), requestChain("mitm-request"), chain("mitm")
+	if p.har != nil {
+		mitmChain = mitmChain.Append(p.har.Middleware)
 	}
-	err = registerHandler(mux, alice.New(mitmMiddleware...).Then(mitmHandler), *optMitmHostnames)
+
+	parents, err := upstreamProxy(c.Upstream)
 	if err != nil {
-		l.Fatal("", zap.Error(err))
+		return nil, err
+	}
+	transport, err := upstreamTransport(c.Upstream, parents)
+	if err != nil {
+		return nil, err
 	}
 
-	var tunnelHandler http.Handler = &handlers.Tunnel{
+	var mux = &router.Router{
+		Default: httpChain.Then(&handlers.HTTPHandler{
+			Transport:       transport,
+			NoXForwardedFor: !c.Headers.XForwardedFor,
+		}),
+	}
+
+	certNaming, _ := handlers.ParseCertNaming(c.MITM.Naming) // validated by config.Config.Validate
+	mitmHandler := mitmChain.Then(&handlers.MITMHandler{
+		Issuer:    p.issuer,
+		CertCache: p.certs,
+		Handler: mitmRequestChain.Then(&handlers.HTTPHandler{
+			Transport:       transport,
+			NoXForwardedFor: !c.Headers.XForwardedFor,
+		}),
+		CertNaming:     certNaming,
+		MirrorUpstream: c.MITM.Mirror,
+		DialContext:    parents.DialContext,
+		DialTimeout:    5 * time.Second,
+		NoHTTP2:        !c.MITM.HTTP2,
+	})
+	tunnelHandler := chain("tunnel").Then(&handlers.Tunnel{
+		DialContext: parents.DialContext,
 		DialTimeout: 5 * time.Second,
+		IdleTimeout: c.Tunnel.IdleTimeout,
+		MaxLifetime: c.Tunnel.MaxLifetime,
+	})
+	denyHandler := chain("deny").ThenFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		log.WithStatusCode(rq, http.StatusForbidden)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	})
+
+	for i, route := range c.Routes {
+		for _, host := range route.Hosts {
+			if host == "*" {
+				switch route.Action {
+				case config.ActionMITM:
+					mux.Connect = mitmHandler
+				case config.ActionTunnel:
+					mux.Connect = tunnelHandler
+				case config.ActionDeny:
+					mux.Connect, mux.Default = denyHandler, denyHandler
+				}
+				continue
+			}
+			pattern, err := router.ParsePattern(host)
+			if err != nil {
+				return nil, fmt.Errorf("routes[%d]: %w", i, err)
+			}
+			switch route.Action {
+			case config.ActionMITM:
+				mux.HandleConnectPattern(pattern, mitmHandler)
+			case config.ActionTunnel:
+				mux.HandleConnectPattern(pattern, tunnelHandler)
+			case config.ActionDeny:
+				mux.HandlePattern(pattern, denyHandler)
+			}
+		}
 	}
-	var tunnelMiddleware = []alice.Constructor{
-		lmw,
-		func(next http.Handler) http.Handler {
-			return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
-				log.Named(rq, "tunnel")
-				next.ServeHTTP(rw, rq)
-			})
-		},
+
+	return &routing{router: mux, transport: transport, authenticator: authenticator}, nil
+}
+
+// authenticate verifies credentials of SOCKS5 clients with the authenticator of the current configuration.
+func (p *proxy) authenticate(user, password string) bool {
+	rt := p.routing.Load().(*routing)
+	return rt.authenticator == nil || rt.authenticator.Authenticate(user, password)
+}
+
+func throttleMiddleware(c config.Throttle) (func(http.Handler) http.Handler, error) {
+	t := &throttle.Throttle{
+		Global:  throttle.Limit(c.Global),
+		Client:  throttle.Limit(c.Client),
+		User:    throttle.Limit(c.User),
+		Latency: c.Latency,
 	}
-	err = registerHandler(mux, alice.New(tunnelMiddleware...).Then(tunnelHandler), *optTunnelHostnames)
-	if err != nil {
-		l.Fatal("", zap.Error(err))
+	for _, h := range c.Hosts {
+		limit := throttle.HostLimit{Limit: throttle.Limit(h.Bandwidth)}
+		for _, host := range h.Hosts {
+			p, err := router.ParsePattern(host)
+			if err != nil {
+				return nil, err
+			}
+			limit.Hosts = append(limit.Hosts, p)
+		}
+		t.Hosts = append(t.Hosts, limit)
+	}
+	if t.Global == (throttle.Limit{}) && t.Client == (throttle.Limit{}) && t.User == (throttle.Limit{}) &&
+		len(t.Hosts) == 0 && t.Latency == 0 {
+		return func(next http.Handler) http.Handler { return next }, nil
 	}
+	return t.Middleware, nil
+}
 
-	l.Info("starting", zap.String("listen", *optListen))
+func upstreamProxy(c config.Upstream) (*upstream.Rules, error) {
+	var (
+		r   = &upstream.Rules{}
+		err error
+	)
+	if c.Proxy == "" {
+		r.Environment = true
+	} else {
+		r.Default, err = upstream.ParseURL(c.Proxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range c.Rules {
+		u, err := upstream.ParseURL(rule.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range rule.Hosts {
+			if err = r.Handle(host, u); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
 
-	err = http.ListenAndServe(*optListen, mux)
+func upstreamTransport(c config.Upstream, parents *upstream.Rules) (*handlers.VerifyingTransport, error) {
+	var (
+		t   = &handlers.VerifyingTransport{Base: handlers.DefaultTransport.Clone()}
+		err error
+	)
+	t.Base.Proxy = parents.ProxyFunc
+	if len(c.CA) > 0 {
+		t.RootCAs, err = handlers.SystemCertPoolWith(c.CA...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.SkipVerify = c.Insecure
+	t.OnFailure, err = handlers.ParseVerifyFailure(c.VerifyFailure)
 	if err != nil {
-		l.Fatal("", zap.Error(err))
+		return nil, err
 	}
+	return t, nil
 }
 
-func registerHandler(mux *router.Router, handler http.Handler, hostnames string) error {
-	for _, hostname := range strings.Split(hostnames, ",") {
-		hostname = strings.TrimSpace(hostname)
-		if hostname != "*" {
-			mux.HandleConnectHost(hostname, handler)
-			continue
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
 		}
-		if mux.Connect != nil {
-			return errors.New("multiple fallback handlers specified")
+	}
+	return items
+}
+
+func proxyAuthenticator(c config.Auth) (auth.Authenticator, error) {
+	switch {
+	case c.Htpasswd != "" && len(c.Users) > 0:
+		return nil, errors.New("htpasswd and users are mutually exclusive")
+	case c.Htpasswd != "":
+		return auth.LoadHtpasswd(c.Htpasswd)
+	case len(c.Users) > 0:
+		users := auth.Static{}
+		for _, u := range c.Users {
+			users[u.Name] = u.Password
 		}
-		mux.Connect = handler
+		return users, nil
+	default:
+		return nil, nil
 	}
-	return nil
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/akabos/multiproxy/pkg/config"
+)
+
+func TestRouting_Close(t *testing.T) {
+	var idle, closed int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateIdle:
+			atomic.AddInt32(&idle, 1)
+		case http.StateClosed:
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	c, err := flagConfig()
+	require.NoError(t, err)
+	c.Log.Access = false
+	p := &proxy{logger: zap.NewNop()}
+	require.NoError(t, p.init(c))
+	rt, err := p.build(c)
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	rt.router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, upstream.URL+"/", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	body, _ := ioutil.ReadAll(rw.Body)
+	require.Equal(t, "ok", string(body))
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&idle) == 1 }, time.Second, 10*time.Millisecond)
+
+	// the upstream connection is kept in the pool of the replaced routing until it's closed
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&closed))
+	rt.close()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&closed) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := &config.Config{Listen: ":8080"}
+	c := &config.Config{Listen: ":8080", Auth: config.Auth{Users: []config.User{{Name: "user", Password: "secret"}}}}
+	require.Empty(t, restartRequired(old, c))
+
+	old.SocksListen, c.SocksListen = ":1080", ":1080"
+	require.Equal(t, []string{"auth"}, restartRequired(old, c))
+	require.Empty(t, restartRequired(c, c))
+}
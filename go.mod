@@ -3,6 +3,7 @@ module github.com/akabos/multiproxy
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/google/uuid v1.1.4
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/justinas/alice v1.2.0
@@ -10,4 +11,6 @@ require (
 	github.com/stretchr/testify v1.6.1
 	go.uber.org/zap v1.16.0
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
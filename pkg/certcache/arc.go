@@ -0,0 +1,62 @@
+package certcache
+
+import (
+	"crypto/tls"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// ARC is an in-memory Cache with adaptive replacement policy.
+//
+// Zero value is a valid instance.
+type ARC struct {
+	// Size defines the maximum number of certificates kept in cache.
+	//
+	// If 0, DefaultSize will be used.
+	Size int
+
+	once  sync.Once
+	cache *lru.ARCCache
+}
+
+func (c *ARC) init() {
+	if c.Size == 0 {
+		c.Size = DefaultSize
+	}
+	c.cache, _ = lru.NewARC(c.Size)
+}
+
+// Get implements Cache interface
+func (c *ARC) Get(key string) (*tls.Certificate, error) {
+	c.once.Do(c.init)
+	x, ok := c.cache.Get(key)
+	if !ok {
+		return nil, ErrMiss
+	}
+	cert, ok := x.(*tls.Certificate)
+	if !ok {
+		panic("invalid value in cache")
+	}
+	if expired(cert) {
+		c.cache.Remove(key)
+		return nil, ErrMiss
+	}
+	return cert, nil
+}
+
+// Add implements Cache interface
+func (c *ARC) Add(key string, cert *tls.Certificate) error {
+	c.once.Do(c.init)
+	c.cache.Add(key, cert)
+	return nil
+}
+
+// Len returns the number of certificates in cache.
+func (c *ARC) Len() int {
+	c.once.Do(c.init)
+	return c.cache.Len()
+}
+
+// DefaultSize defines default size for in-memory cache.
+const DefaultSize = 1024
@@ -0,0 +1,34 @@
+// Package certcache implements certificate caches for MITMHandler.
+package certcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+// Cache defines interface for certificate cache.
+type Cache interface {
+	// Get returns certificate stored under the key. Returns ErrMiss if there's no such certificate or it has expired.
+	Get(key string) (*tls.Certificate, error)
+
+	// Add stores certificate under the key.
+	Add(key string, cert *tls.Certificate) error
+}
+
+// ErrMiss is returned by Cache.Get if there's no valid certificate under the key.
+var ErrMiss = errors.New("certificate cache miss")
+
+// expired reports whether certificate has expired. Certificates with unparsable leaf are considered expired.
+func expired(cert *tls.Certificate) bool {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return true
+		}
+	}
+	return time.Now().After(leaf.NotAfter)
+}
@@ -0,0 +1,120 @@
+package certcache_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/certcache"
+)
+
+func testCert(t *testing.T, cn string, notAfter time.Time) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notAfter.Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func testCache(t *testing.T, c certcache.Cache) {
+	t.Run("miss", func(t *testing.T) {
+		_, err := c.Get("missing.example.com")
+		require.Equal(t, certcache.ErrMiss, err)
+	})
+	t.Run("hit", func(t *testing.T) {
+		cert := testCert(t, "example.com", time.Now().Add(time.Hour))
+		require.NoError(t, c.Add("example.com", cert))
+		got, err := c.Get("example.com")
+		require.NoError(t, err)
+		require.Equal(t, cert.Certificate[0], got.Certificate[0])
+	})
+	t.Run("wildcard and ip keys", func(t *testing.T) {
+		for _, key := range []string{"*.example.com", "::1", "127.0.0.1"} {
+			cert := testCert(t, key, time.Now().Add(time.Hour))
+			require.NoError(t, c.Add(key, cert))
+			got, err := c.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, cert.Certificate[0], got.Certificate[0])
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		require.NoError(t, c.Add("expired.example.com", testCert(t, "expired.example.com", time.Now().Add(-time.Minute))))
+		_, err := c.Get("expired.example.com")
+		require.Equal(t, certcache.ErrMiss, err)
+	})
+}
+
+func TestARC(t *testing.T) {
+	testCache(t, &certcache.ARC{})
+
+	t.Run("size", func(t *testing.T) {
+		c := &certcache.ARC{Size: 2}
+		for _, key := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+			require.NoError(t, c.Add(key, testCert(t, key, time.Now().Add(time.Hour))))
+		}
+		require.Equal(t, 2, c.Len())
+	})
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	testCache(t, &certcache.Dir{Path: dir})
+
+	t.Run("persistence", func(t *testing.T) {
+		cert := testCert(t, "persistent.example.com", time.Now().Add(time.Hour))
+		require.NoError(t, (&certcache.Dir{Path: dir}).Add("persistent.example.com", cert))
+
+		got, err := (&certcache.Dir{Path: dir}).Get("persistent.example.com")
+		require.NoError(t, err)
+		require.Equal(t, cert.Certificate[0], got.Certificate[0])
+	})
+
+	t.Run("expired removed", func(t *testing.T) {
+		dir := t.TempDir()
+		c := &certcache.Dir{Path: dir}
+		require.NoError(t, c.Add("expired.example.com", testCert(t, "expired.example.com", time.Now().Add(-time.Minute))))
+		_, _ = c.Get("expired.example.com")
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, files)
+	})
+}
+
+func TestTiered(t *testing.T) {
+	var (
+		mem  = &certcache.ARC{}
+		disk = &certcache.Dir{Path: t.TempDir()}
+	)
+	testCache(t, certcache.Tiered{mem, disk})
+
+	t.Run("promote", func(t *testing.T) {
+		cert := testCert(t, "promoted.example.com", time.Now().Add(time.Hour))
+		require.NoError(t, disk.Add("promoted.example.com", cert))
+
+		_, err := mem.Get("promoted.example.com")
+		require.Equal(t, certcache.ErrMiss, err)
+
+		_, err = certcache.Tiered{mem, disk}.Get("promoted.example.com")
+		require.NoError(t, err)
+
+		_, err = mem.Get("promoted.example.com")
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,63 @@
+package certcache
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/akabos/multiproxy/pkg/issuer"
+)
+
+// Dir is a Cache which stores certificates on disk, so they survive restarts. Each certificate is stored in a separate
+// file named after the key, containing PEM encoded chain followed by the private key. Expired certificates are removed
+// upon access.
+//
+// Dir doesn't hold anything in memory. It is supposed to be used behind an in-memory cache, see Tiered.
+type Dir struct {
+	// Path is the cache directory. It will be created on the first Add if doesn't exist.
+	Path string
+}
+
+// Get implements Cache interface
+func (c *Dir) Get(key string) (*tls.Certificate, error) {
+	f := c.filename(key)
+	cert, err := issuer.LoadCert(f, "")
+	if os.IsNotExist(err) {
+		return nil, ErrMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expired(cert) {
+		_ = os.Remove(f)
+		return nil, ErrMiss
+	}
+	return cert, nil
+}
+
+// Add implements Cache interface
+func (c *Dir) Add(key string, cert *tls.Certificate) error {
+	err := os.MkdirAll(c.Path, 0700)
+	if err != nil {
+		return err
+	}
+	// write into a temporary file first, so concurrent readers never see partially written certificate
+	tmp, err := ioutil.TempFile(c.Path, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err = issuer.SaveCert(cert, tmp.Name(), "")
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.filename(key))
+}
+
+func (c *Dir) filename(key string) string {
+	return filepath.Join(c.Path, url.QueryEscape(key)+".pem")
+}
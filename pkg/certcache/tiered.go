@@ -0,0 +1,39 @@
+package certcache
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// Tiered is a Cache combining several caches, e.g. fast in-memory ARC in front of persistent Dir. Get looks up caches
+// in order and populates upper tiers with certificates found in lower ones. Add stores certificate in all tiers.
+type Tiered []Cache
+
+// Get implements Cache interface
+func (c Tiered) Get(key string) (*tls.Certificate, error) {
+	for i := range c {
+		cert, err := c[i].Get(key)
+		if errors.Is(err, ErrMiss) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < i; j++ {
+			_ = c[j].Add(key, cert)
+		}
+		return cert, nil
+	}
+	return nil, ErrMiss
+}
+
+// Add implements Cache interface
+func (c Tiered) Add(key string, cert *tls.Certificate) error {
+	for i := range c {
+		err := c[i].Add(key, cert)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
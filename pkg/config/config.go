@@ -0,0 +1,436 @@
+// Package config implements the proxy configuration file.
+//
+// The file is YAML, JSON being a subset of YAML is accepted as well, or TOML if its name has .toml extension. Keys are
+// the snake_case names of the fields, see the yaml tags. Settings missing in the file keep the values Config had before
+// loading it, so command line flags could provide defaults for the file.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/issuer"
+	"github.com/akabos/multiproxy/pkg/middleware/ratelimit"
+	"github.com/akabos/multiproxy/pkg/router"
+	"github.com/akabos/multiproxy/pkg/upstream"
+)
+
+// Config is the proxy configuration.
+type Config struct {
+	// Listen is the address of HTTP proxy server.
+	Listen string `yaml:"listen"`
+
+	// SocksListen is the address of SOCKS5 server, SOCKS5 is disabled if empty.
+	SocksListen string `yaml:"socks_listen"`
+
+	// AdminListen is the address of admin server serving metrics, disabled if empty.
+	AdminListen string `yaml:"admin_listen"`
+
+	// ShutdownTimeout is the time to wait for requests in flight to finish on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	Log      Log      `yaml:"log"`
+	Routes   []Route  `yaml:"routes"`
+	ACL      string   `yaml:"acl"`
+	Auth     Auth     `yaml:"auth"`
+	Headers  Headers  `yaml:"headers"`
+	Cache    Cache    `yaml:"cache"`
+	Tunnel   Tunnel   `yaml:"tunnel"`
+	Throttle Throttle `yaml:"throttle"`
+	HAR      HAR      `yaml:"har"`
+
+	// RateLimits are all checked for every request, requests over any of the limits are rejected.
+	RateLimits []RateLimit `yaml:"rate_limits"`
+
+	Upstream Upstream `yaml:"upstream"`
+	MITM     MITM     `yaml:"mitm"`
+}
+
+// Log configures logging.
+type Log struct {
+	// Level is the server log level: debug, info, warn or error.
+	Level string `yaml:"level"`
+
+	// Access enables access log.
+	Access bool `yaml:"access"`
+
+	// WebSocket enables logging of WebSocket messages of plain HTTP and MITM intercepted connections.
+	WebSocket bool `yaml:"websocket"`
+
+	// WebSocketPayload is how many bytes of text message payload to log.
+	WebSocketPayload int `yaml:"websocket_payload"`
+}
+
+// Action is what the proxy does with CONNECT requests to hosts of a route.
+type Action string
+
+// Supported actions
+const (
+	ActionMITM   Action = "mitm"
+	ActionTunnel Action = "tunnel"
+	ActionDeny   Action = "deny"
+)
+
+// Route assigns the action to target hosts. Routes are matched in order, the first one matching wins. The host `*`
+// makes the route a fallback for hosts no route matches, regardless of its position.
+//
+// MITM and tunnel routes only apply to CONNECT requests, deny routes apply to plain HTTP requests as well.
+type Route struct {
+	// Hosts are router.Pattern host patterns.
+	Hosts  []string `yaml:"hosts"`
+	Action Action   `yaml:"action"`
+}
+
+// Auth configures proxy authentication. It's enabled if either Htpasswd or Users is set.
+type Auth struct {
+	// Htpasswd is the htpasswd file with allowed users.
+	Htpasswd string `yaml:"htpasswd"`
+
+	// Users are allowed users.
+	Users []User `yaml:"users"`
+
+	// Realm is the authentication realm.
+	Realm string `yaml:"realm"`
+
+	// Digest offers Digest authentication in addition to Basic, only works with Users.
+	Digest bool `yaml:"digest"`
+}
+
+// User is a user name and password pair.
+type User struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+}
+
+// Headers configures proxy headers added to requests.
+type Headers struct {
+	Via           bool `yaml:"via"`
+	XForwardedFor bool `yaml:"x_forwarded_for"`
+}
+
+// Cache configures response cache.
+type Cache struct {
+	Enabled bool `yaml:"enabled"`
+
+	// MemorySize is the maximum size of in-memory cache in bytes.
+	MemorySize int64 `yaml:"memory_size"`
+
+	// Dir is the directory to store cached responses in instead of memory.
+	Dir string `yaml:"dir"`
+
+	// DirSize is the maximum size of Dir in bytes.
+	DirSize int64 `yaml:"dir_size"`
+
+	// MaxObjectSize is the maximum size of cached response body in bytes.
+	MaxObjectSize int64 `yaml:"max_object_size"`
+}
+
+// Tunnel configures tunneled connections. Zero durations disable the limits.
+type Tunnel struct {
+	// IdleTimeout is the time after which the tunnel with no data going in either direction is closed.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// MaxLifetime is the time after which the tunnel is closed regardless of activity.
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+}
+
+// Throttle configures bandwidth limits of plain HTTP requests, tunnels and MITM intercepted connections.
+type Throttle struct {
+	// Latency is added to every request to simulate slow networks.
+	Latency time.Duration `yaml:"latency"`
+
+	// Global limits all requests together.
+	Global Bandwidth `yaml:"global"`
+
+	// Client limits requests of each client address.
+	Client Bandwidth `yaml:"client"`
+
+	// User limits requests of each authenticated user.
+	User Bandwidth `yaml:"user"`
+
+	// Hosts limit requests to target hosts, the first rule matching the target applies.
+	Hosts []HostBandwidth `yaml:"hosts"`
+}
+
+// Bandwidth is the bandwidth limit in bytes per second. Zero means no limit.
+type Bandwidth struct {
+	Download int64 `yaml:"download"`
+	Upload   int64 `yaml:"upload"`
+}
+
+// HostBandwidth limits bandwidth of requests to target hosts.
+type HostBandwidth struct {
+	// Hosts are router.Pattern host patterns.
+	Hosts     []string `yaml:"hosts"`
+	Bandwidth `yaml:",inline"`
+}
+
+// RateLimit limits rate and concurrency of requests sharing the key. Zero limits are not enforced.
+type RateLimit struct {
+	// Key is what requests share the limit: client, user or host.
+	Key string `yaml:"key"`
+
+	// Rate is the number of requests per second.
+	Rate float64 `yaml:"rate"`
+
+	// Burst is the number of requests allowed to go at once over Rate, Rate rounded up by default.
+	Burst int `yaml:"burst"`
+
+	// MaxConcurrent is the number of requests served at once, tunnels and MITM intercepted connections included.
+	MaxConcurrent int `yaml:"max_concurrent"`
+}
+
+// HAR configures recording of plain HTTP and MITM intercepted requests in HAR format. Recorded requests are served at
+// /har of the admin server, each session may be written into a separate file as well.
+type HAR struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Dir is the directory to write HAR file of each session to.
+	Dir string `yaml:"dir"`
+
+	// MaxBodySize is the number of bytes of request and response bodies recorded.
+	MaxBodySize int64 `yaml:"max_body_size"`
+
+	// MaxEntries is the number of the most recent requests kept in memory.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// Upstream configures connections to target servers and parent proxies.
+type Upstream struct {
+	// Proxy is the parent proxy URL or upstream.Direct. If empty, parent proxy is taken from environment variables.
+	Proxy string `yaml:"proxy"`
+
+	// Rules override Proxy for matching target hosts.
+	Rules []ProxyRule `yaml:"rules"`
+
+	// CA are PEM files with CA certificates to trust in addition to system ones.
+	CA []string `yaml:"ca"`
+
+	// Insecure are host patterns of target servers which certificates are not verified.
+	Insecure []string `yaml:"insecure"`
+
+	// VerifyFailure is what to do if target server certificate fails verification: reject or warn.
+	VerifyFailure string `yaml:"verify_failure"`
+}
+
+// ProxyRule selects parent proxy for target hosts.
+type ProxyRule struct {
+	Hosts []string `yaml:"hosts"`
+	Proxy string   `yaml:"proxy"`
+}
+
+// MITM configures certificates of MITM intercepted connections.
+type MITM struct {
+	CACert         string `yaml:"ca_cert"`
+	CAKey          string `yaml:"ca_key"`
+	CAGenerate     bool   `yaml:"ca_generate"`
+	CAKeyAlgorithm string `yaml:"ca_key_algorithm"`
+	KeyAlgorithm   string `yaml:"key_algorithm"`
+	KeyBits        int    `yaml:"key_bits"`
+	KeyPool        int    `yaml:"key_pool"`
+	CacheSize      int    `yaml:"cache_size"`
+	CacheDir       string `yaml:"cache_dir"`
+	Naming         string `yaml:"naming"`
+	Mirror         bool   `yaml:"mirror"`
+	HTTP2          bool   `yaml:"http2"`
+}
+
+// Load reads the file into the configuration and validates the result. Files with .toml extension are decoded with
+// DecodeTOML, others with Decode.
+func (c *Config) Load(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	decode := c.Decode
+	if strings.EqualFold(filepath.Ext(filename), ".toml") {
+		decode = c.DecodeTOML
+	}
+	err = decode(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// Decode reads YAML or JSON document into the configuration and validates the result. Unknown keys are errors.
+func (c *Config) Decode(r io.Reader) error {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	err := dec.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return c.Validate()
+}
+
+// DecodeTOML reads TOML document into the configuration and validates the result. The document is converted into YAML
+// and decoded with Decode, so keys and values are the same, e.g. durations are strings.
+func (c *Config) DecodeTOML(r io.Reader) error {
+	var doc map[string]interface{}
+	_, err := toml.DecodeReader(r, &doc)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return c.Decode(bytes.NewReader(b))
+}
+
+// Validate checks the configuration for errors.
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return errors.New("listen: address is required")
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return fmt.Errorf("log.level: %w", err)
+	}
+	if c.Log.WebSocketPayload < 0 {
+		return errors.New("log.websocket_payload: must not be negative")
+	}
+
+	fallback := false
+	for i, r := range c.Routes {
+		switch r.Action {
+		case ActionMITM, ActionTunnel, ActionDeny:
+		default:
+			return fmt.Errorf("routes[%d]: unknown action %q", i, r.Action)
+		}
+		if len(r.Hosts) == 0 {
+			return fmt.Errorf("routes[%d]: hosts are required", i)
+		}
+		for _, host := range r.Hosts {
+			if host == "*" {
+				if fallback {
+					return fmt.Errorf("routes[%d]: multiple fallback routes", i)
+				}
+				fallback = true
+				continue
+			}
+			if _, err := router.ParsePattern(host); err != nil {
+				return fmt.Errorf("routes[%d]: %w", i, err)
+			}
+		}
+	}
+
+	if c.Auth.Htpasswd != "" && len(c.Auth.Users) > 0 {
+		return errors.New("auth: htpasswd and users are mutually exclusive")
+	}
+	if c.Auth.Digest && len(c.Auth.Users) == 0 {
+		return errors.New("auth.digest: only works with users")
+	}
+	for i, u := range c.Auth.Users {
+		if u.Name == "" {
+			return fmt.Errorf("auth.users[%d]: name is required", i)
+		}
+	}
+
+	if c.Cache.Enabled && (c.Cache.MemorySize <= 0 || c.Cache.DirSize <= 0 || c.Cache.MaxObjectSize <= 0) {
+		return errors.New("cache: sizes must be positive")
+	}
+
+	if c.Tunnel.IdleTimeout < 0 {
+		return errors.New("tunnel.idle_timeout: must not be negative")
+	}
+	if c.Tunnel.MaxLifetime < 0 {
+		return errors.New("tunnel.max_lifetime: must not be negative")
+	}
+
+	if c.Throttle.Latency < 0 {
+		return errors.New("throttle.latency: must not be negative")
+	}
+	for name, b := range map[string]Bandwidth{
+		"global": c.Throttle.Global,
+		"client": c.Throttle.Client,
+		"user":   c.Throttle.User,
+	} {
+		if b.Download < 0 || b.Upload < 0 {
+			return fmt.Errorf("throttle.%s: must not be negative", name)
+		}
+	}
+	for i, h := range c.Throttle.Hosts {
+		if len(h.Hosts) == 0 {
+			return fmt.Errorf("throttle.hosts[%d]: hosts are required", i)
+		}
+		for _, host := range h.Hosts {
+			if _, err := router.ParsePattern(host); err != nil {
+				return fmt.Errorf("throttle.hosts[%d]: %w", i, err)
+			}
+		}
+		if h.Download < 0 || h.Upload < 0 {
+			return fmt.Errorf("throttle.hosts[%d]: must not be negative", i)
+		}
+	}
+
+	if c.HAR.Enabled && c.AdminListen == "" && c.HAR.Dir == "" {
+		return errors.New("har: requires either admin_listen or dir")
+	}
+	if c.HAR.Enabled && (c.HAR.MaxBodySize <= 0 || c.HAR.MaxEntries <= 0) {
+		return errors.New("har: sizes must be positive")
+	}
+
+	for i, r := range c.RateLimits {
+		if _, err := ratelimit.ParseKey(r.Key); err != nil {
+			return fmt.Errorf("rate_limits[%d]: %w", i, err)
+		}
+		if r.Rate < 0 || r.Burst < 0 || r.MaxConcurrent < 0 {
+			return fmt.Errorf("rate_limits[%d]: limits must not be negative", i)
+		}
+	}
+
+	if c.Upstream.Proxy != "" {
+		if _, err := upstream.ParseURL(c.Upstream.Proxy); err != nil {
+			return fmt.Errorf("upstream.proxy: %w", err)
+		}
+	}
+	for i, r := range c.Upstream.Rules {
+		if _, err := upstream.ParseURL(r.Proxy); err != nil {
+			return fmt.Errorf("upstream.rules[%d]: %w", i, err)
+		}
+		for _, host := range r.Hosts {
+			if _, err := router.ParsePattern(host); err != nil {
+				return fmt.Errorf("upstream.rules[%d]: %w", i, err)
+			}
+		}
+	}
+	for _, host := range c.Upstream.Insecure {
+		if _, err := router.ParsePattern(host); err != nil {
+			return fmt.Errorf("upstream.insecure: %w", err)
+		}
+	}
+	if _, err := handlers.ParseVerifyFailure(c.Upstream.VerifyFailure); err != nil {
+		return fmt.Errorf("upstream.verify_failure: %w", err)
+	}
+
+	if c.MITM.CAGenerate && c.MITM.CACert == "" {
+		return errors.New("mitm.ca_generate: requires ca_cert")
+	}
+	if c.MITM.CacheDir != "" && c.MITM.CACert == "" {
+		// certificates signed by a root generated on startup are useless after restart
+		return errors.New("mitm.cache_dir: requires ca_cert")
+	}
+	if _, err := issuer.ParseKeyAlgorithm(c.MITM.CAKeyAlgorithm); err != nil {
+		return fmt.Errorf("mitm.ca_key_algorithm: %w", err)
+	}
+	if _, err := issuer.ParseKeyAlgorithm(c.MITM.KeyAlgorithm); err != nil {
+		return fmt.Errorf("mitm.key_algorithm: %w", err)
+	}
+	if _, err := handlers.ParseCertNaming(c.MITM.Naming); err != nil {
+		return fmt.Errorf("mitm.naming: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/config"
+)
+
+func base() *config.Config {
+	return &config.Config{
+		Listen:          "127.0.0.1:8080",
+		ShutdownTimeout: 30 * time.Second,
+		Log:             config.Log{Level: "info", Access: true},
+		Routes:          []config.Route{{Hosts: []string{"*"}, Action: config.ActionTunnel}},
+		Headers:         config.Headers{Via: true, XForwardedFor: true},
+		Tunnel:          config.Tunnel{IdleTimeout: 10 * time.Minute},
+		Upstream:        config.Upstream{VerifyFailure: "reject"},
+		MITM: config.MITM{
+			CAKeyAlgorithm: "rsa",
+			KeyAlgorithm:   "rsa",
+			Naming:         "exact",
+		},
+	}
+}
+
+func TestConfig_Decode(t *testing.T) {
+	c := base()
+	require.NoError(t, c.Decode(strings.NewReader(`
+listen: 0.0.0.0:3128
+shutdown_timeout: 2m
+log:
+  level: debug
+routes:
+  - hosts: [".example.com", "10.0.0.0/8"]
+    action: mitm
+  - hosts: ["ads.example.org"]
+    action: deny
+tunnel:
+  max_lifetime: 24h
+throttle:
+  client: {download: 65536}
+  hosts:
+    - hosts: [".example.net"]
+      download: 1024
+      upload: 512
+rate_limits:
+  - key: client
+    rate: 10
+    max_concurrent: 100
+auth:
+  users:
+    - name: alice
+      password: secret
+upstream:
+  rules:
+    - hosts: [".corp.example.com"]
+      proxy: direct
+mitm:
+  naming: parent
+`)))
+	require.Equal(t, "0.0.0.0:3128", c.Listen)
+	require.Equal(t, 2*time.Minute, c.ShutdownTimeout)
+	require.Equal(t, config.Log{Level: "debug", Access: true}, c.Log)
+	require.Equal(t, []config.Route{
+		{Hosts: []string{".example.com", "10.0.0.0/8"}, Action: config.ActionMITM},
+		{Hosts: []string{"ads.example.org"}, Action: config.ActionDeny},
+	}, c.Routes)
+	require.Equal(t, config.Tunnel{IdleTimeout: 10 * time.Minute, MaxLifetime: 24 * time.Hour}, c.Tunnel)
+	require.Equal(t, config.Throttle{
+		Client: config.Bandwidth{Download: 65536},
+		Hosts: []config.HostBandwidth{
+			{Hosts: []string{".example.net"}, Bandwidth: config.Bandwidth{Download: 1024, Upload: 512}},
+		},
+	}, c.Throttle)
+	require.Equal(t, []config.RateLimit{{Key: "client", Rate: 10, MaxConcurrent: 100}}, c.RateLimits)
+	require.Equal(t, []config.User{{Name: "alice", Password: "secret"}}, c.Auth.Users)
+	require.Equal(t, []config.ProxyRule{{Hosts: []string{".corp.example.com"}, Proxy: "direct"}}, c.Upstream.Rules)
+	require.Equal(t, "parent", c.MITM.Naming)
+	// missing settings are kept
+	require.Equal(t, config.Headers{Via: true, XForwardedFor: true}, c.Headers)
+	require.Equal(t, "rsa", c.MITM.KeyAlgorithm)
+}
+
+func TestConfig_DecodeJSON(t *testing.T) {
+	c := base()
+	require.NoError(t, c.Decode(strings.NewReader(`{"headers": {"via": false}, "cache": {"enabled": true,
+		"memory_size": 1024, "dir_size": 2048, "max_object_size": 512}}`)))
+	require.Equal(t, config.Headers{XForwardedFor: true}, c.Headers)
+	require.Equal(t, config.Cache{Enabled: true, MemorySize: 1024, DirSize: 2048, MaxObjectSize: 512}, c.Cache)
+}
+
+func TestConfig_DecodeTOML(t *testing.T) {
+	c := base()
+	require.NoError(t, c.DecodeTOML(strings.NewReader(`
+shutdown_timeout = "1m"
+
+[headers]
+via = false
+
+[[routes]]
+hosts = [".example.com", "10.0.0.0/8"]
+action = "mitm"
+`)))
+	require.Equal(t, time.Minute, c.ShutdownTimeout)
+	require.Equal(t, config.Headers{XForwardedFor: true}, c.Headers)
+	require.Equal(t, []config.Route{{Hosts: []string{".example.com", "10.0.0.0/8"}, Action: config.ActionMITM}}, c.Routes)
+
+	err := base().DecodeTOML(strings.NewReader(`lisen = "127.0.0.1:8080"`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "field lisen not found")
+	require.Error(t, base().DecodeTOML(strings.NewReader(`listen = `)))
+}
+
+func TestConfig_DecodeEmpty(t *testing.T) {
+	c := base()
+	require.NoError(t, c.Decode(strings.NewReader("")))
+	require.Equal(t, base(), c)
+}
+
+func TestConfig_DecodeInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		doc, err string
+	}{
+		{"lisen: 127.0.0.1:8080", "field lisen not found"},
+		{"listen: ''", "listen: address is required"},
+		{"log: {level: verbose}", "log.level"},
+		{"routes: [{hosts: [example.com], action: block}]", `routes[0]: unknown action "block"`},
+		{"routes: [{action: mitm}]", "routes[0]: hosts are required"},
+		{"routes: [{hosts: ['*'], action: mitm}, {hosts: ['*'], action: deny}]", "routes[1]: multiple fallback routes"},
+		{"routes: [{hosts: ['10.0.0.0/33'], action: deny}]", "routes[0]"},
+		{"auth: {htpasswd: /etc/htpasswd, users: [{name: a, password: b}]}", "mutually exclusive"},
+		{"auth: {digest: true}", "auth.digest"},
+		{"cache: {enabled: true}", "cache: sizes must be positive"},
+		{"tunnel: {idle_timeout: -1s}", "tunnel.idle_timeout"},
+		{"throttle: {user: {upload: -1}}", "throttle.user"},
+		{"throttle: {hosts: [{download: 1024}]}", "throttle.hosts[0]: hosts are required"},
+		{"rate_limits: [{key: path, rate: 1}]", `rate_limits[0]: unknown key: "path"`},
+		{"rate_limits: [{key: host, max_concurrent: -1}]", "rate_limits[0]"},
+		{"har: {enabled: true, max_body_size: 1, max_entries: 1}", "har: requires either admin_listen or dir"},
+		{"har: {enabled: true, dir: /tmp}", "har: sizes must be positive"},
+		{"upstream: {proxy: 'ftp://example.com:21'}", "upstream.proxy"},
+		{"upstream: {rules: [{hosts: [example.com], proxy: 'http://example.com'}]}", "upstream.rules[0]"},
+		{"upstream: {verify_failure: ignore}", "upstream.verify_failure"},
+		{"mitm: {ca_generate: true}", "mitm.ca_generate"},
+		{"mitm: {cache_dir: /tmp}", "mitm.cache_dir"},
+		{"mitm: {key_algorithm: dsa}", "mitm.key_algorithm"},
+		{"mitm: {naming: wildcard}", "mitm.naming"},
+		{"shutdown_timeout: soon", "into time.Duration"},
+	} {
+		err := base().Decode(strings.NewReader(tc.doc))
+		require.Error(t, err, tc.doc)
+		require.Contains(t, err.Error(), tc.err, tc.doc)
+	}
+}
+
+func TestConfig_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "multiproxy.yaml")
+
+	require.Error(t, base().Load(filename))
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("acl: /etc/multiproxy/acl\n"), 0600))
+	c := base()
+	require.NoError(t, c.Load(filename))
+	require.Equal(t, "/etc/multiproxy/acl", c.ACL)
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("acl: [\n"), 0600))
+	err = base().Load(filename)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), filename)
+
+	filename = filepath.Join(dir, "multiproxy.toml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("acl = \"/etc/multiproxy/acl\"\n"), 0600))
+	c = base()
+	require.NoError(t, c.Load(filename))
+	require.Equal(t, "/etc/multiproxy/acl", c.ACL)
+}
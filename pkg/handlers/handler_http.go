@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -11,6 +11,8 @@ import (
 	"sync"
 	"time"
 
+	"go.uber.org/zap"
+
 	"github.com/akabos/multiproxy/pkg/middleware/log"
 )
 
@@ -78,6 +80,10 @@ func (s *HTTPHandler) modifyResponse(rs *http.Response) error {
 	rq := rs.Request
 
 	log.WithStatusCode(rq, rs.StatusCode)
+	if rs.StatusCode == http.StatusSwitchingProtocols {
+		// the body is the upgraded connection, httputil.ReverseProxy splices it with the client connection
+		return nil
+	}
 	if rs.ContentLength >= 0 {
 		log.WithContentLength(rq, int(rs.ContentLength))
 		return nil
@@ -101,10 +107,22 @@ func (s *HTTPHandler) modifyResponse(rs *http.Response) error {
 }
 
 func (s *HTTPHandler) handleError(rw http.ResponseWriter, rq *http.Request, err error) {
+	var certErr *UpstreamCertError
+	if !errors.As(err, &certErr) && isCertError(err) {
+		certErr = &UpstreamCertError{Host: rq.URL.Host, Err: err}
+	}
+	if certErr != nil {
+		log.WithStatusCode(rq, http.StatusBadGateway)
+		log.Warn(rq, "upstream certificate verification failed", zap.Error(err))
+		http.Error(rw, http.StatusText(http.StatusBadGateway)+"\n\n"+certErr.Error(), http.StatusBadGateway)
+		return
+	}
 	if _, ok := err.(*net.OpError); ok {
+		log.WithStatusCode(rq, http.StatusBadGateway)
 		http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 		return
 	}
+	log.WithStatusCode(rq, http.StatusInternalServerError)
 	http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	return
 }
@@ -121,9 +139,6 @@ var DefaultTransport = &http.Transport{
 	TLSHandshakeTimeout:   10 * time.Second,
 	ExpectContinueTimeout: 1 * time.Second,
 	MaxIdleConnsPerHost:   runtime.GOMAXPROCS(0) + 1,
-	TLSClientConfig: &tls.Config{
-		InsecureSkipVerify: true,
-	},
 	DisableCompression: true,
 	DisableKeepAlives:  false,
 }
@@ -2,22 +2,27 @@ package handlers
 
 import (
 	"bufio"
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/url"
+	"net/http/httputil"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	lru "github.com/hashicorp/golang-lru"
 	"go.uber.org/zap"
-	"golang.org/x/net/publicsuffix"
+	"golang.org/x/net/http2"
 
+	"github.com/akabos/multiproxy/pkg/certcache"
 	"github.com/akabos/multiproxy/pkg/issuer"
 	"github.com/akabos/multiproxy/pkg/middleware/log"
 )
@@ -36,15 +41,44 @@ type MITMHandler struct {
 	// If Issuer is nil, issuer.SelfSignedCA will be used.
 	Issuer issuer.Issuer
 
-	// CertCacheSize specifies the size of certificate cache used by the proxy.
+	// CertCache specifies optional certificate cache.
 	//
-	// If CertCacheSize is 0, platform-specific max int value will be used.
+	// If CertCache is nil, certcache.ARC of CertCacheSize will be used.
+	CertCache certcache.Cache
+
+	// CertCacheSize specifies the size of default in-memory certificate cache. Ignored if CertCache is set.
+	//
+	// If CertCacheSize is 0, certcache.DefaultSize will be used.
 	CertCacheSize int
 
+	// CertNaming specifies the policy for naming issued certificates. Ignored for certificates mirrored from upstream.
+	//
+	// The zero value is CertNamingExact.
+	CertNaming CertNaming
+
+	// MirrorUpstream instructs the proxy to connect to the target server before issuing a certificate and to copy
+	// subject, alternative names and validity period of the server's certificate into issued one. Issuer must implement
+	// issuer.MirrorIssuer for that to work. If the target server can't be reached, the certificate is issued as usual.
+	MirrorUpstream bool
+
+	// DialContext specifies the dial function for connecting to target servers when MirrorUpstream is on.
+	//
+	// If DialContext is nil then the proxy dials using package net.
+	DialContext func(context.Context, string, string) (net.Conn, error)
+
+	// DialTimeout specifies an optional timeout for connecting to target servers including TLS handshake.
+	DialTimeout time.Duration
+
+	// NoHTTP2 disables negotiation of HTTP/2 with clients of intercepted connections. If set, clients will be forced
+	// to use HTTP/1.1.
+	NoHTTP2 bool
+
 	once sync.Once
 
-	certCache    *lru.ARCCache
-	certCacheMux sync.Mutex
+	h2 *http2.Server
+
+	certCalls    map[string]*certCall
+	certCallsMux sync.Mutex
 }
 
 func (s *MITMHandler) init() {
@@ -54,10 +88,17 @@ func (s *MITMHandler) init() {
 	if s.Issuer == nil {
 		s.Issuer = &issuer.SelfSignedCA{}
 	}
-	if s.CertCacheSize == 0 {
-		s.CertCacheSize = int(^uint(0) >> 1)
+	if s.CertCache == nil {
+		s.CertCache = &certcache.ARC{Size: s.CertCacheSize}
+	}
+	s.certCalls = make(map[string]*certCall)
+	if s.DialContext == nil {
+		d := net.Dialer{}
+		s.DialContext = d.DialContext
+	}
+	if !s.NoHTTP2 {
+		s.h2 = &http2.Server{}
 	}
-	s.certCache, _ = lru.NewARC(s.CertCacheSize)
 }
 
 func (s *MITMHandler) httpError(rw http.ResponseWriter, code int) {
@@ -77,7 +118,6 @@ func (s *MITMHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 	if !ok {
 		s.httpError(rw, http.StatusInternalServerError)
 		panic("underlying http.ResponseWriter MUST implement http.Hijacker")
-		return
 	}
 
 	conn, bufrw, err := hj.Hijack()
@@ -91,13 +131,6 @@ func (s *MITMHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 	_, _ = fmt.Fprintf(bufrw, "HTTP/1.1 200 OK\r\n\r\n")
 	_ = bufrw.Flush()
 
-	cert, err := s.certForRequest(rq)
-	if err != nil {
-		s.httpError(rw, http.StatusInternalServerError)
-		log.Warn(rq, "failed to issue certificate", zap.Error(err))
-		return
-	}
-
 	mitmconn := mitmCounterConn{
 		Conn: conn,
 	}
@@ -106,9 +139,28 @@ func (s *MITMHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 		log.WithContentLength(rq, mitmconn.bytesWritten)
 	}()
 
-	tlsconn := tls.Server(&mitmconn, &tls.Config{
-		Certificates: []tls.Certificate{*cert},
-	})
+	// authority is the target server address intercepted requests are routed to. It's the host name from the
+	// ClientHello SNI extension, if client sent one, and the host from CONNECT request otherwise.
+	authority := rq.URL.Host
+	tlsconf := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			hostname := rq.URL.Hostname()
+			if hello.ServerName != "" {
+				hostname = hello.ServerName
+				authority = mitmAuthority(hello.ServerName, rq.URL.Port())
+				log.With(rq, zap.String("sni", hello.ServerName))
+			}
+			cert, err := s.certForHost(rq, hostname)
+			if err != nil {
+				log.Warn(rq, "failed to issue certificate", zap.Error(err))
+			}
+			return cert, err
+		},
+	}
+	if s.h2 != nil {
+		tlsconf.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	tlsconn := tls.Server(&mitmconn, tlsconf)
 	err = tlsconn.Handshake()
 	if err != nil {
 		log.Warn(rq, "TLS handshake failed", zap.Error(err))
@@ -116,8 +168,14 @@ func (s *MITMHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 	}
 	defer tlsconn.Close()
 
+	if tlsconn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		s.serveHTTP2(rq, tlsconn, authority)
+		return
+	}
+
+	br := bufio.NewReader(tlsconn)
 	for seq := uint64(1); true; seq++ {
-		err = s.roundTrip(rq.Context(), tlsconn)
+		err = s.roundTrip(rq.Context(), tlsconn, br, authority)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
@@ -128,81 +186,185 @@ func (s *MITMHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 	}
 }
 
-func (s *MITMHandler) roundTrip(ctx context.Context, conn net.Conn) error {
-	rq, err := http.ReadRequest(bufio.NewReader(conn))
+// serveHTTP2 serves intercepted HTTP/2 connection. Each stream is passed to the Handler as a separate sub-request.
+func (s *MITMHandler) serveHTTP2(rq *http.Request, conn *tls.Conn, authority string) {
+	s.h2.ServeConn(conn, &http2.ServeConnOpts{
+		Context: rq.Context(),
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			rq.URL.Scheme = "https"
+			rq.URL.Host = authority
+			s.Handler.ServeHTTP(rw, rq)
+		}),
+	})
+}
+
+func (s *MITMHandler) roundTrip(ctx context.Context, conn net.Conn, br *bufio.Reader, authority string) error {
+	rq, err := http.ReadRequest(br)
 	if err != nil {
 		return err
 	}
 	rq = rq.WithContext(ctx)
 
-	rq.URL, _ = url.Parse("https://" + rq.Host + rq.URL.String())
+	rq.URL.Scheme = "https"
+	rq.URL.Host = authority
 	rq.RemoteAddr = conn.RemoteAddr().String()
 
-	rw := mitmResponseWriter{conn: &mitmNoopCloseConn{conn}}
+	rw := mitmResponseWriter{
+		conn: &mitmNoopCloseConn{conn},
+		br:   br,
+		bufw: bufio.NewWriter(conn),
+		rq:   rq,
+	}
 	s.Handler.ServeHTTP(&rw, rq)
-	return rw.Close()
-}
+	if rw.hijacked {
+		return io.EOF
+	}
+
+	// drain whatever is left of the request body, so the next request could be read from the connection
+	_, _ = io.Copy(ioutil.Discard, rq.Body)
+	_ = rq.Body.Close()
 
-func (s *MITMHandler) certForRequest(rq *http.Request) (*tls.Certificate, error) {
-	type cacheEntry struct {
-		cert *tls.Certificate
-		mux  sync.Mutex
-	}
-	var (
-		hostname    = rq.URL.Hostname()
-		cn          string
-		dnsnames    []string
-		ipaddresses []net.IP
-		err         error
-		entry       *cacheEntry
-	)
-
-	tldplus, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+	err = rw.Close()
 	if err != nil {
-		cn = tldplus
-		dnsnames = append(dnsnames, tldplus, "."+tldplus)
-	} else {
-		cn = hostname
+		return err
+	}
+	if rw.closeAfter {
+		return io.EOF
 	}
-	if ip := net.ParseIP(hostname); ip != nil {
-		cn = ip.String()
-		ipaddresses = append(ipaddresses, ip)
+	return nil
+}
+
+// mitmAuthority joins host name and port of the CONNECT request into URL authority.
+func mitmAuthority(hostname, port string) string {
+	if port == "" {
+		port = "443"
 	}
+	return net.JoinHostPort(hostname, port)
+}
 
-	s.certCacheMux.Lock()
-	if x, ok := s.certCache.Get(cn); ok {
-		entry, ok = x.(*cacheEntry)
-		if !ok {
-			panic("invalid value in cache")
+// certForHost returns certificate for the target host name. Request is only used for logging.
+func (s *MITMHandler) certForHost(rq *http.Request, hostname string) (*tls.Certificate, error) {
+	if mi, ok := s.Issuer.(issuer.MirrorIssuer); ok && s.MirrorUpstream {
+		orig, err := s.upstreamCert(rq.Context(), rq.URL.Host, hostname)
+		if err == nil {
+			sum := sha256.Sum256(orig.Raw)
+			return s.cachedCert(rq, "sha256:"+hex.EncodeToString(sum[:]), func() (*tls.Certificate, error) {
+				return mi.IssueMirror(orig)
+			})
 		}
-	} else {
-		entry = &cacheEntry{}
-		s.certCache.Add(cn, entry)
+		log.Debug(rq, "failed to fetch upstream certificate", zap.Error(err))
 	}
-	entry.mux.Lock()
-	defer entry.mux.Unlock()
 
-	s.certCacheMux.Unlock()
+	cn, dnsnames, ipaddresses := s.CertNaming.Names(hostname)
+	// the key includes all the names, so certificates issued under different policies never collide
+	key := cn
+	if len(dnsnames) > 0 {
+		key = strings.Join(dnsnames, ",")
+	}
+	return s.cachedCert(rq, key, func() (*tls.Certificate, error) {
+		return s.Issuer.Issue(cn, dnsnames, ipaddresses)
+	})
+}
 
-	if entry.cert == nil {
-		entry.cert, err = s.Issuer.Issue(cn, dnsnames, ipaddresses)
+// upstreamCert connects to the target server and returns its leaf certificate.
+func (s *MITMHandler) upstreamCert(ctx context.Context, addr, servername string) (*x509.Certificate, error) {
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+	conn, err := s.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	conf := &tls.Config{
+		// the certificate is only inspected here, actual verification is up to the Handler's transport
+		InsecureSkipVerify: true,
+	}
+	if net.ParseIP(servername) == nil {
+		conf.ServerName = servername
+	}
+	tlsconn := tls.Client(conn, conf)
+	err = tlsconn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	return tlsconn.ConnectionState().PeerCertificates[0], nil
+}
+
+// certCall is an in-flight certificate issuance
+type certCall struct {
+	wg   sync.WaitGroup
+	cert *tls.Certificate
+	err  error
+}
+
+// cachedCert looks up certificate in the cache and calls issue on miss. Concurrent requests for the same key wait for
+// a single issuance.
+func (s *MITMHandler) cachedCert(rq *http.Request, key string, issue func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	cert, err := s.CertCache.Get(key)
+	if err == nil {
+		return cert, nil
+	}
+	if !errors.Is(err, certcache.ErrMiss) {
+		log.Warn(rq, "certificate cache lookup failed", zap.String("key", key), zap.Error(err))
+	}
+
+	s.certCallsMux.Lock()
+	if call, ok := s.certCalls[key]; ok {
+		s.certCallsMux.Unlock()
+		call.wg.Wait()
+		return call.cert, call.err
+	}
+	call := &certCall{}
+	call.wg.Add(1)
+	s.certCalls[key] = call
+	s.certCallsMux.Unlock()
+
+	call.cert, call.err = issue()
+	if call.err == nil {
+		err = s.CertCache.Add(key, call.cert)
 		if err != nil {
-			return nil, err
+			log.Warn(rq, "failed to store certificate in cache", zap.String("key", key), zap.Error(err))
 		}
 	}
 
-	return entry.cert, nil
+	s.certCallsMux.Lock()
+	delete(s.certCalls, key)
+	s.certCallsMux.Unlock()
+	call.wg.Done()
+
+	return call.cert, call.err
 }
 
-// mitmResponseWriter implements http.ResponseWriter
+// mitmResponseWriter implements http.ResponseWriter and http.Flusher on top of intercepted HTTP/1.x connection.
+//
+// Response headers are sent on WriteHeader (or the first Write) and the body is streamed straight to the connection.
+// If handler doesn't specify Content-Length, chunked transfer encoding is used.
 //
 // not thread-safe
 type mitmResponseWriter struct {
-	conn       net.Conn
-	body       bytes.Buffer
-	header     http.Header
-	statusCode int
-	hijacked   bool
+	conn net.Conn
+	br   *bufio.Reader
+	bufw *bufio.Writer
+	rq   *http.Request
+
+	header      http.Header
+	statusCode  int
+	wroteHeader bool
+	hijacked    bool
+
+	chunked       bool
+	noBody        bool
+	contentLength int64
+	written       int64
+	body          io.WriteCloser
+	closeAfter    bool
 }
 
 // Header implements http.ResponseWriter interface
@@ -215,42 +377,139 @@ func (rw *mitmResponseWriter) Header() http.Header {
 
 // Write implements http.ResponseWriter interface
 func (rw *mitmResponseWriter) Write(p []byte) (int, error) {
-	// We put writes into the buffer and flush it upon response writer Close() call. It is not efficient memory-wise for
-	// large responses, but should be okay in this particular case since the underlying handler would only write
-	// directly in case of error responses which would be very small.
-	return rw.body.Write(p)
+	if rw.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.rq.Method == http.MethodHead {
+		// body of HEAD response is dropped silently, the same way net/http does
+		return len(p), nil
+	}
+	if rw.noBody {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if rw.contentLength >= 0 && rw.written+int64(len(p)) > rw.contentLength {
+		return 0, http.ErrContentLength
+	}
+	n, err := rw.body.Write(p)
+	rw.written += int64(n)
+	return n, err
 }
 
 // WriteHeader implements http.ResponseWriter interface
 func (rw *mitmResponseWriter) WriteHeader(statusCode int) {
-	if rw.statusCode != 0 {
+	if rw.hijacked {
+		return
+	}
+	if rw.wroteHeader {
 		panic("spurious header write")
 	}
 	rw.statusCode = statusCode
+
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		// informational responses are sent as is and do not complete the response
+		_, _ = fmt.Fprintf(rw.bufw, "HTTP/1.1 %03d %s\r\n", statusCode, http.StatusText(statusCode))
+		_ = rw.Header().Write(rw.bufw)
+		_, _ = rw.bufw.WriteString("\r\n")
+		_ = rw.bufw.Flush()
+		return
+	}
+	rw.wroteHeader = true
+
+	h := rw.Header()
+	h.Del("Transfer-Encoding")
+	rw.contentLength = -1
+	rw.body = mitmNopWriteCloser{rw.bufw}
+
+	switch {
+	case rw.rq.Method == http.MethodHead, statusCode == http.StatusNoContent, statusCode == http.StatusNotModified,
+		statusCode == http.StatusSwitchingProtocols:
+		rw.noBody = true
+	case h.Get("Content-Length") != "":
+		n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		if err != nil || n < 0 {
+			h.Del("Content-Length")
+			rw.closeAfter = true
+			break
+		}
+		rw.contentLength = n
+	case rw.rq.ProtoAtLeast(1, 1):
+		rw.chunked = true
+		rw.body = httputil.NewChunkedWriter(rw.bufw)
+		h.Set("Transfer-Encoding", "chunked")
+	default:
+		// HTTP/1.0 client, the only way to delimit the body is to close the connection
+		rw.closeAfter = true
+	}
+	if rw.rq.Close {
+		rw.closeAfter = true
+	}
+	if rw.closeAfter {
+		h.Set("Connection", "close")
+	}
+
+	_, _ = fmt.Fprintf(rw.bufw, "HTTP/1.1 %03d %s\r\n", statusCode, http.StatusText(statusCode))
+	_ = h.Write(rw.bufw)
+	_, _ = rw.bufw.WriteString("\r\n")
 }
 
+// Flush implements http.Flusher interface
+func (rw *mitmResponseWriter) Flush() {
+	if rw.hijacked {
+		return
+	}
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	_ = rw.bufw.Flush()
+}
+
+// Close finishes the response and flushes buffered data to the connection.
 func (rw *mitmResponseWriter) Close() error {
 	if rw.hijacked {
 		return nil
 	}
-	return (&http.Response{
-		ProtoMajor:       1,
-		ProtoMinor:       1,
-		StatusCode:       rw.statusCode,
-		Header:           rw.header,
-		Body:             ioutil.NopCloser(&rw.body),
-		ContentLength:    int64(rw.body.Len()),
-		TransferEncoding: []string{"identity"},
-	}).Write(rw.conn)
+	if !rw.wroteHeader {
+		rw.Header().Set("Content-Length", "0")
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.chunked {
+		err := rw.body.Close()
+		if err != nil {
+			return err
+		}
+		_, err = rw.bufw.WriteString("\r\n")
+		if err != nil {
+			return err
+		}
+	}
+	if rw.contentLength >= 0 && rw.written < rw.contentLength {
+		// handler didn't write as much as it promised, the client is out of sync now
+		rw.closeAfter = true
+	}
+	return rw.bufw.Flush()
 }
 
-// Hijack implements http.Hijacker interface
+// Hijack implements http.Hijacker interface. Reads from the returned connection go through the connection's buffered
+// reader, so whatever the client sent after the request head, e.g. the first WebSocket frames, is not lost.
 func (rw *mitmResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if rw.hijacked {
 		panic("spurious connection hijack")
 	}
 	rw.hijacked = true
-	return rw.conn, bufio.NewReadWriter(bufio.NewReader(rw.conn), bufio.NewWriter(rw.conn)), nil
+	conn := &mitmBufferedConn{Conn: rw.conn, br: rw.br}
+	return conn, bufio.NewReadWriter(rw.br, rw.bufw), nil
+}
+
+type mitmNopWriteCloser struct {
+	io.Writer
+}
+
+// Close implements io.Closer
+func (mitmNopWriteCloser) Close() error {
+	return nil
 }
 
 type mitmCounterConn struct {
@@ -265,6 +524,16 @@ func (c *mitmCounterConn) Write(p []byte) (n int, err error) {
 	return
 }
 
+type mitmBufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// Read wraps net.Conn, data buffered by the reader is read first
+func (c *mitmBufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
 type mitmNoopCloseConn struct {
 	net.Conn
 }
@@ -1,23 +1,33 @@
 package handlers_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/middleware/log"
 )
 
 func TestMITMHandler_ServeHTTP(t *testing.T) {
-	p := httptest.NewServer(&handlers.MITMHandler{})
+	p := httptest.NewServer(&handlers.MITMHandler{
+		Handler: &handlers.HTTPHandler{Transport: testUpstreamTransport()},
+	})
 	defer p.Close()
 
 	tr := testTransport(p.URL)
@@ -67,6 +77,48 @@ func TestMITMHandler_ServeHTTP(t *testing.T) {
 		require.Len(t, strings.Split(strings.TrimSpace(buf.String()), "\n"), 2)
 	})
 
+	t.Run("streaming", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		release := make(chan struct{})
+		s := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			_, _ = io.WriteString(rw, "first\n")
+			rw.(http.Flusher).Flush()
+			<-release
+			_, _ = io.WriteString(rw, "second\n")
+		}))
+		defer s.Close()
+		defer close(release)
+
+		rq, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+		rs, err := tr.RoundTrip(rq)
+		require.NoError(t, err)
+		defer rs.Body.Close()
+		require.Equal(t, http.StatusOK, rs.StatusCode)
+		require.Equal(t, []string{"chunked"}, rs.TransferEncoding)
+
+		// the first line must reach the client while upstream handler is still blocked
+		line, err := bufio.NewReader(rs.Body).ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "first\n", line)
+	})
+
+	t.Run("large response", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		rq, _ := http.NewRequestWithContext(ctx, http.MethodGet, testTLSServer.URL+"/bytes/100000", nil)
+		rs, err := tr.RoundTrip(rq)
+		require.NoError(t, err)
+		defer rs.Body.Close()
+		require.Equal(t, http.StatusOK, rs.StatusCode)
+
+		n, err := io.Copy(ioutil.Discard, rs.Body)
+		require.NoError(t, err)
+		require.Equal(t, int64(100000), n)
+	})
+
 	t.Run("keep alive", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 		defer cancel()
@@ -91,3 +143,221 @@ func TestMITMHandler_ServeHTTP(t *testing.T) {
 	})
 
 }
+
+func TestMITMHandler_HTTP2(t *testing.T) {
+	var access testSyncBuffer
+	p := httptest.NewServer(&handlers.MITMHandler{
+		Handler: log.Middleware(&access, ioutil.Discard, zapcore.InfoLevel)(&handlers.HTTPHandler{Transport: testUpstreamTransport()}),
+	})
+	defer p.Close()
+
+	tr := testTransport(p.URL)
+	tr.ForceAttemptHTTP2 = true
+
+	const n = 5
+	type result struct {
+		err        error
+		statusCode int
+		protoMajor int
+		userAgent  string
+	}
+	results := make(chan result, n)
+	wg := sync.WaitGroup{}
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			rq, _ := http.NewRequestWithContext(ctx, http.MethodGet, testTLSServer.URL+"/get", nil)
+			rs, err := tr.RoundTrip(rq)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer rs.Body.Close()
+
+			var data testGetResponse
+			err = json.NewDecoder(rs.Body).Decode(&data)
+			results <- result{err, rs.StatusCode, rs.ProtoMajor, data.Headers.Get("user-agent")}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	tr.CloseIdleConnections()
+
+	for r := range results {
+		require.NoError(t, r.err)
+		require.Equal(t, http.StatusOK, r.statusCode)
+		require.Equal(t, 2, r.protoMajor)
+		require.Equal(t, "Go-http-client/2.0", r.userAgent)
+	}
+	// access log line is written after the response is flushed to the client
+	require.Eventually(t, func() bool {
+		return strings.Count(access.String(), `"url":"`+testTLSServer.URL+`/get"`) == n
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMITMHandler_MirrorUpstream(t *testing.T) {
+	p := httptest.NewServer(&handlers.MITMHandler{
+		Handler:        &handlers.HTTPHandler{Transport: testUpstreamTransport()},
+		MirrorUpstream: true,
+		DialTimeout:    time.Second,
+	})
+	defer p.Close()
+
+	tr := testTransport(p.URL)
+
+	rq, _ := http.NewRequest(http.MethodGet, testTLSServer.URL+"/get", nil)
+	rs, err := tr.RoundTrip(rq)
+	require.NoError(t, err)
+	defer rs.Body.Close()
+	require.Equal(t, http.StatusOK, rs.StatusCode)
+
+	var (
+		orig = testTLSServer.Certificate()
+		got  = rs.TLS.PeerCertificates[0]
+	)
+	require.NotEqual(t, orig.Raw, got.Raw)
+	require.Equal(t, orig.DNSNames, got.DNSNames)
+	require.Equal(t, orig.Subject.String(), got.Subject.String())
+	require.True(t, orig.NotAfter.Equal(got.NotAfter))
+	require.Len(t, got.IPAddresses, len(orig.IPAddresses))
+}
+
+func TestMITMHandler_SNI(t *testing.T) {
+	var hosts testSyncBuffer
+	d := &handlers.HTTPHandler{Transport: testUpstreamTransport()}
+	p := httptest.NewServer(&handlers.MITMHandler{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			_, _ = hosts.Write([]byte(rq.URL.Host + "\n"))
+			d.ServeHTTP(rw, rq)
+		}),
+	})
+	defer p.Close()
+
+	_, port, _ := net.SplitHostPort(testTLSServer.Listener.Addr().String())
+
+	t.Run("certificate", func(t *testing.T) {
+		tr := testTransport(p.URL)
+		tr.TLSClientConfig.ServerName = "example.com"
+
+		rq, _ := http.NewRequest(http.MethodGet, testTLSServer.URL+"/get", nil)
+		rs, err := tr.RoundTrip(rq)
+		require.NoError(t, err)
+		defer rs.Body.Close()
+
+		require.Equal(t, "example.com", rs.TLS.PeerCertificates[0].Subject.CommonName)
+		require.Equal(t, []string{"example.com"}, rs.TLS.PeerCertificates[0].DNSNames)
+		require.Empty(t, rs.TLS.PeerCertificates[0].IPAddresses)
+	})
+
+	t.Run("routing", func(t *testing.T) {
+		tr := testTransport(p.URL)
+		tr.TLSClientConfig.ServerName = "localhost"
+
+		rq, _ := http.NewRequest(http.MethodGet, testTLSServer.URL+"/get", nil)
+		rs, err := tr.RoundTrip(rq)
+		require.NoError(t, err)
+		defer rs.Body.Close()
+
+		require.Equal(t, http.StatusOK, rs.StatusCode)
+		require.Contains(t, hosts.String(), "localhost:"+port+"\n")
+	})
+
+	t.Run("no SNI", func(t *testing.T) {
+		tr := testTransport(p.URL)
+
+		rq, _ := http.NewRequest(http.MethodGet, testTLSServer.URL+"/get", nil)
+		rs, err := tr.RoundTrip(rq)
+		require.NoError(t, err)
+		defer rs.Body.Close()
+
+		require.Equal(t, http.StatusOK, rs.StatusCode)
+		require.Equal(t, "127.0.0.1", rs.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+}
+
+func TestMITMHandler_Head(t *testing.T) {
+	errs := make(chan error, 2)
+	p := httptest.NewServer(&handlers.MITMHandler{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			rw.Header().Set("Content-Length", "5")
+			_, err := rw.Write([]byte("hello"))
+			errs <- err
+		}),
+	})
+	defer p.Close()
+
+	tr := testTransport(p.URL)
+	defer tr.CloseIdleConnections()
+
+	// the same connection is reused for the second request, the body of HEAD response must not get in its way
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		rq, _ := http.NewRequest(method, testTLSServer.URL+"/", nil)
+		rs, err := tr.RoundTrip(rq)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(rs.Body)
+		_ = rs.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rs.StatusCode)
+		require.Equal(t, int64(5), rs.ContentLength)
+		if method == http.MethodGet {
+			require.Equal(t, "hello", string(b))
+		}
+		require.NoError(t, <-errs)
+	}
+}
+
+func TestMITMHandler_Upgrade(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		if rq.Header.Get("Upgrade") != "echo" {
+			http.Error(rw, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, bufrw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = bufrw.Flush()
+		_, _ = io.CopyN(bufrw, bufrw, 8)
+		_ = bufrw.Flush()
+	}))
+	defer upstream.Close()
+
+	p := httptest.NewServer(&handlers.MITMHandler{
+		Handler: &handlers.HTTPHandler{Transport: testUpstreamTransport()},
+	})
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	addr := upstream.Listener.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	rs, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rs.StatusCode)
+
+	tlsconn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	// the first bytes of the new protocol are sent along with the request head
+	_, err = fmt.Fprintf(tlsconn, "GET /ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nping", addr)
+	require.NoError(t, err)
+	tlsbr := bufio.NewReader(tlsconn)
+	rs, err = http.ReadResponse(tlsbr, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, rs.StatusCode)
+	require.Equal(t, "echo", rs.Header.Get("Upgrade"))
+
+	_, err = tlsconn.Write([]byte("pong"))
+	require.NoError(t, err)
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(tlsbr, buf)
+	require.NoError(t, err)
+	require.Equal(t, "pingpong", string(buf))
+}
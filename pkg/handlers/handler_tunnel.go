@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -29,6 +30,13 @@ type Tunnel struct {
 	// DialTimeout specifies an optional timeout for the dialer to establish upstream connection.
 	DialTimeout time.Duration
 
+	// IdleTimeout specifies an optional timeout after which the tunnel is closed if no data went through it in either
+	// direction.
+	IdleTimeout time.Duration
+
+	// MaxLifetime specifies an optional limit on how long the tunnel stays open regardless of activity.
+	MaxLifetime time.Duration
+
 	once sync.Once
 }
 
@@ -83,37 +91,99 @@ func (s *Tunnel) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 	_ = bufrw.Flush()
 	log.WithStatusCode(rq, http.StatusOK)
 
+	var (
+		// client is what's read from the client, the client might have sent data ahead buffered in bufrw
+		client   io.Reader = bufrw
+		upstream io.Reader = u
+		active             = time.Now().UnixNano()
+
+		sent, received int64
+		done           = make(chan struct{})
+		closed         = make(chan string, 1)
+	)
+	if s.IdleTimeout > 0 {
+		// readers are only wrapped if needed, it stops io.Copy from splicing connections
+		client = &activityReader{r: client, active: &active}
+		upstream = &activityReader{r: upstream, active: &active}
+	}
+	go func() {
+		closed <- s.watch(done, &active, conn, u)
+	}()
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		_, err := s.copy(u, bufrw)
+		var err error
+		received, err = s.copy(u, client)
 		if err != nil {
 			log.Debug(rq, "client -> upstream copy error", zap.Error(err))
 		}
+		closeWrite(u, conn, err)
 	}()
 	go func() {
 		defer wg.Done()
-		n, err := s.copy(bufrw, u)
+		var err error
+		sent, err = s.copy(bufrw, upstream)
+		if err == nil {
+			err = bufrw.Flush()
+		}
 		if err != nil {
 			log.Debug(rq, "upstream -> client copy error", zap.Error(err))
 		}
-		log.WithContentLength(rq, n)
+		closeWrite(conn, u, err)
 	}()
 
 	wg.Wait()
+	close(done)
+	if reason := <-closed; reason != "" {
+		log.Debug(rq, "tunnel closed", zap.String("reason", reason))
+	}
+	log.WithBytes(rq, sent, received)
 }
 
-func (s *Tunnel) copy(dst io.Writer, src io.Reader) (int, error) {
+// watch aborts the tunnel once it's idle for IdleTimeout or open for MaxLifetime, unless done is closed first. Returns
+// the reason the tunnel was aborted for, or empty string.
+func (s *Tunnel) watch(done <-chan struct{}, active *int64, conns ...net.Conn) string {
+	var idle, lifetime *time.Timer
+	if s.IdleTimeout > 0 {
+		idle = time.NewTimer(s.IdleTimeout)
+		defer idle.Stop()
+	}
+	if s.MaxLifetime > 0 {
+		lifetime = time.NewTimer(s.MaxLifetime)
+		defer lifetime.Stop()
+	}
+	for {
+		select {
+		case <-done:
+			return ""
+		case <-timerC(lifetime):
+			abort(conns...)
+			return "max lifetime"
+		case <-timerC(idle):
+			// the timer is rearmed until it fires with no reads since the last check
+			since := time.Since(time.Unix(0, atomic.LoadInt64(active)))
+			if since < s.IdleTimeout {
+				idle.Reset(s.IdleTimeout - since)
+				continue
+			}
+			abort(conns...)
+			return "idle timeout"
+		}
+	}
+}
+
+func (s *Tunnel) copy(dst io.Writer, src io.Reader) (int64, error) {
 	n, err := io.Copy(dst, src)
 	switch {
 	case errors.Is(err, io.EOF):
-		return int(n), nil
+		return n, nil
 	case errors.Is(err, os.ErrDeadlineExceeded):
-		return int(n), nil
+		return n, nil
 	default:
-		return int(n), err
+		return n, err
 	}
 }
 
@@ -125,3 +195,50 @@ func (s *Tunnel) dialContext(ctx context.Context, network, addr string) (net.Con
 	}
 	return s.DialContext(ctx, network, addr)
 }
+
+// closeWrite passes EOF of the copy into dst on to its reader. The tunnel is aborted if the copy failed. If dst doesn't
+// support half-close, the tunnel lasts until the other copy is over too, or IdleTimeout or MaxLifetime end it.
+func closeWrite(dst, src net.Conn, err error) {
+	if err != nil {
+		abort(dst, src)
+		return
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// closeWriter is implemented by connections supporting half-close, e.g. *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// abort unblocks pending and future reads and writes of the connections, so copies between them stop.
+func abort(conns ...net.Conn) {
+	for _, c := range conns {
+		_ = c.SetDeadline(time.Unix(1, 0))
+	}
+}
+
+// timerC returns the channel of the timer, nil channel blocks forever if there's no timer.
+func timerC(t *time.Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
+// activityReader records the time of the last successful read.
+type activityReader struct {
+	r      io.Reader
+	active *int64
+}
+
+// Read implements io.Reader interface
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(r.active, time.Now().UnixNano())
+	}
+	return n, err
+}
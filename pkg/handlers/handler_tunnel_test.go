@@ -1,15 +1,25 @@
 package handlers_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/middleware/log"
 )
 
 func TestTunnelProxy_ServeHTTP(t *testing.T) {
@@ -77,3 +87,162 @@ func TestTunnelProxy_ServeHTTP(t *testing.T) {
 		require.Equal(t, http.StatusOK, rs.StatusCode)
 	})
 }
+
+// tcpServer accepts connections and serves each with the handler, the connection is closed when the handler returns
+func tcpServer(t *testing.T, handler func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// connect opens the tunnel to addr through the proxy, returns the client connection and the reader to read from it
+func connect(t *testing.T, proxy, addr string) (*net.TCPConn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", proxy)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	rs, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rs.StatusCode)
+	return conn.(*net.TCPConn), br
+}
+
+type syncBuffer struct {
+	mux sync.Mutex
+	b   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.b.String()
+}
+
+func TestTunnel_HalfClose(t *testing.T) {
+	// the target server only answers once the client is done sending
+	l := tcpServer(t, func(conn net.Conn) {
+		b, _ := ioutil.ReadAll(conn)
+		_, _ = fmt.Fprintf(conn, "got %q", b)
+	})
+	defer l.Close()
+
+	var access syncBuffer
+	p := httptest.NewServer(log.Middleware(&access, ioutil.Discard, zapcore.InfoLevel)(&handlers.Tunnel{}))
+	defer p.Close()
+
+	conn, br := connect(t, p.Listener.Addr().String(), l.Addr().String())
+	defer conn.Close()
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+
+	b, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	require.Equal(t, `got "hello"`, string(b))
+
+	require.Eventually(t, func() bool {
+		return bytes.Contains([]byte(access.String()), []byte(`"bytes-sent":11,"bytes-received":5`))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTunnel_NoHalfClose(t *testing.T) {
+	// the target server answers the request without waiting for EOF
+	l := tcpServer(t, func(conn net.Conn) {
+		b := make([]byte, 5)
+		_, _ = io.ReadFull(conn, b)
+		_, _ = fmt.Fprintf(conn, "got %q", b)
+	})
+	defer l.Close()
+
+	// upstream connection wrapped into a type which doesn't support half-close
+	p := httptest.NewServer(&handlers.Tunnel{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		return struct{ net.Conn }{c}, err
+	}})
+	defer p.Close()
+
+	conn, br := connect(t, p.Listener.Addr().String(), l.Addr().String())
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+
+	b, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	require.Equal(t, `got "hello"`, string(b))
+}
+
+func echo(conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+}
+
+func TestTunnel_IdleTimeout(t *testing.T) {
+	l := tcpServer(t, echo)
+	defer l.Close()
+
+	p := httptest.NewServer(&handlers.Tunnel{IdleTimeout: 200 * time.Millisecond})
+	defer p.Close()
+
+	conn, br := connect(t, p.Listener.Addr().String(), l.Addr().String())
+	defer conn.Close()
+
+	// the tunnel is kept open while there's traffic
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := conn.Write([]byte("x"))
+		require.NoError(t, err)
+		_, err = br.ReadByte()
+		require.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, time.Since(start) > 400*time.Millisecond)
+
+	_, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestTunnel_MaxLifetime(t *testing.T) {
+	l := tcpServer(t, echo)
+	defer l.Close()
+
+	p := httptest.NewServer(&handlers.Tunnel{IdleTimeout: time.Minute, MaxLifetime: 300 * time.Millisecond})
+	defer p.Close()
+
+	conn, br := connect(t, p.Listener.Addr().String(), l.Addr().String())
+	defer conn.Close()
+
+	start := time.Now()
+	for {
+		_, err := conn.Write([]byte("x"))
+		if err == nil {
+			_, err = br.ReadByte()
+		}
+		if err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.True(t, time.Since(start) > 250*time.Millisecond)
+	require.True(t, time.Since(start) < 2*time.Second)
+}
@@ -1,17 +1,22 @@
 package handlers_test
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/mccutchen/go-httpbin/httpbin"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
 )
 
 var (
@@ -67,3 +72,32 @@ func testTransport(proxy string) *http.Transport {
 		},
 	}
 }
+
+// testUpstreamTransport returns transport which trusts test servers certificate
+func testUpstreamTransport() http.RoundTripper {
+	roots := x509.NewCertPool()
+	roots.AddCert(testTLSServer.Certificate())
+	return &handlers.VerifyingTransport{
+		RootCAs: roots,
+		// test server certificate is only valid for example.com and loopback addresses
+		SkipVerify: []string{"localhost"},
+	}
+}
+
+// testSyncBuffer is a bytes.Buffer safe for concurrent use
+type testSyncBuffer struct {
+	buf bytes.Buffer
+	mux sync.Mutex
+}
+
+func (b *testSyncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *testSyncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// CertNaming defines the policy MITMHandler uses to choose names for issued certificates. Wider certificates cover more
+// hosts, so fewer of them have to be issued and cache hit rate is higher.
+//
+// Regardless of the policy, certificates for IP addresses are issued for the exact address and certificates for
+// single-label host names (e.g. localhost) are issued for the exact name, since wildcards are not allowed right below
+// top-level domains. Wildcard is never used if it would cover a public suffix, e.g. *.co.uk or *.github.io.
+type CertNaming int
+
+const (
+	// CertNamingExact issues certificates for the exact host name, e.g. www.example.com.
+	CertNamingExact CertNaming = iota
+
+	// CertNamingParent issues wildcard certificates for the parent domain, e.g. *.example.com for www.example.com.
+	CertNamingParent
+
+	// CertNamingETLDPlusOne issues certificates for the registrable domain and its wildcard, e.g. example.com and
+	// *.example.com for both example.com and www.example.com. Since wildcard only covers a single label, hosts deeper
+	// than that are named as with CertNamingParent, e.g. *.www.example.com for api.www.example.com.
+	CertNamingETLDPlusOne
+)
+
+var certNamingNames = map[CertNaming]string{
+	CertNamingExact:       "exact",
+	CertNamingParent:      "parent",
+	CertNamingETLDPlusOne: "etld1",
+}
+
+// ParseCertNaming converts string representation of the policy into CertNaming.
+func ParseCertNaming(s string) (CertNaming, error) {
+	for n, name := range certNamingNames {
+		if name == s {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown certificate naming policy: %q", s)
+}
+
+// String implements fmt.Stringer interface
+func (n CertNaming) String() string {
+	if name, ok := certNamingNames[n]; ok {
+		return name
+	}
+	return fmt.Sprintf("CertNaming(%d)", int(n))
+}
+
+// Names returns common name, DNS names and IP addresses for a certificate to cover the host according to the policy.
+func (n CertNaming) Names(hostname string) (cn string, dnsnames []string, ipaddresses []net.IP) {
+	if ip := net.ParseIP(hostname); ip != nil {
+		return ip.String(), nil, []net.IP{ip}
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+
+	switch n {
+	case CertNamingParent:
+		if parent, ok := wildcardParent(hostname); ok {
+			return "*." + parent, []string{"*." + parent}, nil
+		}
+	case CertNamingETLDPlusOne:
+		domain, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+		if err != nil {
+			break
+		}
+		if hostname == domain || hostname[strings.IndexByte(hostname, '.')+1:] == domain {
+			return domain, []string{domain, "*." + domain}, nil
+		}
+		if parent, ok := wildcardParent(hostname); ok {
+			return "*." + parent, []string{"*." + parent}, nil
+		}
+	}
+	return hostname, []string{hostname}, nil
+}
+
+// wildcardParent returns parent domain of the host if it could be safely wildcarded, i.e. it's not a public suffix.
+func wildcardParent(hostname string) (string, bool) {
+	i := strings.IndexByte(hostname, '.')
+	if i < 0 {
+		return "", false
+	}
+	parent := hostname[i+1:]
+	suffix, _ := publicsuffix.PublicSuffix(parent)
+	if suffix == parent {
+		return "", false
+	}
+	return parent, true
+}
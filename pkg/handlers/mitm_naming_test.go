@@ -0,0 +1,77 @@
+package handlers_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
+)
+
+func TestCertNaming_Names(t *testing.T) {
+	cases := []struct {
+		hostname string
+		naming   handlers.CertNaming
+		cn       string
+		dnsnames []string
+		ip       net.IP
+	}{
+		{"www.example.com", handlers.CertNamingExact, "www.example.com", []string{"www.example.com"}, nil},
+		{"WWW.Example.COM.", handlers.CertNamingExact, "www.example.com", []string{"www.example.com"}, nil},
+		{"www.example.com", handlers.CertNamingParent, "*.example.com", []string{"*.example.com"}, nil},
+		{"a.b.example.com", handlers.CertNamingParent, "*.b.example.com", []string{"*.b.example.com"}, nil},
+		{"example.com", handlers.CertNamingParent, "example.com", []string{"example.com"}, nil},
+		{"www.example.com", handlers.CertNamingETLDPlusOne, "example.com", []string{"example.com", "*.example.com"}, nil},
+		{"example.com", handlers.CertNamingETLDPlusOne, "example.com", []string{"example.com", "*.example.com"}, nil},
+		{"a.b.example.com", handlers.CertNamingETLDPlusOne, "*.b.example.com", []string{"*.b.example.com"}, nil},
+
+		// multi-level public suffixes
+		{"www.example.co.uk", handlers.CertNamingParent, "*.example.co.uk", []string{"*.example.co.uk"}, nil},
+		{"example.co.uk", handlers.CertNamingParent, "example.co.uk", []string{"example.co.uk"}, nil},
+		{"www.example.co.uk", handlers.CertNamingETLDPlusOne, "example.co.uk", []string{"example.co.uk", "*.example.co.uk"}, nil},
+		{"example.github.io", handlers.CertNamingParent, "example.github.io", []string{"example.github.io"}, nil},
+		{"www.example.github.io", handlers.CertNamingETLDPlusOne, "example.github.io", []string{"example.github.io", "*.example.github.io"}, nil},
+
+		// single-label hosts
+		{"localhost", handlers.CertNamingExact, "localhost", []string{"localhost"}, nil},
+		{"localhost", handlers.CertNamingParent, "localhost", []string{"localhost"}, nil},
+		{"localhost", handlers.CertNamingETLDPlusOne, "localhost", []string{"localhost"}, nil},
+		{"www.intranet", handlers.CertNamingParent, "www.intranet", []string{"www.intranet"}, nil},
+
+		// IP addresses
+		{"192.0.2.1", handlers.CertNamingExact, "192.0.2.1", nil, net.ParseIP("192.0.2.1")},
+		{"192.0.2.1", handlers.CertNamingParent, "192.0.2.1", nil, net.ParseIP("192.0.2.1")},
+		{"192.0.2.1", handlers.CertNamingETLDPlusOne, "192.0.2.1", nil, net.ParseIP("192.0.2.1")},
+		{"2001:db8::1", handlers.CertNamingParent, "2001:db8::1", nil, net.ParseIP("2001:db8::1")},
+		{"2001:DB8:0::1", handlers.CertNamingETLDPlusOne, "2001:db8::1", nil, net.ParseIP("2001:db8::1")},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.naming.String()+" "+c.hostname, func(t *testing.T) {
+			cn, dnsnames, ipaddresses := c.naming.Names(c.hostname)
+			require.Equal(t, c.cn, cn)
+			require.Equal(t, c.dnsnames, dnsnames)
+			if c.ip == nil {
+				require.Empty(t, ipaddresses)
+			} else {
+				require.Len(t, ipaddresses, 1)
+				require.True(t, c.ip.Equal(ipaddresses[0]))
+			}
+		})
+	}
+}
+
+func TestParseCertNaming(t *testing.T) {
+	for _, n := range []handlers.CertNaming{
+		handlers.CertNamingExact,
+		handlers.CertNamingParent,
+		handlers.CertNamingETLDPlusOne,
+	} {
+		parsed, err := handlers.ParseCertNaming(n.String())
+		require.NoError(t, err)
+		require.Equal(t, n, parsed)
+	}
+	_, err := handlers.ParseCertNaming("bogus")
+	require.Error(t, err)
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"go.uber.org/zap"
+
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+	"github.com/akabos/multiproxy/pkg/router"
+)
+
+// VerifyFailure defines what VerifyingTransport does when target server certificate fails verification.
+type VerifyFailure int
+
+const (
+	// VerifyFailureReject fails the request with UpstreamCertError. HTTPHandler responds with 502 and an error page
+	// describing the problem.
+	VerifyFailureReject VerifyFailure = iota
+
+	// VerifyFailureWarn logs the problem and passes the request through anyway.
+	VerifyFailureWarn
+)
+
+// ParseVerifyFailure converts string representation of the policy ("reject" or "warn") into VerifyFailure.
+func ParseVerifyFailure(s string) (VerifyFailure, error) {
+	switch s {
+	case "reject":
+		return VerifyFailureReject, nil
+	case "warn":
+		return VerifyFailureWarn, nil
+	default:
+		return 0, fmt.Errorf("unknown verification failure policy: %q", s)
+	}
+}
+
+// UpstreamCertError is returned by VerifyingTransport when target server certificate fails verification.
+type UpstreamCertError struct {
+	Host string
+	Err  error
+}
+
+func (e *UpstreamCertError) Error() string {
+	return fmt.Sprintf("certificate of %s failed verification: %v", e.Host, e.Err)
+}
+
+func (e *UpstreamCertError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyingTransport is an http.RoundTripper which verifies target server certificates against configurable trust
+// store.
+//
+// The zero value of VerifyingTransport is a valid instance which verifies certificates against system roots.
+type VerifyingTransport struct {
+	// Base specifies optional transport used as a template for connecting to target servers. Its TLS client
+	// configuration is overridden.
+	//
+	// If Base is nil, DefaultTransport is used.
+	Base *http.Transport
+
+	// RootCAs defines the set of root certificates to verify target servers against. See SystemCertPoolWith.
+	//
+	// If RootCAs is nil, system roots are used.
+	RootCAs *x509.CertPool
+
+	// SkipVerify is the list of target hosts for which verification is skipped entirely. See router.Pattern for the
+	// pattern syntax, invalid patterns are ignored.
+	SkipVerify []string
+
+	// OnFailure defines what to do if verification fails.
+	//
+	// The zero value is VerifyFailureReject.
+	OnFailure VerifyFailure
+
+	once     sync.Once
+	skipped  []*router.Pattern
+	secure   *http.Transport
+	insecure *http.Transport
+	failed   *lru.Cache
+}
+
+func (t *VerifyingTransport) init() {
+	if t.Base == nil {
+		t.Base = DefaultTransport
+	}
+	t.secure = t.Base.Clone()
+	t.secure.TLSClientConfig = &tls.Config{
+		RootCAs: t.RootCAs,
+	}
+	t.insecure = t.Base.Clone()
+	t.insecure.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	for _, s := range t.SkipVerify {
+		if p, err := router.ParsePattern(s); err == nil {
+			t.skipped = append(t.skipped, p)
+		}
+	}
+	t.failed, _ = lru.New(verifyFailureCacheSize)
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *VerifyingTransport) RoundTrip(rq *http.Request) (*http.Response, error) {
+	t.once.Do(t.init)
+
+	if rq.URL.Scheme != "https" || t.skip(rq.URL.Host) {
+		return t.insecure.RoundTrip(rq)
+	}
+	if t.OnFailure != VerifyFailureWarn {
+		rs, err := t.secure.RoundTrip(rq)
+		if err != nil && isCertError(err) {
+			return nil, &UpstreamCertError{Host: rq.URL.Host, Err: err}
+		}
+		return rs, err
+	}
+
+	if x, ok := t.failed.Get(rq.URL.Host); ok && time.Since(x.(verifyFailure).at) < verifyFailureTTL {
+		// the host is known to fail verification, don't bother connecting securely for a while
+		log.Warn(rq, "upstream certificate verification failed", zap.Error(x.(verifyFailure).err))
+		return t.insecure.RoundTrip(rq)
+	}
+
+	// the body is not touched until connection is established, so it could be reused for another attempt if the
+	// first one fails verification; the only thing to prevent is the transport closing it
+	var body = rq.Body
+	if body != nil {
+		rq = rq.Clone(rq.Context())
+		rq.Body = ioutil.NopCloser(body)
+	}
+	rs, err := t.secure.RoundTrip(rq)
+	if err == nil || !isCertError(err) {
+		if err != nil && body != nil {
+			_ = body.Close()
+		}
+		return rs, err
+	}
+	err = &UpstreamCertError{Host: rq.URL.Host, Err: err}
+	t.failed.Add(rq.URL.Host, verifyFailure{err: err, at: time.Now()})
+	log.Warn(rq, "upstream certificate verification failed", zap.Error(err))
+	rq.Body = body
+	return t.insecure.RoundTrip(rq)
+}
+
+type verifyFailure struct {
+	err error
+	at  time.Time
+}
+
+// CloseIdleConnections closes idle connections of underlying transports.
+func (t *VerifyingTransport) CloseIdleConnections() {
+	t.once.Do(t.init)
+	t.secure.CloseIdleConnections()
+	t.insecure.CloseIdleConnections()
+}
+
+func (t *VerifyingTransport) skip(addr string) bool {
+	for _, pattern := range t.skipped {
+		if pattern.MatchAddr(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCertError reports whether the error is caused by certificate verification failure.
+func isCertError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+	)
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// SystemCertPoolWith returns system certificate pool extended with certificates from PEM files.
+func SystemCertPoolWith(files ...string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", f)
+		}
+	}
+	return pool, nil
+}
+
+const (
+	// verifyFailureCacheSize defines how many hosts failing verification VerifyingTransport remembers.
+	verifyFailureCacheSize = 1024
+
+	// verifyFailureTTL defines how long VerifyingTransport remembers verification failure.
+	verifyFailureTTL = time.Minute
+)
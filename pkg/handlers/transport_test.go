@@ -0,0 +1,74 @@
+package handlers_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
+)
+
+func TestVerifyingTransport(t *testing.T) {
+	serve := func(t *testing.T, transport http.RoundTripper, method string) (int, string) {
+		p := httptest.NewServer(&handlers.MITMHandler{
+			Handler: &handlers.HTTPHandler{Transport: transport},
+		})
+		defer p.Close()
+
+		var body = strings.NewReader("payload")
+		rq, _ := http.NewRequest(method, testTLSServer.URL+"/"+strings.ToLower(method), body)
+		rs, err := testTransport(p.URL).RoundTrip(rq)
+		require.NoError(t, err)
+		defer rs.Body.Close()
+		data, err := ioutil.ReadAll(rs.Body)
+		require.NoError(t, err)
+		return rs.StatusCode, string(data)
+	}
+
+	t.Run("default transport", func(t *testing.T) {
+		status, body := serve(t, nil, http.MethodGet)
+		require.Equal(t, http.StatusBadGateway, status)
+		require.Contains(t, body, "failed verification")
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		status, body := serve(t, &handlers.VerifyingTransport{}, http.MethodGet)
+		require.Equal(t, http.StatusBadGateway, status)
+		require.Contains(t, body, "failed verification")
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		transport := &handlers.VerifyingTransport{OnFailure: handlers.VerifyFailureWarn}
+		for i := 0; i < 2; i++ {
+			status, body := serve(t, transport, http.MethodPost)
+			require.Equal(t, http.StatusOK, status)
+			require.Contains(t, body, "payload")
+		}
+	})
+
+	t.Run("skip verify", func(t *testing.T) {
+		status, _ := serve(t, &handlers.VerifyingTransport{SkipVerify: []string{"127.0.0.1"}}, http.MethodGet)
+		require.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("extra roots", func(t *testing.T) {
+		f := filepath.Join(t.TempDir(), "ca.pem")
+		err := ioutil.WriteFile(f, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: testTLSServer.Certificate().Raw,
+		}), 0600)
+		require.NoError(t, err)
+
+		roots, err := handlers.SystemCertPoolWith(f)
+		require.NoError(t, err)
+
+		status, _ := serve(t, &handlers.VerifyingTransport{RootCAs: roots}, http.MethodGet)
+		require.Equal(t, http.StatusOK, status)
+	})
+}
@@ -0,0 +1,132 @@
+package issuer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ErrNotCA is returned when loaded certificate is not suitable to sign other certificates.
+var ErrNotCA = errors.New("certificate is not a CA")
+
+// ErrExpired is returned when loaded CA certificate is expired or not valid yet.
+var ErrExpired = errors.New("certificate is expired or not valid yet")
+
+// LoadCert reads PEM encoded certificate chain and private key from files. The private key may be either PKCS#1,
+// PKCS#8 or EC encoded.
+//
+// If keyFile is empty, the private key is expected to be found in certFile along with the chain.
+func LoadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// SaveCert writes PEM encoded certificate chain and private key into files. Key file is created readable by owner only.
+//
+// If keyFile is empty, the private key is appended to certFile.
+func SaveCert(cert *tls.Certificate, certFile, keyFile string) error {
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	block, err := marshalKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(block)
+	if keyFile == "" {
+		return ioutil.WriteFile(certFile, append(certPEM, keyPEM...), 0600)
+	}
+	err = ioutil.WriteFile(certFile, certPEM, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, keyPEM, 0600)
+}
+
+// LoadFiles loads CA certificate and private key from PEM encoded files. See LoadCert for details. Certificates which
+// are not valid at the moment are rejected, since nothing they sign would be trusted.
+//
+// Must be called before the first Issue call.
+func (ca *SelfSignedCA) LoadFiles(certFile, keyFile string) error {
+	cert, err := LoadCert(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	if !cert.Leaf.IsCA || cert.Leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("%s: %w", certFile, ErrNotCA)
+	}
+	if now := time.Now(); now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("%s: %w: valid from %s until %s", certFile, ErrExpired,
+			cert.Leaf.NotBefore.Format(time.RFC3339), cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	ca.Cert = cert
+	return nil
+}
+
+// LoadOrGenerateFiles works like LoadFiles, but if certFile doesn't exist, it generates a new self-signed root
+// certificate (unless Cert is already set) and saves it into the files, so the same root could be used on the next run.
+// An existing keyFile is never overwritten, it's an error if keyFile exists without certFile.
+//
+// Must be called before the first Issue call.
+func (ca *SelfSignedCA) LoadOrGenerateFiles(certFile, keyFile string) error {
+	_, err := os.Stat(certFile)
+	if !os.IsNotExist(err) {
+		return ca.LoadFiles(certFile, keyFile)
+	}
+	if keyFile != "" {
+		_, err = os.Stat(keyFile)
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("%s exists without %s: %w", keyFile, certFile, os.ErrExist)
+		}
+	}
+	ca.once.Do(ca.init)
+	return SaveCert(ca.Cert, certFile, keyFile)
+}
+
+// marshalKey encodes private key into a PEM block. RSA and ECDSA keys are encoded with their traditional formats,
+// anything else as PKCS#8.
+func marshalKey(key crypto.PrivateKey) (*pem.Block, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+}
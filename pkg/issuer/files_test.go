@@ -0,0 +1,150 @@
+package issuer_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/issuer"
+)
+
+func TestSelfSignedCA_LoadOrGenerateFiles(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		certFile = filepath.Join(dir, "ca.pem")
+		keyFile  = filepath.Join(dir, "ca-key.pem")
+	)
+
+	first := &issuer.SelfSignedCA{}
+	require.NoError(t, first.LoadOrGenerateFiles(certFile, keyFile))
+	require.NotNil(t, first.Cert)
+
+	second := &issuer.SelfSignedCA{}
+	require.NoError(t, second.LoadOrGenerateFiles(certFile, keyFile))
+	require.Equal(t, first.Cert.Certificate[0], second.Cert.Certificate[0])
+	// the saved root is meant to be reused for years
+	require.True(t, first.Cert.Leaf.NotAfter.After(time.Now().Add(issuer.DefaultIssuerRootValidity-time.Hour)))
+	require.True(t, first.Cert.Leaf.NotBefore.Before(time.Now()))
+
+	cert, err := second.Issue("example.com", []string{"example.com"}, nil)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first.Cert.Leaf)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+	require.NoError(t, err)
+}
+
+func TestSelfSignedCA_LoadOrGenerateFiles_KeyExists(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		certFile = filepath.Join(dir, "ca.pem")
+		keyFile  = filepath.Join(dir, "ca-key.pem")
+	)
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("key"), 0600))
+
+	err := (&issuer.SelfSignedCA{}).LoadOrGenerateFiles(certFile, keyFile)
+	require.True(t, errors.Is(err, os.ErrExist), err)
+	b, err := ioutil.ReadFile(keyFile)
+	require.NoError(t, err)
+	require.Equal(t, "key", string(b))
+	require.NoFileExists(t, certFile)
+}
+
+func TestSelfSignedCA_LoadFiles(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		ca  = &issuer.SelfSignedCA{}
+	)
+	_, err := ca.Issue("example.com", nil, nil) // force root generation
+	require.NoError(t, err)
+
+	t.Run("combined", func(t *testing.T) {
+		f := filepath.Join(dir, "combined.pem")
+		require.NoError(t, issuer.SaveCert(ca.Cert, f, ""))
+
+		loaded := &issuer.SelfSignedCA{}
+		require.NoError(t, loaded.LoadFiles(f, ""))
+		require.Equal(t, ca.Cert.Certificate[0], loaded.Cert.Certificate[0])
+	})
+
+	t.Run("PKCS#8", func(t *testing.T) {
+		var (
+			certFile = filepath.Join(dir, "pkcs8.pem")
+			keyFile  = filepath.Join(dir, "pkcs8-key.pem")
+		)
+		require.NoError(t, issuer.SaveCert(ca.Cert, certFile, keyFile))
+		der, err := x509.MarshalPKCS8PrivateKey(ca.Cert.PrivateKey)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+		loaded := &issuer.SelfSignedCA{}
+		require.NoError(t, loaded.LoadFiles(certFile, keyFile))
+	})
+
+	t.Run("EC", func(t *testing.T) {
+		var (
+			certFile = filepath.Join(dir, "ec.pem")
+			keyFile  = filepath.Join(dir, "ec-key.pem")
+		)
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		tmpl := issuer.DefaultIssuerRootTmpl
+		tmpl.SignatureAlgorithm = x509.ECDSAWithSHA256
+		tmpl.NotBefore = time.Now()
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+		require.NoError(t, err)
+		require.NoError(t, issuer.SaveCert(&tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certFile, keyFile))
+
+		loaded := &issuer.SelfSignedCA{}
+		require.NoError(t, loaded.LoadFiles(certFile, keyFile))
+		_, ok := loaded.Cert.PrivateKey.(*ecdsa.PrivateKey)
+		require.True(t, ok)
+
+		cert, err := loaded.Issue("example.com", []string{"example.com"}, nil)
+		require.NoError(t, err)
+		require.Equal(t, x509.ECDSAWithSHA256, cert.Leaf.SignatureAlgorithm)
+	})
+
+	t.Run("not CA", func(t *testing.T) {
+		var (
+			certFile = filepath.Join(dir, "leaf.pem")
+			keyFile  = filepath.Join(dir, "leaf-key.pem")
+		)
+		cert, err := ca.Issue("example.com", []string{"example.com"}, nil)
+		require.NoError(t, err)
+		require.NoError(t, issuer.SaveCert(cert, certFile, keyFile))
+
+		loaded := &issuer.SelfSignedCA{}
+		require.True(t, errors.Is(loaded.LoadFiles(certFile, keyFile), issuer.ErrNotCA))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		var (
+			certFile = filepath.Join(dir, "expired.pem")
+			keyFile  = filepath.Join(dir, "expired-key.pem")
+			tmpl     = issuer.DefaultIssuerRootTmpl
+		)
+		tmpl.NotBefore = time.Now().Add(-2 * time.Hour)
+		tmpl.NotAfter = time.Now().Add(-time.Hour)
+		expired := &issuer.SelfSignedCA{RootTmpl: &tmpl}
+		_, err := expired.Issue("example.com", nil, nil)
+		require.NoError(t, err)
+		require.NoError(t, issuer.SaveCert(expired.Cert, certFile, keyFile))
+
+		loaded := &issuer.SelfSignedCA{}
+		require.True(t, errors.Is(loaded.LoadFiles(certFile, keyFile), issuer.ErrExpired))
+	})
+}
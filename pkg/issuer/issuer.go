@@ -1,12 +1,12 @@
 package issuer
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
 	"io"
 	"math/big"
 	"net"
@@ -19,6 +19,14 @@ type Issuer interface {
 	Issue(cn string, dnsnames []string, ipaddresses []net.IP) (*tls.Certificate, error)
 }
 
+// MirrorIssuer is an Issuer capable of issuing look-alike copies of existing certificates.
+type MirrorIssuer interface {
+	Issuer
+
+	// IssueMirror issues a certificate with subject, alternative names and validity period copied from orig.
+	IssueMirror(orig *x509.Certificate) (*tls.Certificate, error)
+}
+
 // SelfSignedCA defines an Issuer. Zero value is a valid instance.
 type SelfSignedCA struct {
 	// Cert is a cert chain used to sign newly issued certs. The cert's primary usage must be x509.KeyUsageCertSign
@@ -26,12 +34,22 @@ type SelfSignedCA struct {
 	// If nil, a self-signed cert will be generated.
 	Cert *tls.Certificate
 
-	// BitSize defines bit size for issued certificate keys generation.
+	// KeyAlgorithm defines algorithm for issued certificate keys generation.
+	//
+	// If empty, KeyAlgorithmRSA will be used.
+	KeyAlgorithm KeyAlgorithm
+
+	// BitSize defines bit size for issued certificate keys generation. Only applicable to KeyAlgorithmRSA.
 	//
 	// If 0, DefaultIssuerBitSize will be used.
 	BitSize int
 
-	// RootBitSize defines bit size for self-signed root certificate key generation.
+	// RootKeyAlgorithm defines algorithm for self-signed root certificate key generation.
+	//
+	// If empty, KeyAlgorithmRSA will be used.
+	RootKeyAlgorithm KeyAlgorithm
+
+	// RootBitSize defines bit size for self-signed root certificate key generation. Only applicable to KeyAlgorithmRSA.
 	//
 	// If 0, DefaultIssuerRootBitSize will be used.
 	RootBitSize int
@@ -41,7 +59,8 @@ type SelfSignedCA struct {
 	// If nil, DefaultIssuerTmpl will be used.
 	Tmpl *x509.Certificate
 
-	// RootTmpl is a template for self-signed root certificate.
+	// RootTmpl is a template for self-signed root certificate. If validity period of the template is not set, the root
+	// is valid for DefaultIssuerRootValidity since it's generated.
 	//
 	// If nil, DefaultIssuerRootTmpl will be used.
 	RootTmpl *x509.Certificate
@@ -56,39 +75,86 @@ type SelfSignedCA struct {
 
 // Issue implements Issuer interface
 func (ca *SelfSignedCA) Issue(cn string, dnsnames []string, ipaddresses []net.IP) (*tls.Certificate, error) {
+	key, err := ca.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return ca.IssueKey(key, cn, dnsnames, ipaddresses)
+}
+
+// GenerateKey generates private key for a certificate according to KeyAlgorithm and BitSize.
+func (ca *SelfSignedCA) GenerateKey() (crypto.Signer, error) {
+	ca.once.Do(ca.init)
+	return generateKey(ca.Rand, ca.KeyAlgorithm, ca.BitSize)
+}
+
+// IssueKey works like Issue, but uses provided private key instead of generating a new one.
+func (ca *SelfSignedCA) IssueKey(key crypto.Signer, cn string, dnsnames []string, ipaddresses []net.IP) (*tls.Certificate, error) {
 	ca.once.Do(ca.init)
 
 	tmpl := *ca.Tmpl
 	tmpl.Subject.CommonName = cn
-	tmpl.NotBefore = time.Now()
-	tmpl.NotAfter = time.Now().AddDate(10, 0, 0)
-	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
-	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+	now := time.Now()
+	tmpl.NotBefore = now.Add(-DefaultIssuerBackdate)
+	tmpl.NotAfter = now.Add(DefaultIssuerValidity)
 	tmpl.DNSNames = dnsnames
 	tmpl.IPAddresses = ipaddresses
+	return ca.sign(key, &tmpl)
+}
 
-	key, err := rsa.GenerateKey(ca.Rand, 1024)
+// IssueMirror implements MirrorIssuer interface
+func (ca *SelfSignedCA) IssueMirror(orig *x509.Certificate) (*tls.Certificate, error) {
+	key, err := ca.GenerateKey()
 	if err != nil {
 		return nil, err
 	}
+	return ca.issueMirror(key, orig)
+}
 
-	der, err := x509.CreateCertificate(ca.Rand, &tmpl, ca.Cert.Leaf, &key.PublicKey, ca.Cert.PrivateKey)
+func (ca *SelfSignedCA) issueMirror(key crypto.Signer, orig *x509.Certificate) (*tls.Certificate, error) {
+	ca.once.Do(ca.init)
+
+	tmpl := *ca.Tmpl
+	tmpl.Subject = orig.Subject
+	tmpl.Subject.Names = nil
+	tmpl.NotBefore = orig.NotBefore
+	tmpl.NotAfter = orig.NotAfter
+	tmpl.DNSNames = orig.DNSNames
+	tmpl.IPAddresses = orig.IPAddresses
+	tmpl.EmailAddresses = orig.EmailAddresses
+	tmpl.URIs = orig.URIs
+	return ca.sign(key, &tmpl)
+}
+
+// sign signs the certificate for the key according to the template. Serial number, signature algorithm and key usage
+// are always set by the CA.
+func (ca *SelfSignedCA) sign(key crypto.Signer, tmpl *x509.Certificate) (*tls.Certificate, error) {
+	serial, err := generateSerial(ca.Rand)
 	if err != nil {
 		return nil, err
 	}
+	tmpl.SerialNumber = serial
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+	tmpl.SignatureAlgorithm = signatureAlgorithm(ca.Cert.PrivateKey)
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		// RSA key exchange requires the key to be usable for encryption
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
 
-	cert, err := tls.X509KeyPair(
-		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
-		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
-	)
+	der, err := x509.CreateCertificate(ca.Rand, tmpl, ca.Cert.Leaf, key.Public(), ca.Cert.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
-	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	leaf, err := x509.ParseCertificate(der)
 	if err != nil {
 		return nil, err
 	}
-	return &cert, nil
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
 }
 
 func (ca *SelfSignedCA) init() {
@@ -101,9 +167,15 @@ func (ca *SelfSignedCA) init() {
 	if ca.RootTmpl == nil {
 		ca.RootTmpl = &DefaultIssuerRootTmpl
 	}
+	if ca.KeyAlgorithm == "" {
+		ca.KeyAlgorithm = KeyAlgorithmRSA
+	}
 	if ca.BitSize == 0 {
 		ca.BitSize = DefaultIssuerBitSize
 	}
+	if ca.RootKeyAlgorithm == "" {
+		ca.RootKeyAlgorithm = KeyAlgorithmRSA
+	}
 	if ca.RootBitSize == 0 {
 		ca.RootBitSize = DefaultIssuerRootBitSize
 	}
@@ -117,33 +189,54 @@ func (ca *SelfSignedCA) init() {
 }
 
 func (ca *SelfSignedCA) initRootCert() {
-	key, err := rsa.GenerateKey(ca.Rand, ca.RootBitSize)
+	key, err := generateKey(ca.Rand, ca.RootKeyAlgorithm, ca.RootBitSize)
 	if err != nil {
 		panic(err)
 	}
-	cert, err := x509.CreateCertificate(ca.Rand, ca.RootTmpl, ca.RootTmpl, &key.PublicKey, key)
+	serial, err := generateSerial(ca.Rand)
 	if err != nil {
 		panic(err)
 	}
-	pair, err := tls.X509KeyPair(
-		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
-		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
-	)
+	tmpl := *ca.RootTmpl
+	tmpl.SerialNumber = serial
+	if tmpl.NotAfter.IsZero() {
+		now := time.Now()
+		tmpl.NotBefore = now.Add(-DefaultIssuerBackdate)
+		tmpl.NotAfter = now.Add(DefaultIssuerRootValidity)
+	}
+	tmpl.SignatureAlgorithm = signatureAlgorithm(key)
+	der, err := x509.CreateCertificate(ca.Rand, &tmpl, &tmpl, key.Public(), key)
 	if err != nil {
 		panic(err)
 	}
-	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	leaf, err := x509.ParseCertificate(der)
 	if err != nil {
 		panic(err)
 	}
-	ca.Cert = &pair
+	ca.Cert = &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
 }
 
 // DefaultIssuerRootBitSize defines default bit size for a self-signed root cert.
 const DefaultIssuerRootBitSize = 2048
 
 // DefaultIssuerBitSize defines default bit size for issued certs.
-const DefaultIssuerBitSize = 1024
+const DefaultIssuerBitSize = 2048
+
+// DefaultIssuerValidity defines validity period of issued certs. Browsers reject server certs valid for more than 398
+// days, Apple platforms for more than 825 days.
+const DefaultIssuerValidity = 397 * 24 * time.Hour
+
+// DefaultIssuerRootValidity defines validity period of a self-signed root cert. The root is meant to be saved and
+// trusted by clients, so it's long.
+const DefaultIssuerRootValidity = 10 * 365 * 24 * time.Hour
+
+// DefaultIssuerBackdate defines how long before issuing the issued certs become valid, to tolerate clock skew of
+// clients.
+const DefaultIssuerBackdate = time.Hour
 
 var (
 	// DefaultIssuerRootTmpl is the default template for self-signed root CA certificate.
@@ -157,13 +250,10 @@ var (
 			CommonName:   "root.example.org",
 			Organization: []string{"Multiproxy Root Org"},
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(time.Hour * 24 * 365 * 2),
 		IsCA:                  true,
 		BasicConstraintsValid: true,
 		OCSPServer:            []string{"ocsp.example.org"},
 		DNSNames:              []string{"root.example.org"},
-		SignatureAlgorithm:    x509.SHA1WithRSA,
 		KeyUsage:              x509.KeyUsageCertSign,
 	}
 
@@ -1,8 +1,12 @@
 package issuer_test
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -24,4 +28,83 @@ func TestIssuer_Issue(t *testing.T) {
 		require.Len(t, cert.Leaf.IPAddresses, 1)
 		require.True(t, cert.Leaf.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")))
 	})
+	t.Run("Validity", func(t *testing.T) {
+		cert, err := (&issuer.SelfSignedCA{}).Issue("example.com", []string{"example.com"}, nil)
+		require.NoError(t, err)
+		require.True(t, cert.Leaf.NotBefore.Before(time.Now().Add(-time.Minute)))
+		require.True(t, cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore) <= 398*24*time.Hour)
+	})
+}
+
+func TestIssuer_KeyAlgorithm(t *testing.T) {
+	cases := []struct {
+		alg       issuer.KeyAlgorithm
+		pubkeyAlg x509.PublicKeyAlgorithm
+		sigAlg    x509.SignatureAlgorithm
+	}{
+		{issuer.KeyAlgorithmRSA, x509.RSA, x509.SHA256WithRSA},
+		{issuer.KeyAlgorithmECDSAP256, x509.ECDSA, x509.ECDSAWithSHA256},
+		{issuer.KeyAlgorithmECDSAP384, x509.ECDSA, x509.ECDSAWithSHA384},
+		{issuer.KeyAlgorithmEd25519, x509.Ed25519, x509.PureEd25519},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(string(c.alg), func(t *testing.T) {
+			ca := &issuer.SelfSignedCA{
+				KeyAlgorithm:     c.alg,
+				RootKeyAlgorithm: c.alg,
+			}
+			cert, err := ca.Issue("example.com", []string{"example.com"}, nil)
+			require.NoError(t, err)
+			require.Equal(t, c.pubkeyAlg, cert.Leaf.PublicKeyAlgorithm)
+			require.Equal(t, c.sigAlg, cert.Leaf.SignatureAlgorithm)
+			require.Equal(t, c.sigAlg, ca.Cert.Leaf.SignatureAlgorithm)
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.Cert.Leaf)
+			_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+			require.NoError(t, err)
+		})
+	}
+	t.Run("bit size", func(t *testing.T) {
+		cert, err := (&issuer.SelfSignedCA{BitSize: 3072}).Issue("example.com", []string{"example.com"}, nil)
+		require.NoError(t, err)
+		require.Equal(t, 3072, cert.Leaf.PublicKey.(*rsa.PublicKey).N.BitLen())
+	})
+	t.Run("unique serial", func(t *testing.T) {
+		ca := &issuer.SelfSignedCA{KeyAlgorithm: issuer.KeyAlgorithmECDSAP256}
+		a, err := ca.Issue("example.com", []string{"example.com"}, nil)
+		require.NoError(t, err)
+		b, err := ca.Issue("example.com", []string{"example.com"}, nil)
+		require.NoError(t, err)
+		require.NotEqual(t, a.Leaf.SerialNumber, b.Leaf.SerialNumber)
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := (&issuer.SelfSignedCA{KeyAlgorithm: "dsa"}).Issue("example.com", nil, nil)
+		require.True(t, errors.Is(err, issuer.ErrUnsupportedKeyAlgorithm))
+	})
+}
+
+func TestIssuer_IssueMirror(t *testing.T) {
+	orig, err := (&issuer.SelfSignedCA{KeyAlgorithm: issuer.KeyAlgorithmECDSAP256}).Issue(
+		"www.example.com",
+		[]string{"www.example.com", "example.com"},
+		[]net.IP{net.ParseIP("192.0.2.1")},
+	)
+	require.NoError(t, err)
+
+	for _, iss := range []issuer.MirrorIssuer{
+		&issuer.SelfSignedCA{KeyAlgorithm: issuer.KeyAlgorithmECDSAP256},
+		&issuer.KeyPool{CA: &issuer.SelfSignedCA{KeyAlgorithm: issuer.KeyAlgorithmECDSAP256}, Size: 1},
+	} {
+		cert, err := iss.IssueMirror(orig.Leaf)
+		require.NoError(t, err)
+		require.Equal(t, orig.Leaf.Subject.String(), cert.Leaf.Subject.String())
+		require.Equal(t, orig.Leaf.DNSNames, cert.Leaf.DNSNames)
+		require.Len(t, cert.Leaf.IPAddresses, 1)
+		require.True(t, cert.Leaf.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")))
+		require.True(t, orig.Leaf.NotBefore.Equal(cert.Leaf.NotBefore))
+		require.True(t, orig.Leaf.NotAfter.Equal(cert.Leaf.NotAfter))
+		require.NotEqual(t, orig.Leaf.PublicKey, cert.Leaf.PublicKey)
+	}
 }
@@ -0,0 +1,94 @@
+package issuer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// KeyAlgorithm defines the algorithm of generated certificate keys.
+type KeyAlgorithm string
+
+const (
+	// KeyAlgorithmRSA stands for RSA keys of configurable bit size signed with SHA-256.
+	KeyAlgorithmRSA KeyAlgorithm = "rsa"
+
+	// KeyAlgorithmECDSAP256 stands for ECDSA keys on P-256 curve signed with SHA-256.
+	KeyAlgorithmECDSAP256 KeyAlgorithm = "ecdsa-p256"
+
+	// KeyAlgorithmECDSAP384 stands for ECDSA keys on P-384 curve signed with SHA-384.
+	KeyAlgorithmECDSAP384 KeyAlgorithm = "ecdsa-p384"
+
+	// KeyAlgorithmEd25519 stands for Ed25519 keys. Note that most browsers don't accept Ed25519 certificates yet.
+	KeyAlgorithmEd25519 KeyAlgorithm = "ed25519"
+)
+
+// ErrUnsupportedKeyAlgorithm is returned when key generation is requested for unknown algorithm.
+var ErrUnsupportedKeyAlgorithm = errors.New("unsupported key algorithm")
+
+// ParseKeyAlgorithm converts string into KeyAlgorithm. Returns ErrUnsupportedKeyAlgorithm if the algorithm is unknown.
+func ParseKeyAlgorithm(s string) (KeyAlgorithm, error) {
+	switch alg := KeyAlgorithm(s); alg {
+	case KeyAlgorithmRSA, KeyAlgorithmECDSAP256, KeyAlgorithmECDSAP384, KeyAlgorithmEd25519:
+		return alg, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedKeyAlgorithm, s)
+	}
+}
+
+func generateKey(r io.Reader, alg KeyAlgorithm, bits int) (crypto.Signer, error) {
+	switch alg {
+	case KeyAlgorithmRSA:
+		return rsa.GenerateKey(r, bits)
+	case KeyAlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), r)
+	case KeyAlgorithmECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), r)
+	case KeyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(r)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedKeyAlgorithm, alg)
+	}
+}
+
+// signatureAlgorithm returns the signature algorithm matching the signer key.
+func signatureAlgorithm(key crypto.PrivateKey) x509.SignatureAlgorithm {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return x509.SHA256WithRSA
+	case *ecdsa.PrivateKey:
+		if key.Curve == elliptic.P384() {
+			return x509.ECDSAWithSHA384
+		}
+		if key.Curve == elliptic.P521() {
+			return x509.ECDSAWithSHA512
+		}
+		return x509.ECDSAWithSHA256
+	case ed25519.PrivateKey:
+		return x509.PureEd25519
+	default:
+		// let crypto/x509 decide
+		return x509.UnknownSignatureAlgorithm
+	}
+}
+
+// serialLimit is the upper bound for random certificate serial numbers, 128 bits as recommended by CA/B Forum.
+var serialLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// generateSerial returns random serial number. Clients may reject certificates sharing issuer and serial number, so
+// each certificate needs an unique one.
+func generateSerial(r io.Reader) (*big.Int, error) {
+	return rand.Int(r, serialLimit)
+}
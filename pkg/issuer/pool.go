@@ -0,0 +1,151 @@
+package issuer
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyPool is an Issuer which pre-generates private keys in background, so issuing a certificate only costs a
+// signature. If the pool runs dry, keys are generated synchronously.
+//
+// Zero value is a valid instance. Background generation starts on the first Issue call.
+type KeyPool struct {
+	// CA is the underlying certificate authority which generates keys and signs certificates.
+	//
+	// If nil, zero value of SelfSignedCA will be used.
+	CA *SelfSignedCA
+
+	// Size defines the number of keys kept ready for use.
+	//
+	// If 0, DefaultKeyPoolSize will be used.
+	Size int
+
+	// Workers defines the number of goroutines generating keys concurrently.
+	//
+	// If 0, runtime.GOMAXPROCS(0) will be used.
+	Workers int
+
+	once      sync.Once
+	keys      chan crypto.Signer
+	done      chan struct{}
+	closeOnce sync.Once
+
+	hits   uint64
+	misses uint64
+}
+
+// KeyPoolStats holds KeyPool statistics.
+type KeyPoolStats struct {
+	// Size is the number of keys available in the pool.
+	Size int
+
+	// Capacity is the maximum number of keys the pool holds.
+	Capacity int
+
+	// Hits is the number of certificates issued with pre-generated keys.
+	Hits uint64
+
+	// Misses is the number of certificates for which keys were generated synchronously.
+	Misses uint64
+}
+
+func (p *KeyPool) init() {
+	if p.CA == nil {
+		p.CA = &SelfSignedCA{}
+	}
+	if p.Size == 0 {
+		p.Size = DefaultKeyPoolSize
+	}
+	if p.Workers == 0 {
+		p.Workers = runtime.GOMAXPROCS(0)
+	}
+	p.keys = make(chan crypto.Signer, p.Size)
+	p.done = make(chan struct{})
+	for i := 0; i < p.Workers; i++ {
+		go p.generate()
+	}
+}
+
+// Start starts background key generation without waiting for the first Issue call.
+func (p *KeyPool) Start() {
+	p.once.Do(p.init)
+}
+
+// Issue implements Issuer interface
+func (p *KeyPool) Issue(cn string, dnsnames []string, ipaddresses []net.IP) (*tls.Certificate, error) {
+	key, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	return p.CA.IssueKey(key, cn, dnsnames, ipaddresses)
+}
+
+// IssueMirror implements MirrorIssuer interface
+func (p *KeyPool) IssueMirror(orig *x509.Certificate) (*tls.Certificate, error) {
+	key, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	return p.CA.issueMirror(key, orig)
+}
+
+// key takes a key from the pool or generates one if the pool is empty.
+func (p *KeyPool) key() (crypto.Signer, error) {
+	p.once.Do(p.init)
+	select {
+	case key := <-p.keys:
+		atomic.AddUint64(&p.hits, 1)
+		return key, nil
+	default:
+		atomic.AddUint64(&p.misses, 1)
+		return p.CA.GenerateKey()
+	}
+}
+
+// Stats returns pool statistics.
+func (p *KeyPool) Stats() KeyPoolStats {
+	p.once.Do(p.init)
+	return KeyPoolStats{
+		Size:     len(p.keys),
+		Capacity: cap(p.keys),
+		Hits:     atomic.LoadUint64(&p.hits),
+		Misses:   atomic.LoadUint64(&p.misses),
+	}
+}
+
+// Close stops background key generation. Issue keeps working after Close, generating keys synchronously once the
+// pool is drained.
+func (p *KeyPool) Close() {
+	p.once.Do(p.init)
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+func (p *KeyPool) generate() {
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		key, err := p.CA.GenerateKey()
+		if err != nil {
+			// the error is going to be reported by synchronous generation once the pool is drained
+			return
+		}
+		select {
+		case p.keys <- key:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// DefaultKeyPoolSize defines default number of pre-generated keys in KeyPool.
+const DefaultKeyPoolSize = 16
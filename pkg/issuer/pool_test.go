@@ -0,0 +1,58 @@
+package issuer_test
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/issuer"
+)
+
+func TestKeyPool_Issue(t *testing.T) {
+	p := &issuer.KeyPool{
+		CA:   &issuer.SelfSignedCA{KeyAlgorithm: issuer.KeyAlgorithmECDSAP256},
+		Size: 4,
+	}
+	defer p.Close()
+	p.Start()
+
+	require.Eventually(t, func() bool {
+		return p.Stats().Size == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cert, err := p.Issue("example.com", []string{"example.com"}, nil)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert.Leaf)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+	require.NoError(t, err)
+
+	stats := p.Stats()
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, uint64(0), stats.Misses)
+	require.Equal(t, 4, stats.Capacity)
+
+	// the pool gets refilled
+	require.Eventually(t, func() bool {
+		return p.Stats().Size == 4
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKeyPool_Close(t *testing.T) {
+	p := &issuer.KeyPool{
+		CA:   &issuer.SelfSignedCA{KeyAlgorithm: issuer.KeyAlgorithmECDSAP256},
+		Size: 1,
+	}
+	p.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := p.Issue("example.com", []string{"example.com"}, nil)
+		require.NoError(t, err)
+	}
+	stats := p.Stats()
+	require.Equal(t, uint64(3), stats.Hits+stats.Misses)
+	require.True(t, stats.Misses >= 2)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/akabos/multiproxy/pkg/certcache"
+	"github.com/akabos/multiproxy/pkg/issuer"
+)
+
+// CertCache is a certcache.Cache counting hits and misses of the underlying cache.
+type CertCache struct {
+	Cache  certcache.Cache
+	Hits   *Counter
+	Misses *Counter
+}
+
+// Get implements certcache.Cache interface
+func (c *CertCache) Get(key string) (*tls.Certificate, error) {
+	cert, err := c.Cache.Get(key)
+	switch {
+	case err == nil:
+		c.Hits.Inc()
+	case errors.Is(err, certcache.ErrMiss):
+		c.Misses.Inc()
+	}
+	return cert, err
+}
+
+// Add implements certcache.Cache interface
+func (c *CertCache) Add(key string, cert *tls.Certificate) error {
+	return c.Cache.Add(key, cert)
+}
+
+// Issuer is an issuer.MirrorIssuer observing issuance latency of the underlying issuer. If the underlying issuer
+// doesn't implement issuer.MirrorIssuer, IssueMirror only copies names of the original certificate.
+type Issuer struct {
+	Issuer   issuer.Issuer
+	Duration *Histogram
+}
+
+// Issue implements issuer.Issuer interface
+func (i *Issuer) Issue(cn string, dnsnames []string, ipaddresses []net.IP) (*tls.Certificate, error) {
+	defer i.observe(time.Now())
+	return i.Issuer.Issue(cn, dnsnames, ipaddresses)
+}
+
+// IssueMirror implements issuer.MirrorIssuer interface
+func (i *Issuer) IssueMirror(orig *x509.Certificate) (*tls.Certificate, error) {
+	mi, ok := i.Issuer.(issuer.MirrorIssuer)
+	if !ok {
+		return i.Issue(orig.Subject.CommonName, orig.DNSNames, orig.IPAddresses)
+	}
+	defer i.observe(time.Now())
+	return mi.IssueMirror(orig)
+}
+
+func (i *Issuer) observe(start time.Time) {
+	i.Duration.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,374 @@
+// Package metrics implements counters, gauges and histograms exposed in Prometheus text format.
+//
+// Only the subset of the Prometheus data model used by the proxy is implemented: metrics with fixed sets of labels,
+// registered once and updated concurrently.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the default histogram buckets, tailored to measure request latency in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics. It implements http.Handler serving the metrics in Prometheus text format.
+//
+// Zero value is a valid empty registry.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]collector
+}
+
+type collector interface {
+	write(w *bufio.Writer, name string)
+}
+
+// register adds the metric or returns existing metric of the same name. It panics if the existing metric is of
+// different kind.
+func (r *Registry) register(name string, m collector) collector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.metrics == nil {
+		r.metrics = make(map[string]collector)
+	}
+	if existing, ok := r.metrics[name]; ok {
+		if reflect.TypeOf(existing) != reflect.TypeOf(m) {
+			panic(fmt.Sprintf("metric %s is already registered as %T", name, existing))
+		}
+		return existing
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// Counter registers counter with the labels, or returns the counter registered earlier under the name.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return r.register(name, &CounterVec{vec: newVec(help, "counter", labels)}).(*CounterVec)
+}
+
+// Gauge registers gauge with the labels, or returns the gauge registered earlier under the name.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return r.register(name, &GaugeVec{vec: newVec(help, "gauge", labels)}).(*GaugeVec)
+}
+
+// GaugeFunc registers gauge which value is obtained by calling the function upon every scrape.
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.register(name, &gaugeFunc{help: help, f: f})
+}
+
+// Histogram registers histogram with the buckets and the labels, or returns the histogram registered earlier under the
+// name. Buckets are upper bounds in increasing order, nil means DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{vec: newVec(help, "histogram", labels), buckets: buckets}
+	return r.register(name, h).(*HistogramVec)
+}
+
+// ServeHTTP implements http.Handler interface
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(rw)
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	metrics := make(map[string]collector, len(r.metrics))
+	for name, m := range r.metrics {
+		names = append(names, name)
+		metrics[name] = m
+	}
+	r.mu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		metrics[name].write(w, name)
+	}
+	_ = w.Flush()
+}
+
+// vec is a set of series of a metric distinguished by label values.
+type vec struct {
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.RWMutex
+	series map[string]interface{}
+}
+
+func newVec(help, typ string, labels []string) vec {
+	return vec{help: help, typ: typ, labels: labels, series: make(map[string]interface{})}
+}
+
+// with returns the series for the label values, creating it with the function if needed.
+func (v *vec) with(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok = v.series[key]; !ok {
+		s = create()
+		v.series[key] = s
+	}
+	return s
+}
+
+// each calls the function for each series in order of label values.
+func (v *vec) each(f func(labels string, s interface{})) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		v.mu.RLock()
+		s := v.series[key]
+		v.mu.RUnlock()
+		var values []string
+		if len(v.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		f(formatLabels(v.labels, values), s)
+	}
+}
+
+func (v *vec) writeHeader(w *bufio.Writer, name string) {
+	writeHeader(w, name, v.help, v.typ)
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel appends the label to formatted label set.
+func withLabel(labels, name, value string) string {
+	l := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return labels[:len(labels)-1] + "," + l + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec
+}
+
+// With returns the counter for the label values. Values must be given in the order labels were registered.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (v *CounterVec) write(w *bufio.Writer, name string) {
+	v.writeHeader(w, name)
+	v.each(func(labels string, s interface{}) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(s.(*Counter).Value()))
+	})
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v value
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add increments the counter by the value. Negative values are ignored.
+func (c *Counter) Add(f float64) {
+	if f > 0 {
+		c.v.add(f)
+	}
+}
+
+// Value returns current value of the counter.
+func (c *Counter) Value() float64 {
+	return c.v.get()
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	vec
+}
+
+// With returns the gauge for the label values. Values must be given in the order labels were registered.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (v *GaugeVec) write(w *bufio.Writer, name string) {
+	v.writeHeader(w, name)
+	v.each(func(labels string, s interface{}) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(s.(*Gauge).Value()))
+	})
+}
+
+// Gauge is a value which goes up and down.
+type Gauge struct {
+	v value
+}
+
+// Set sets the gauge to the value.
+func (g *Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+// Add adds the value to the gauge. The value may be negative.
+func (g *Gauge) Add(f float64) {
+	g.v.add(f)
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+// Value returns current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return g.v.get()
+}
+
+type gaugeFunc struct {
+	help string
+	f    func() float64
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer, name string) {
+	writeHeader(w, name, g.help, "gauge")
+	_, _ = fmt.Fprintf(w, "%s %s\n", name, formatFloat(g.f()))
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// With returns the histogram for the label values. Values must be given in the order labels were registered.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values, func() interface{} {
+		return &Histogram{buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+	}).(*Histogram)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer, name string) {
+	v.writeHeader(w, name)
+	v.each(func(labels string, s interface{}) {
+		h := s.(*Histogram)
+		h.mu.Lock()
+		counts := append([]uint64(nil), h.counts...)
+		count, sum := h.count, h.sum
+		h.mu.Unlock()
+
+		var cumulative uint64
+		for i, le := range v.buckets {
+			cumulative += counts[i]
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatFloat(le)), cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+	})
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(f float64) {
+	i := sort.SearchFloat64s(h.buckets, f)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += f
+}
@@ -0,0 +1,148 @@
+package metrics_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/certcache"
+	"github.com/akabos/multiproxy/pkg/issuer"
+	"github.com/akabos/multiproxy/pkg/metrics"
+)
+
+func scrape(t *testing.T, r *metrics.Registry) string {
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rw.Header().Get("Content-Type"))
+	return rw.Body.String()
+}
+
+func TestRegistry(t *testing.T) {
+	r := &metrics.Registry{}
+	c := r.Counter("test_requests_total", "Number of requests.", "code", "host")
+	c.With("200", "example.com").Inc()
+	c.With("200", "example.com").Add(2)
+	c.With("502", `a"b\c`).Inc()
+	c.With("502", "x").Add(-1)
+	require.Same(t, c, r.Counter("test_requests_total", "ignored", "code", "host"))
+
+	g := r.Gauge("test_active", "Active\nrequests.")
+	g.With().Inc()
+	g.With().Inc()
+	g.With().Dec()
+
+	r.GaugeFunc("test_size", "Size.", func() float64 { return 42 })
+
+	h := r.Histogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "handler")
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.With("http").Observe(v)
+	}
+
+	require.Equal(t, `# HELP test_active Active\nrequests.
+# TYPE test_active gauge
+test_active 1
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{handler="http",le="0.1"} 2
+test_duration_seconds_bucket{handler="http",le="1"} 3
+test_duration_seconds_bucket{handler="http",le="+Inf"} 4
+test_duration_seconds_sum{handler="http"} 2.65
+test_duration_seconds_count{handler="http"} 4
+# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200",host="example.com"} 3
+test_requests_total{code="502",host="a\"b\\c"} 1
+test_requests_total{code="502",host="x"} 0
+# HELP test_size Size.
+# TYPE test_size gauge
+test_size 42
+`, scrape(t, r))
+
+	require.Panics(t, func() { r.Gauge("test_requests_total", "") })
+	require.Panics(t, func() { c.With("200") })
+}
+
+func TestRegistry_Concurrency(t *testing.T) {
+	var (
+		r  = &metrics.Registry{}
+		c  = r.Counter("test_total", "", "n")
+		wg sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.With("a").Inc()
+				_ = scrape(t, r)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, float64(10000), c.With("a").Value())
+}
+
+type failingCache struct{}
+
+func (failingCache) Get(string) (*tls.Certificate, error) { return nil, errors.New("broken") }
+
+func (failingCache) Add(string, *tls.Certificate) error { return nil }
+
+func TestCertCache(t *testing.T) {
+	r := &metrics.Registry{}
+	v := r.Counter("test_cert_cache_total", "", "result")
+	c := &metrics.CertCache{Cache: &certcache.ARC{}, Hits: v.With("hit"), Misses: v.With("miss")}
+	ca := &issuer.SelfSignedCA{KeyAlgorithm: issuer.KeyAlgorithmECDSAP256, RootKeyAlgorithm: issuer.KeyAlgorithmECDSAP256}
+	cert, err := ca.Issue("example.com", []string{"example.com"}, nil)
+	require.NoError(t, err)
+
+	_, err = c.Get("example.com")
+	require.Equal(t, certcache.ErrMiss, err)
+	require.NoError(t, c.Add("example.com", cert))
+	_, err = c.Get("example.com")
+	require.NoError(t, err)
+	require.Equal(t, float64(1), v.With("hit").Value())
+	require.Equal(t, float64(1), v.With("miss").Value())
+
+	c.Cache = failingCache{}
+	_, err = c.Get("example.com")
+	require.Error(t, err)
+	require.Equal(t, float64(1), v.With("miss").Value())
+}
+
+type plainIssuer struct {
+	issuer.Issuer
+	names []string
+}
+
+func (i *plainIssuer) Issue(cn string, dnsnames []string, ipaddresses []net.IP) (*tls.Certificate, error) {
+	i.names = append([]string{cn}, dnsnames...)
+	return &tls.Certificate{}, nil
+}
+
+func TestIssuer(t *testing.T) {
+	r := &metrics.Registry{}
+	h := r.Histogram("test_issue_seconds", "", nil)
+
+	i := &metrics.Issuer{Issuer: &issuer.SelfSignedCA{
+		KeyAlgorithm:     issuer.KeyAlgorithmECDSAP256,
+		RootKeyAlgorithm: issuer.KeyAlgorithmECDSAP256,
+	}, Duration: h.With()}
+	cert, err := i.Issue("example.com", []string{"example.com"}, nil)
+	require.NoError(t, err)
+	_, err = i.IssueMirror(cert.Leaf)
+	require.NoError(t, err)
+	require.Contains(t, scrape(t, r), "test_issue_seconds_count 2\n")
+
+	plain := &plainIssuer{}
+	i = &metrics.Issuer{Issuer: plain, Duration: h.With()}
+	_, err = i.IssueMirror(cert.Leaf)
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com", "example.com"}, plain.names)
+	require.Contains(t, scrape(t, r), "test_issue_seconds_count 3\n")
+}
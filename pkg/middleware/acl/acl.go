@@ -0,0 +1,193 @@
+// Package acl implements access control middleware.
+//
+// Access control list is an ordered list of rules. Each rule allows or denies requests matching all of its conditions:
+// client address, target host, target port and request method. The first matching rule wins, if no rule matches, the
+// default action is taken. Denied requests get `403 Forbidden`, the rule which denied the request is recorded in the
+// access log.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+	"github.com/akabos/multiproxy/pkg/router"
+)
+
+// Action is the action taken for a request.
+type Action int
+
+const (
+	// Allow passes request through.
+	Allow Action = iota
+
+	// Deny responds with 403.
+	Deny
+)
+
+// ParseAction converts string representation of the action ("allow" or "deny") into Action.
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	default:
+		return 0, fmt.Errorf("unknown action: %q", s)
+	}
+}
+
+func (a Action) String() string {
+	if a == Deny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To int
+}
+
+// Rule is an access control rule. Empty condition matches any request.
+type Rule struct {
+	Action Action
+
+	// Clients is the list of client networks.
+	Clients []*net.IPNet
+
+	// Hosts is the list of target host patterns.
+	Hosts []*router.Pattern
+
+	// Ports is the list of target port ranges.
+	Ports []PortRange
+
+	// Methods is the list of request methods.
+	Methods []string
+
+	// Name identifies the rule in the access log. Rules loaded with Parse are named after their position and source
+	// text.
+	Name string
+}
+
+// Matches reports whether the request matches all the conditions of the rule.
+func (r *Rule) Matches(rq *http.Request) bool {
+	if len(r.Methods) > 0 && !r.matchesMethod(rq.Method) {
+		return false
+	}
+	if len(r.Clients) > 0 && !r.matchesClient(rq.RemoteAddr) {
+		return false
+	}
+	hostname, port := target(rq)
+	if len(r.Hosts) > 0 && !r.matchesHost(hostname, port) {
+		return false
+	}
+	if len(r.Ports) > 0 && !r.matchesPort(port) {
+		return false
+	}
+	return true
+}
+
+func (r *Rule) matchesMethod(method string) bool {
+	for _, m := range r.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchesClient(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.Clients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchesHost(hostname string, port int) bool {
+	for _, pattern := range r.Hosts {
+		if pattern.Match(hostname, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchesPort(port int) bool {
+	for _, p := range r.Ports {
+		if port >= p.From && port <= p.To {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns target host name and port of the request. The port defaults to the one of URL scheme.
+func target(rq *http.Request) (string, int) {
+	hostname, port := rq.URL.Hostname(), rq.URL.Port()
+	if port == "" {
+		if rq.URL.Scheme == "https" {
+			return hostname, 443
+		}
+		return hostname, 80
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return hostname, -1
+	}
+	return hostname, n
+}
+
+// ACL is access control list.
+//
+// The zero value of ACL is a valid instance which allows everything.
+type ACL struct {
+	Rules []Rule
+
+	// Default is the action taken if no rule matches.
+	Default Action
+}
+
+// Check evaluates the rules against the request. Returns the action and the matching rule, which is nil if the default
+// action was taken.
+func (a *ACL) Check(rq *http.Request) (Action, *Rule) {
+	for i := range a.Rules {
+		if a.Rules[i].Matches(rq) {
+			return a.Rules[i].Action, &a.Rules[i]
+		}
+	}
+	return a.Default, nil
+}
+
+// Middleware is the middleware constructor.
+func (a *ACL) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		action, rule := a.Check(rq)
+		if action == Allow {
+			next.ServeHTTP(rw, rq)
+			return
+		}
+		reason := "default"
+		if rule != nil {
+			reason = rule.Name
+		}
+		log.With(rq, zap.String("acl", reason))
+		log.WithStatusCode(rq, http.StatusForbidden)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	})
+}
@@ -0,0 +1,137 @@
+package acl_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/justinas/alice"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/akabos/multiproxy/pkg/middleware/acl"
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+const testRules = `
+# local clients may only tunnel to HTTPS
+allow client=10.0.0.0/8,::1 method=CONNECT port=443,8443-8444
+deny  method=CONNECT
+
+allow client=10.0.0.0/8 host=.example.com
+deny  host=*
+default allow
+`
+
+func testRequest(method, target, client string) *http.Request {
+	var rq *http.Request
+	if method == http.MethodConnect {
+		// httptest.NewRequest doesn't handle authority form
+		rq = &http.Request{
+			Method:     method,
+			URL:        &url.URL{Host: target},
+			Host:       target,
+			Header:     http.Header{},
+			RequestURI: target,
+		}
+	} else {
+		rq = httptest.NewRequest(method, target, nil)
+	}
+	rq.RemoteAddr = client
+	return rq
+}
+
+func TestACL_Check(t *testing.T) {
+	a, err := acl.Parse(strings.NewReader(testRules))
+	require.NoError(t, err)
+	require.Len(t, a.Rules, 4)
+
+	for _, tc := range []struct {
+		method, target, client string
+		action                 acl.Action
+		rule                   string
+	}{
+		{http.MethodConnect, "example.com:443", "10.1.2.3:5000", acl.Allow, "line 3: allow client=10.0.0.0/8,::1 method=CONNECT port=443,8443-8444"},
+		{http.MethodConnect, "example.com:8444", "[::1]:5000", acl.Allow, "line 3: allow client=10.0.0.0/8,::1 method=CONNECT port=443,8443-8444"},
+		{http.MethodConnect, "example.com:22", "10.1.2.3:5000", acl.Deny, "line 4: deny method=CONNECT"},
+		{http.MethodConnect, "example.com:443", "192.168.1.1:5000", acl.Deny, "line 4: deny method=CONNECT"},
+		{http.MethodGet, "http://www.example.com/", "10.1.2.3:5000", acl.Allow, "line 6: allow client=10.0.0.0/8 host=.example.com"},
+		{http.MethodGet, "http://www.example.org/", "10.1.2.3:5000", acl.Deny, "line 7: deny host=*"},
+	} {
+		action, rule := a.Check(testRequest(tc.method, tc.target, tc.client))
+		require.Equal(t, tc.action, action, tc)
+		require.NotNil(t, rule, tc)
+		require.Equal(t, tc.rule, rule.Name)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		a := &acl.ACL{
+			Rules:   []acl.Rule{{Action: acl.Allow, Ports: []acl.PortRange{{From: 80, To: 80}}}},
+			Default: acl.Deny,
+		}
+		action, rule := a.Check(testRequest(http.MethodGet, "http://example.com/", "10.1.2.3:5000"))
+		require.Equal(t, acl.Allow, action)
+		require.NotNil(t, rule)
+
+		action, rule = a.Check(testRequest(http.MethodGet, "https://example.com/", "10.1.2.3:5000"))
+		require.Equal(t, acl.Deny, action)
+		require.Nil(t, rule)
+	})
+}
+
+func TestACL_Middleware(t *testing.T) {
+	a, err := acl.Parse(strings.NewReader(testRules))
+	require.NoError(t, err)
+
+	var (
+		access bytes.Buffer
+		h      = alice.New(log.Middleware(&access, ioutil.Discard, zapcore.InfoLevel), a.Middleware).ThenFunc(
+			func(rw http.ResponseWriter, rq *http.Request) {
+				rw.WriteHeader(http.StatusNoContent)
+			},
+		)
+	)
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, testRequest(http.MethodGet, "http://www.example.com/", "10.1.2.3:5000"))
+	require.Equal(t, http.StatusNoContent, rw.Code)
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, testRequest(http.MethodConnect, "example.com:22", "10.1.2.3:5000"))
+	require.Equal(t, http.StatusForbidden, rw.Code)
+	require.Contains(t, access.String(), `"acl":"line 4: deny method=CONNECT"`)
+	require.Contains(t, access.String(), `"status":403`)
+}
+
+func TestParse(t *testing.T) {
+	for _, rules := range []string{
+		"permit host=example.com",
+		"allow host",
+		"allow color=red",
+		"allow client=10.0.0.0/33",
+		"allow client=example.com",
+		"allow port=443-80",
+		"allow port=70000",
+		"allow method=",
+		"default",
+		"default maybe",
+	} {
+		_, err := acl.Parse(strings.NewReader(rules))
+		require.Error(t, err, rules)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "acl")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("default deny\n"), 0644))
+
+	a, err := acl.Load(filename)
+	require.NoError(t, err)
+	require.Equal(t, acl.Deny, a.Default)
+	require.Empty(t, a.Rules)
+}
@@ -0,0 +1,156 @@
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/akabos/multiproxy/pkg/router"
+)
+
+// Load reads access control list from the file. See Parse for the format.
+func Load(filename string) (*ACL, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return a, nil
+}
+
+// Parse reads access control list. Each line is either a rule or the default action, empty lines and lines starting
+// with `#` are ignored:
+//
+//      # allow local clients to connect to HTTPS ports only
+//      allow client=10.0.0.0/8,192.168.0.0/16 method=CONNECT port=443,8443
+//      deny method=CONNECT
+//      allow client=10.0.0.0/8,192.168.0.0/16
+//      deny host=.internal.example.com
+//      default deny
+//
+// A rule is the action followed by conditions. Condition values are coma-separated. Supported conditions are `client`
+// (IP address or CIDR), `host` (see router.Pattern), `port` (port number or range, e.g. `8000-8999`) and `method`.
+func Parse(r io.Reader) (*ACL, error) {
+	a := &ACL{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "default" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: default expects exactly one action", n)
+			}
+			action, err := ParseAction(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			a.Default = action
+			continue
+		}
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rule.Name = fmt.Sprintf("line %d: %s", n, strings.Join(fields, " "))
+		a.Rules = append(a.Rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseRule(fields []string) (Rule, error) {
+	var (
+		rule Rule
+		err  error
+	)
+	rule.Action, err = ParseAction(fields[0])
+	if err != nil {
+		return rule, err
+	}
+	for _, field := range fields[1:] {
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return rule, fmt.Errorf("invalid condition %q, expected key=value", field)
+		}
+		key, values := field[:i], strings.Split(field[i+1:], ",")
+		for _, value := range values {
+			if value == "" {
+				return rule, fmt.Errorf("empty value in condition %q", field)
+			}
+			switch key {
+			case "client":
+				n, err := parseNet(value)
+				if err != nil {
+					return rule, err
+				}
+				rule.Clients = append(rule.Clients, n)
+			case "host":
+				p, err := router.ParsePattern(value)
+				if err != nil {
+					return rule, err
+				}
+				rule.Hosts = append(rule.Hosts, p)
+			case "port":
+				p, err := parsePortRange(value)
+				if err != nil {
+					return rule, err
+				}
+				rule.Ports = append(rule.Ports, p)
+			case "method":
+				rule.Methods = append(rule.Methods, strings.ToUpper(value))
+			default:
+				return rule, fmt.Errorf("unknown condition %q", key)
+			}
+		}
+	}
+	return rule, nil
+}
+
+// parseNet parses CIDR or a single IP address.
+func parseNet(s string) (*net.IPNet, error) {
+	if strings.IndexByte(s, '/') >= 0 {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parsePortRange parses port number or range of ports.
+func parsePortRange(s string) (PortRange, error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	var (
+		p   PortRange
+		err error
+	)
+	p.From, err = strconv.Atoi(from)
+	if err == nil {
+		p.To, err = strconv.Atoi(to)
+	}
+	if err != nil || p.From < 0 || p.To > 65535 || p.From > p.To {
+		return p, fmt.Errorf("invalid port range %q", s)
+	}
+	return p, nil
+}
@@ -0,0 +1,141 @@
+// Package auth implements proxy authentication middleware (RFC 7235).
+//
+// Clients are challenged with `407 Proxy Authentication Required` and authenticate with `Proxy-Authorization` header
+// using Basic (RFC 7617) or, optionally, Digest (RFC 7616) scheme. Authenticated user is recorded in the request context
+// and in the log context, so access log entries show who made the request.
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+// DefaultRealm is the default protection space reported to clients.
+const DefaultRealm = "multiproxy"
+
+// DefaultNonceTTL is the default lifetime of Digest nonces.
+const DefaultNonceTTL = 5 * time.Minute
+
+// Auth is proxy authentication middleware.
+//
+// The zero value of Auth is a valid instance which refuses everyone.
+type Auth struct {
+	// Authenticator verifies user credentials. If Authenticator is nil, all the credentials are rejected.
+	Authenticator Authenticator
+
+	// Realm specifies protection space reported to clients. If Realm is empty, DefaultRealm is used.
+	Realm string
+
+	// Digest enables Digest authentication scheme in addition to Basic. It's only effective if Authenticator
+	// implements DigestAuthenticator.
+	Digest bool
+
+	// NonceTTL specifies lifetime of Digest nonces. If NonceTTL is zero, DefaultNonceTTL is used.
+	NonceTTL time.Duration
+
+	once   sync.Once
+	digest DigestAuthenticator
+	nonces nonceSource
+}
+
+func (a *Auth) init() {
+	if a.Authenticator == nil {
+		a.Authenticator = AuthenticatorFunc(func(string, string) bool { return false })
+	}
+	if a.Realm == "" {
+		a.Realm = DefaultRealm
+	}
+	if a.NonceTTL == 0 {
+		a.NonceTTL = DefaultNonceTTL
+	}
+	if a.Digest {
+		a.digest, _ = a.Authenticator.(DigestAuthenticator)
+	}
+	a.nonces = newNonceSource(a.NonceTTL)
+}
+
+// Middleware is the middleware constructor.
+//
+// Requests which are already authenticated, e.g. requests intercepted from authenticated CONNECT session, are passed
+// through. Proxy-Authorization header is removed from authenticated requests.
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	a.once.Do(a.init)
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		if user, ok := User(rq); ok {
+			// nested log entries don't inherit fields of the parent one
+			log.With(rq, zap.String("user", user))
+			next.ServeHTTP(rw, rq)
+			return
+		}
+
+		user, stale, ok := a.authenticate(rq)
+		if !ok {
+			a.challenge(rw, rq, stale)
+			return
+		}
+
+		rq.Header.Del("Proxy-Authorization")
+		log.With(rq, zap.String("user", user))
+		next.ServeHTTP(rw, rq.WithContext(context.WithValue(rq.Context(), ctxKey{}, user)))
+	})
+}
+
+// authenticate verifies request credentials. Returns authenticated user name. Stale means the credentials were valid,
+// but Digest nonce has expired.
+func (a *Auth) authenticate(rq *http.Request) (user string, stale bool, ok bool) {
+	h := rq.Header.Get("Proxy-Authorization")
+	i := strings.IndexByte(h, ' ')
+	if i < 0 {
+		return "", false, false
+	}
+	scheme, credentials := h[:i], strings.TrimSpace(h[i+1:])
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		data, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", false, false
+		}
+		j := strings.IndexByte(string(data), ':')
+		if j < 0 {
+			return "", false, false
+		}
+		user, password := string(data[:j]), string(data[j+1:])
+		if !a.Authenticator.Authenticate(user, password) {
+			log.Debug(rq, "authentication failed", zap.String("user", user), zap.String("scheme", "basic"))
+			return "", false, false
+		}
+		return user, false, true
+	case strings.EqualFold(scheme, "Digest") && a.digest != nil:
+		return a.verifyDigest(rq, credentials)
+	default:
+		return "", false, false
+	}
+}
+
+func (a *Auth) challenge(rw http.ResponseWriter, rq *http.Request, stale bool) {
+	rw.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.Realm))
+	if a.digest != nil {
+		rw.Header().Add("Proxy-Authenticate", fmt.Sprintf(
+			"Digest realm=%q, qop=\"auth\", algorithm=MD5, nonce=%q, stale=%t", a.Realm, a.nonces.New(), stale,
+		))
+	}
+	log.WithStatusCode(rq, http.StatusProxyAuthRequired)
+	http.Error(rw, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+}
+
+type ctxKey struct{}
+
+// User returns the name of authenticated user from the request context.
+func User(rq *http.Request) (string, bool) {
+	user, ok := rq.Context().Value(ctxKey{}).(string)
+	return user, ok
+}
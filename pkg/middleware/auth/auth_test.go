@@ -0,0 +1,177 @@
+package auth_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/akabos/multiproxy/pkg/middleware/auth"
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+func testHandler(t *testing.T, a *auth.Auth, access *bytes.Buffer) http.Handler {
+	var b bytes.Buffer
+	return alice.New(log.Middleware(access, &b, zapcore.InfoLevel), a.Middleware).ThenFunc(
+		func(rw http.ResponseWriter, rq *http.Request) {
+			user, ok := auth.User(rq)
+			require.True(t, ok)
+			require.Empty(t, rq.Header.Get("Proxy-Authorization"))
+			_, _ = rw.Write([]byte(user))
+		},
+	)
+}
+
+func TestAuth_Basic(t *testing.T) {
+	var (
+		access bytes.Buffer
+		h      = testHandler(t, &auth.Auth{Authenticator: auth.Static{"user": "secret"}}, &access)
+	)
+
+	t.Run("ok", func(t *testing.T) {
+		rq := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		rq.Header.Set("Proxy-Authorization", "Basic dXNlcjpzZWNyZXQ=")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, rq)
+
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Equal(t, "user", rw.Body.String())
+		require.Contains(t, access.String(), `"user":"user"`)
+	})
+
+	t.Run("challenge", func(t *testing.T) {
+		for _, header := range []string{"", "Basic dXNlcjp3cm9uZw==", "Basic !", "Bearer xxx"} {
+			rq := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+			if header != "" {
+				rq.Header.Set("Proxy-Authorization", header)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, rq)
+
+			require.Equal(t, http.StatusProxyAuthRequired, rw.Code, header)
+			require.Equal(t, []string{`Basic realm="multiproxy", charset="UTF-8"`}, rw.Header()["Proxy-Authenticate"])
+		}
+	})
+
+	t.Run("zero value", func(t *testing.T) {
+		h := testHandler(t, &auth.Auth{}, &access)
+		rq := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		rq.Header.Set("Proxy-Authorization", "Basic dXNlcjpzZWNyZXQ=")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, rq)
+		require.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+	})
+}
+
+func TestAuth_Nested(t *testing.T) {
+	var (
+		access bytes.Buffer
+		a      = &auth.Auth{Authenticator: auth.Static{"user": "secret"}}
+		inner  = testHandler(t, a, &access)
+		outer  = testHandler(t, a, &access)
+	)
+	outer = alice.New(log.Middleware(&access, &bytes.Buffer{}, zapcore.InfoLevel), a.Middleware).ThenFunc(
+		func(rw http.ResponseWriter, rq *http.Request) {
+			// intercepted request inherits the context of CONNECT request, but carries no credentials
+			irq := httptest.NewRequest(http.MethodGet, "https://example.com/", nil).WithContext(rq.Context())
+			inner.ServeHTTP(rw, irq)
+		},
+	)
+
+	rq := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	rq.Header.Set("Proxy-Authorization", "Basic dXNlcjpzZWNyZXQ=")
+	rw := httptest.NewRecorder()
+	outer.ServeHTTP(rw, rq)
+
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, 2, strings.Count(access.String(), `"user":"user"`))
+}
+
+func TestAuth_Digest(t *testing.T) {
+	var (
+		access bytes.Buffer
+		h      = testHandler(t, &auth.Auth{
+			Authenticator: auth.Static{"user": "secret"},
+			Realm:         "test",
+			Digest:        true,
+			NonceTTL:      time.Hour,
+		}, &access)
+	)
+
+	rq := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, rq)
+	require.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+	challenges := rw.Header()["Proxy-Authenticate"]
+	require.Len(t, challenges, 2)
+	require.True(t, strings.HasPrefix(challenges[1], `Digest realm="test", qop="auth", algorithm=MD5, nonce="`))
+	nonce := strings.Split(challenges[1], `nonce="`)[1]
+	nonce = nonce[:strings.IndexByte(nonce, '"')]
+
+	digest := func(password string) string {
+		md5hex := func(s string) string {
+			sum := md5.Sum([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+		ha1 := md5hex("user:test:" + password)
+		ha2 := md5hex("GET:http://example.com/")
+		response := md5hex(ha1 + ":" + nonce + ":00000001:abcdef:auth:" + ha2)
+		return fmt.Sprintf(
+			`Digest username="user", realm="test", nonce="%s", uri="http://example.com/", qop=auth, nc=00000001, cnonce="abcdef", response="%s"`,
+			nonce, response,
+		)
+	}
+
+	rq = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rq.Header.Set("Proxy-Authorization", digest("secret"))
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, rq)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "user", rw.Body.String())
+
+	rq = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rq.Header.Set("Proxy-Authorization", digest("wrong"))
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, rq)
+	require.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+
+	t.Run("stale", func(t *testing.T) {
+		h := testHandler(t, &auth.Auth{
+			Authenticator: auth.Static{"user": "secret"},
+			Realm:         "test",
+			Digest:        true,
+			NonceTTL:      time.Nanosecond,
+		}, &access)
+		rq := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, rq)
+		nonce = strings.Split(rw.Header()["Proxy-Authenticate"][1], `nonce="`)[1]
+		nonce = nonce[:strings.IndexByte(nonce, '"')]
+
+		rq = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		rq.Header.Set("Proxy-Authorization", digest("secret"))
+		rw = httptest.NewRecorder()
+		h.ServeHTTP(rw, rq)
+		require.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+		require.Contains(t, rw.Header()["Proxy-Authenticate"][1], "stale=true")
+	})
+
+	t.Run("not supported by backend", func(t *testing.T) {
+		h := testHandler(t, &auth.Auth{
+			Authenticator: auth.AuthenticatorFunc(func(string, string) bool { return true }),
+			Digest:        true,
+		}, &access)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		require.Len(t, rw.Header()["Proxy-Authenticate"], 1)
+	})
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Authenticator verifies user credentials.
+type Authenticator interface {
+	Authenticate(user, password string) bool
+}
+
+// DigestAuthenticator is an Authenticator able to verify Digest credentials. Since Digest scheme never transfers
+// passwords, the backend must know either plaintext passwords or HA1 hashes.
+type DigestAuthenticator interface {
+	Authenticator
+
+	// HA1 returns hex encoded MD5(user:realm:password) for the user.
+	HA1(user, realm string) (string, bool)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as Authenticator.
+type AuthenticatorFunc func(user, password string) bool
+
+// Authenticate implements Authenticator interface
+func (f AuthenticatorFunc) Authenticate(user, password string) bool {
+	return f(user, password)
+}
+
+// Static is the map of user names to plaintext passwords.
+type Static map[string]string
+
+// Authenticate implements Authenticator interface
+func (s Static) Authenticate(user, password string) bool {
+	expected, ok := s[user]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// HA1 implements DigestAuthenticator interface
+func (s Static) HA1(user, realm string) (string, bool) {
+	password, ok := s[user]
+	if !ok {
+		return "", false
+	}
+	return md5hex(user + ":" + realm + ":" + password), true
+}
+
+// ErrUnsupportedHash is returned for htpasswd entries hashed with unsupported algorithm.
+var ErrUnsupportedHash = errors.New("unsupported password hash")
+
+// Htpasswd is Authenticator backed by Apache htpasswd file. Supported hashes are MD5 (`$apr1$`, the default of
+// htpasswd utility), SHA1 (`{SHA}`) and plaintext marked with `{PLAIN}` prefix. Bcrypt and crypt(3) hashes are not
+// supported.
+type Htpasswd map[string]string
+
+// LoadHtpasswd reads htpasswd file.
+func LoadHtpasswd(filename string) (Htpasswd, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err := ParseHtpasswd(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return h, nil
+}
+
+// ParseHtpasswd parses htpasswd file contents.
+func ParseHtpasswd(r io.Reader) (Htpasswd, error) {
+	h := make(Htpasswd)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: malformed entry", n)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, apr1Magic) && !strings.HasPrefix(hash, shaPrefix) && !strings.HasPrefix(hash, plainPrefix) {
+			// unmarked entries are most likely crypt(3) hashes, which would be accepted as passwords if taken as plaintext
+			return nil, fmt.Errorf("line %d: %w", n, ErrUnsupportedHash)
+		}
+		h[user] = hash
+	}
+	return h, s.Err()
+}
+
+// Authenticate implements Authenticator interface
+func (h Htpasswd) Authenticate(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		return false
+	}
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := strings.TrimPrefix(hash, apr1Magic)
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1(password, salt)
+	case strings.HasPrefix(hash, shaPrefix):
+		sum := sha1.Sum([]byte(password))
+		computed = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, plainPrefix):
+		computed = plainPrefix + password
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(computed)) == 1
+}
+
+const (
+	shaPrefix   = "{SHA}"
+	plainPrefix = "{PLAIN}"
+
+	apr1Magic = "$apr1$"
+	apr1Alpha = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// apr1 computes Apache variant of MD5-based crypt(3).
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	h := md5.New()
+	_, _ = io.WriteString(h, password+apr1Magic+salt)
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(password); i > 0; i -= 16 {
+		_, _ = h.Write(alt[:min(i, 16)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			_, _ = h.Write([]byte{0})
+		} else {
+			_, _ = h.Write([]byte{password[0]})
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			_, _ = io.WriteString(h, password)
+		} else {
+			_, _ = h.Write(sum)
+		}
+		if i%3 != 0 {
+			_, _ = io.WriteString(h, salt)
+		}
+		if i%7 != 0 {
+			_, _ = io.WriteString(h, password)
+		}
+		if i&1 != 0 {
+			_, _ = h.Write(sum)
+		} else {
+			_, _ = io.WriteString(h, password)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(apr1Magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			_ = b.WriteByte(apr1Alpha[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[g[0]])<<16|uint(sum[g[1]])<<8|uint(sum[g[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return b.String()
+}
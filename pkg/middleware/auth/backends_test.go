@@ -0,0 +1,66 @@
+package auth_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/middleware/auth"
+)
+
+func TestHtpasswd(t *testing.T) {
+	// hashes generated with `openssl passwd -apr1` and `htpasswd -s`
+	h, err := auth.ParseHtpasswd(strings.NewReader(`
+# comment
+md5:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0
+long:$apr1$Xy1$if1OK/B4ihHeZvKSd0RbM1
+sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+plain:{PLAIN}secret
+`))
+	require.NoError(t, err)
+
+	require.True(t, h.Authenticate("md5", "secret"))
+	require.False(t, h.Authenticate("md5", "wrong"))
+	require.True(t, h.Authenticate("long", "a much longer password than sixteen"))
+	require.True(t, h.Authenticate("sha", "secret"))
+	require.False(t, h.Authenticate("sha", "wrong"))
+	require.True(t, h.Authenticate("plain", "secret"))
+	require.False(t, h.Authenticate("nobody", "secret"))
+
+	_, err = auth.ParseHtpasswd(strings.NewReader("user:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC\n"))
+	require.True(t, errors.Is(err, auth.ErrUnsupportedHash))
+
+	// crypt(3) DES hash generated with `htpasswd -d`, must not be taken for a plaintext password
+	_, err = auth.ParseHtpasswd(strings.NewReader("user:rqXexS6ZhobKA\n"))
+	require.True(t, errors.Is(err, auth.ErrUnsupportedHash))
+
+	_, err = auth.ParseHtpasswd(strings.NewReader("garbage\n"))
+	require.Error(t, err)
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("user:{PLAIN}secret\n"), 0600))
+
+	h, err := auth.LoadHtpasswd(filename)
+	require.NoError(t, err)
+	require.True(t, h.Authenticate("user", "secret"))
+
+	_, err = auth.LoadHtpasswd(filename + ".missing")
+	require.Error(t, err)
+}
+
+func TestStatic(t *testing.T) {
+	s := auth.Static{"user": "secret"}
+	require.True(t, s.Authenticate("user", "secret"))
+	require.False(t, s.Authenticate("user", "wrong"))
+	require.False(t, s.Authenticate("nobody", ""))
+
+	ha1, ok := s.HA1("user", "realm")
+	require.True(t, ok)
+	require.Equal(t, "fb6cb9e166c6c764ff2bdea12175a8aa", ha1)
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+// verifyDigest verifies Digest credentials. Only MD5 algorithm and `auth` quality of protection are supported.
+//
+// Nonces are stateless, so nonce counts are not tracked and a captured request could be replayed until its nonce
+// expires.
+func (a *Auth) verifyDigest(rq *http.Request, credentials string) (user string, stale bool, ok bool) {
+	params := parseParams(credentials)
+	user = params["username"]
+	if params["realm"] != a.Realm || params["uri"] != rq.RequestURI {
+		return "", false, false
+	}
+	if alg := params["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return "", false, false
+	}
+	ha1, ok := a.digest.HA1(user, a.Realm)
+	if !ok {
+		return "", false, false
+	}
+	ha2 := md5hex(rq.Method + ":" + params["uri"])
+	var expected string
+	switch params["qop"] {
+	case "":
+		expected = md5hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	case "auth":
+		expected = md5hex(ha1 + ":" + params["nonce"] + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	default:
+		return "", false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		log.Debug(rq, "authentication failed", zap.String("user", user), zap.String("scheme", "digest"))
+		return "", false, false
+	}
+	valid, expired := a.nonces.Verify(params["nonce"])
+	if !valid || expired {
+		return "", expired, false
+	}
+	return user, false, true
+}
+
+// parseParams parses comma-separated list of auth-params, values may be quoted.
+func parseParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " \t,")
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				_ = value.WriteByte(s[j])
+			}
+			s = s[min(j+1, len(s)):]
+		} else {
+			j := strings.IndexByte(s, ',')
+			if j < 0 {
+				j = len(s)
+			}
+			value.WriteString(strings.TrimSpace(s[:j]))
+			s = s[j:]
+		}
+		params[key] = value.String()
+	}
+	return params
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// nonceSource issues and verifies stateless nonces. A nonce is the issue time signed with a random key, so nonces don't
+// survive restarts.
+type nonceSource struct {
+	key []byte
+	ttl time.Duration
+}
+
+func newNonceSource(ttl time.Duration) nonceSource {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return nonceSource{key: key, ttl: ttl}
+}
+
+// New issues a new nonce.
+func (n nonceSource) New() string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(time.Now().UnixNano()))
+	return base64.RawURLEncoding.EncodeToString(append(b[:], n.sign(b[:])...))
+}
+
+// Verify checks the nonce was issued by the source and whether it has expired.
+func (n nonceSource) Verify(nonce string) (valid bool, expired bool) {
+	data, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(data) <= 8 || !hmac.Equal(data[8:], n.sign(data[:8])) {
+		return false, false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(data[:8])))
+	return true, time.Since(issued) > n.ttl
+}
+
+func (n nonceSource) sign(b []byte) []byte {
+	m := hmac.New(sha256.New, n.key)
+	_, _ = m.Write(b)
+	return m.Sum(nil)[:16]
+}
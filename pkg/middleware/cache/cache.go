@@ -0,0 +1,275 @@
+// Package cache implements shared HTTP cache middleware as defined in RFC 9111.
+//
+// The middleware is supposed to be the last one in front of HTTPHandler, so the requests served from cache still pass
+// access control and authentication. It works the same way for plain HTTP requests and for requests decrypted by
+// MITMHandler, as long as the request URL is absolute.
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+// Cache is a caching middleware. It stores responses to GET requests and serves GET and HEAD requests from storage while
+// the responses are fresh. Stale responses are revalidated with conditional requests if they have validators (ETag or
+// Last-Modified). Successful responses to unsafe requests invalidate the stored response for the request URL.
+//
+// Responses with Vary header are stored per variant. The entry under the request URL then only lists the request
+// header fields which select the variant, and each variant is stored under the key including values of these fields.
+//
+// Each request served by the middleware is logged with `cache` field: HIT if served from storage, REVALIDATED if
+// served from storage after successful validation, MISS if forwarded to the target server.
+//
+// Zero value is a valid instance which keeps responses in memory.
+type Cache struct {
+	// Storage specifies where responses are stored.
+	//
+	// If nil, Memory with default size is used.
+	Storage Storage
+
+	// MaxObjectSize defines the maximum size of the response body to store. Larger responses are passed through.
+	//
+	// If 0, DefaultMaxObjectSize is used.
+	MaxObjectSize int64
+
+	once sync.Once
+}
+
+// DefaultMaxObjectSize defines default maximum size of stored response body.
+const DefaultMaxObjectSize = 8 << 20
+
+const (
+	statusHit         = "HIT"
+	statusMiss        = "MISS"
+	statusRevalidated = "REVALIDATED"
+)
+
+func (c *Cache) init() {
+	if c.Storage == nil {
+		c.Storage = &Memory{}
+	}
+	if c.MaxObjectSize == 0 {
+		c.MaxObjectSize = DefaultMaxObjectSize
+	}
+}
+
+// Middleware is the caching middleware constructor.
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		c.once.Do(c.init)
+		switch {
+		case rq.Method != http.MethodGet && rq.Method != http.MethodHead:
+			c.invalidate(rw, rq, next)
+		case rq.Header.Get("Upgrade") != "" || rq.Header.Get("Range") != "":
+			// neither upgrades nor partial content are cached
+			log.With(rq, zap.String("cache", statusMiss))
+			next.ServeHTTP(rw, rq)
+		default:
+			c.serve(rw, rq, next)
+		}
+	})
+}
+
+func (c *Cache) serve(rw http.ResponseWriter, rq *http.Request, next http.Handler) {
+	var (
+		key = cacheKey(rq)
+		e   = c.lookup(key, rq)
+		now = time.Now()
+	)
+	if e != nil {
+		age := currentAge(e, now)
+		if fresh(rq, e, age) {
+			c.respond(rw, rq, e, age, statusHit)
+			return
+		}
+	}
+	if parseDirectives(rq.Header).has("only-if-cached") {
+		log.With(rq, zap.String("cache", statusMiss))
+		log.WithStatusCode(rq, http.StatusGatewayTimeout)
+		http.Error(rw, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		return
+	}
+	if e != nil && (e.Header.Get("Etag") != "" || e.Header.Get("Last-Modified") != "") {
+		c.revalidate(rw, rq, next, key, e)
+		return
+	}
+	c.fetch(rw, rq, next, key)
+}
+
+// fetch forwards the request and stores the response if possible.
+func (c *Cache) fetch(rw http.ResponseWriter, rq *http.Request, next http.Handler, key string) {
+	log.With(rq, zap.String("cache", statusMiss))
+	w := newRecorder(rw, c.MaxObjectSize)
+	sent := time.Now()
+	next.ServeHTTP(w, rq)
+	c.store(rq, key, w, sent)
+}
+
+// revalidate forwards the request made conditional with the validators of the stored response. If the target server
+// responds with 304, the stored response is updated and served, otherwise the new response is passed through.
+func (c *Cache) revalidate(rw http.ResponseWriter, rq *http.Request, next http.Handler, key string, e *Entry) {
+	crq := rq.Clone(rq.Context())
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		crq.Header.Del(h)
+	}
+	if etag := e.Header.Get("Etag"); etag != "" {
+		crq.Header.Set("If-None-Match", etag)
+	}
+	if lm := e.Header.Get("Last-Modified"); lm != "" {
+		crq.Header.Set("If-Modified-Since", lm)
+	}
+
+	w := newRecorder(rw, c.MaxObjectSize)
+	w.holdNotModified = true
+	sent := time.Now()
+	next.ServeHTTP(w, crq)
+	if !w.held {
+		log.With(rq, zap.String("cache", statusMiss))
+		c.store(rq, key, w, sent)
+		return
+	}
+
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for k, vv := range w.header {
+		switch k {
+		case "Content-Length", "Transfer-Encoding", "Content-Encoding", "Content-Range":
+			// RFC 9111 section 3.2 keeps these from the stored response
+			continue
+		}
+		updated.Header[k] = vv
+	}
+	updated.RequestTime, updated.ResponseTime = sent, time.Now()
+	if err := c.add(key, rq, &updated); err != nil {
+		log.Warn(rq, "failed to update cached response", zap.Error(err))
+	}
+	c.respond(rw, rq, &updated, currentAge(&updated, time.Now()), statusRevalidated)
+}
+
+// store adds the recorded response to storage if it's complete and storable.
+func (c *Cache) store(rq *http.Request, key string, w *recorder, sent time.Time) {
+	if !w.complete() || !storable(rq, w.status, w.header) || rq.Context().Err() != nil {
+		return
+	}
+	e := &Entry{
+		StatusCode:   w.status,
+		Header:       w.header,
+		Body:         w.body.Bytes(),
+		RequestTime:  sent,
+		ResponseTime: time.Now(),
+	}
+	if err := c.add(key, rq, e); err != nil {
+		log.Warn(rq, "failed to store response", zap.Error(err))
+	}
+}
+
+// add stores the entry, taking care of variants.
+func (c *Cache) add(key string, rq *http.Request, e *Entry) error {
+	names := varyNames(e.Header)
+	if len(names) == 0 {
+		return c.Storage.Add(key, e)
+	}
+	e.RequestHeader = http.Header{}
+	for _, name := range names {
+		if vv := rq.Header.Values(name); len(vv) > 0 {
+			e.RequestHeader[name] = vv
+		}
+	}
+	err := c.Storage.Add(key, &Entry{Vary: names})
+	if err != nil {
+		return err
+	}
+	return c.Storage.Add(variantKey(key, names, rq.Header), e)
+}
+
+// lookup returns stored response matching the request, or nil.
+func (c *Cache) lookup(key string, rq *http.Request) *Entry {
+	e, err := c.Storage.Get(key)
+	if err != nil {
+		if err != ErrMiss {
+			log.Warn(rq, "failed to get cached response", zap.Error(err))
+		}
+		return nil
+	}
+	if len(e.Vary) == 0 {
+		return e
+	}
+	e, err = c.Storage.Get(variantKey(key, e.Vary, rq.Header))
+	if err != nil {
+		return nil
+	}
+	// the variant key is ambiguous in theory, compare the values to be sure
+	if variantKey("", varyNames(e.Header), e.RequestHeader) != variantKey("", varyNames(e.Header), rq.Header) {
+		return nil
+	}
+	return e
+}
+
+// respond writes the stored response.
+func (c *Cache) respond(rw http.ResponseWriter, rq *http.Request, e *Entry, age time.Duration, status string) {
+	log.With(rq, zap.String("cache", status))
+	copyHeader(rw.Header(), e.Header)
+	rw.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if notModified(rq, e) {
+		log.WithStatusCode(rq, http.StatusNotModified)
+		log.WithContentLength(rq, 0)
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	log.WithStatusCode(rq, e.StatusCode)
+	log.WithContentLength(rq, len(e.Body))
+	rw.WriteHeader(e.StatusCode)
+	if rq.Method != http.MethodHead {
+		_, _ = rw.Write(e.Body)
+	}
+}
+
+// invalidate forwards unsafe request and removes the stored response for the request URL if the request succeeds, see
+// RFC 9111 section 4.4.
+func (c *Cache) invalidate(rw http.ResponseWriter, rq *http.Request, next http.Handler) {
+	switch rq.Method {
+	case http.MethodOptions, http.MethodTrace, http.MethodConnect:
+		next.ServeHTTP(rw, rq)
+		return
+	}
+	w := newRecorder(rw, 0)
+	next.ServeHTTP(w, rq)
+	if w.status >= 200 && w.status < 400 {
+		if err := c.Storage.Remove(cacheKey(rq)); err != nil {
+			log.Warn(rq, "failed to invalidate cached response", zap.Error(err))
+		}
+	}
+}
+
+// cacheKey returns the primary cache key for the request. Responses are only stored for GET, so it's just the URL.
+func cacheKey(rq *http.Request) string {
+	u := *rq.URL
+	u.Fragment = ""
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// variantKey returns the secondary cache key for the variant selected by the header.
+func variantKey(key string, names []string, h http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range names {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString(":")
+		for i, v := range h.Values(name) {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(strings.Join(strings.Fields(v), " "))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,319 @@
+package cache_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/middleware/cache"
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+// origin counts requests and responds with the body and header fields set by the test.
+type origin struct {
+	hits    int32
+	header  http.Header
+	status  int
+	handler func(rw http.ResponseWriter, rq *http.Request) bool
+}
+
+func (o *origin) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	n := atomic.AddInt32(&o.hits, 1)
+	if o.handler != nil && o.handler(rw, rq) {
+		return
+	}
+	for k, vv := range o.header {
+		rw.Header()[k] = vv
+	}
+	rw.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	status := o.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	rw.WriteHeader(status)
+	_, _ = fmt.Fprintf(rw, "response %d", n)
+}
+
+type testProxy struct {
+	handler http.Handler
+	access  *bytes.Buffer
+}
+
+func newTestProxy(c *cache.Cache, next http.Handler) *testProxy {
+	p := &testProxy{access: &bytes.Buffer{}}
+	p.handler = alice.New(log.Middleware(p.access, ioutil.Discard, zapcore.InfoLevel), c.Middleware).Then(next)
+	return p
+}
+
+// do sends the request and returns the response along with the cache status logged.
+func (p *testProxy) do(method, target string, header http.Header) (*httptest.ResponseRecorder, string) {
+	rq := httptest.NewRequest(method, target, nil)
+	for k, vv := range header {
+		rq.Header[k] = vv
+	}
+	p.access.Reset()
+	rw := httptest.NewRecorder()
+	p.handler.ServeHTTP(rw, rq)
+	for _, status := range []string{"HIT", "MISS", "REVALIDATED"} {
+		if strings.Contains(p.access.String(), `"cache":"`+status+`"`) {
+			return rw, status
+		}
+	}
+	return rw, ""
+}
+
+func TestCache_Freshness(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	p := newTestProxy(&cache.Cache{}, o)
+
+	rw, status := p.do(http.MethodGet, "http://example.com/a", nil)
+	require.Equal(t, "MISS", status)
+	require.Equal(t, "response 1", rw.Body.String())
+
+	rw, status = p.do(http.MethodGet, "http://EXAMPLE.com/a", nil)
+	require.Equal(t, "HIT", status)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "response 1", rw.Body.String())
+	require.Equal(t, "0", rw.Header().Get("Age"))
+	require.Contains(t, p.access.String(), `"status":200`)
+	require.Contains(t, p.access.String(), `"content-length":10`)
+
+	rw, status = p.do(http.MethodHead, "http://example.com/a", nil)
+	require.Equal(t, "HIT", status)
+	require.Empty(t, rw.Body.String())
+
+	_, status = p.do(http.MethodGet, "http://example.com/a", http.Header{"Cache-Control": {"no-cache"}})
+	require.Equal(t, "MISS", status)
+	_, status = p.do(http.MethodGet, "http://example.com/b", nil)
+	require.Equal(t, "MISS", status)
+	require.EqualValues(t, 3, o.hits)
+
+	t.Run("age", func(t *testing.T) {
+		o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"59"}}}
+		p := newTestProxy(&cache.Cache{}, o)
+		_, status := p.do(http.MethodGet, "http://example.com/", nil)
+		require.Equal(t, "MISS", status)
+		rw, status := p.do(http.MethodGet, "http://example.com/", nil)
+		require.Equal(t, "HIT", status)
+		require.Equal(t, "59", rw.Header().Get("Age"))
+		_, status = p.do(http.MethodGet, "http://example.com/", http.Header{"Cache-Control": {"min-fresh=10"}})
+		require.Equal(t, "MISS", status)
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		o := &origin{header: http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}}
+		p := newTestProxy(&cache.Cache{}, o)
+		_, _ = p.do(http.MethodGet, "http://example.com/", nil)
+		_, status := p.do(http.MethodGet, "http://example.com/", nil)
+		require.Equal(t, "HIT", status)
+	})
+
+	t.Run("heuristic", func(t *testing.T) {
+		o := &origin{header: http.Header{
+			"Last-Modified": {time.Now().Add(-100 * time.Hour).UTC().Format(http.TimeFormat)},
+		}}
+		p := newTestProxy(&cache.Cache{}, o)
+		_, _ = p.do(http.MethodGet, "http://example.com/", nil)
+		_, status := p.do(http.MethodGet, "http://example.com/", nil)
+		require.Equal(t, "HIT", status)
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		o := &origin{header: http.Header{"Cache-Control": {"max-age=0"}}}
+		p := newTestProxy(&cache.Cache{}, o)
+		_, _ = p.do(http.MethodGet, "http://example.com/", nil)
+		_, status := p.do(http.MethodGet, "http://example.com/", nil)
+		require.Equal(t, "MISS", status)
+		_, status = p.do(http.MethodGet, "http://example.com/", http.Header{"Cache-Control": {"max-stale"}})
+		require.Equal(t, "HIT", status)
+	})
+}
+
+func TestCache_NotStored(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		status int
+		rq     http.Header
+	}{
+		{"no-store", http.Header{"Cache-Control": {"max-age=60, no-store"}}, 0, nil},
+		{"request no-store", http.Header{"Cache-Control": {"max-age=60"}}, 0, http.Header{"Cache-Control": {"no-store"}}},
+		{"private", http.Header{"Cache-Control": {`private="Set-Cookie", max-age=60`}}, 0, nil},
+		{"authorization", http.Header{"Cache-Control": {"max-age=60"}}, 0, http.Header{"Authorization": {"Bearer x"}}},
+		{"vary any", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, 0, nil},
+		{"no freshness", http.Header{}, 0, nil},
+		{"status", http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, http.StatusInternalServerError, nil},
+		{"partial", http.Header{"Cache-Control": {"max-age=60"}}, http.StatusPartialContent, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProxy(&cache.Cache{}, &origin{header: tc.header, status: tc.status})
+			_, status := p.do(http.MethodGet, "http://example.com/", tc.rq)
+			require.Equal(t, "MISS", status)
+			_, status = p.do(http.MethodGet, "http://example.com/", tc.rq)
+			require.Equal(t, "MISS", status)
+		})
+	}
+
+	t.Run("authorization public", func(t *testing.T) {
+		p := newTestProxy(&cache.Cache{}, &origin{header: http.Header{"Cache-Control": {"public, max-age=60"}}})
+		_, _ = p.do(http.MethodGet, "http://example.com/", http.Header{"Authorization": {"Bearer x"}})
+		_, status := p.do(http.MethodGet, "http://example.com/", http.Header{"Authorization": {"Bearer x"}})
+		require.Equal(t, "HIT", status)
+	})
+
+	t.Run("max object size", func(t *testing.T) {
+		p := newTestProxy(&cache.Cache{MaxObjectSize: 5}, &origin{header: http.Header{"Cache-Control": {"max-age=60"}}})
+		rw, _ := p.do(http.MethodGet, "http://example.com/", nil)
+		require.Equal(t, "response 1", rw.Body.String())
+		_, status := p.do(http.MethodGet, "http://example.com/", nil)
+		require.Equal(t, "MISS", status)
+	})
+
+	t.Run("only-if-cached", func(t *testing.T) {
+		o := &origin{}
+		p := newTestProxy(&cache.Cache{}, o)
+		rw, status := p.do(http.MethodGet, "http://example.com/", http.Header{"Cache-Control": {"only-if-cached"}})
+		require.Equal(t, "MISS", status)
+		require.Equal(t, http.StatusGatewayTimeout, rw.Code)
+		require.EqualValues(t, 0, o.hits)
+	})
+}
+
+func TestCache_Revalidate(t *testing.T) {
+	var (
+		conditional int32
+		o           = &origin{header: http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}, "X-Version": {"1"}}}
+	)
+	o.handler = func(rw http.ResponseWriter, rq *http.Request) bool {
+		if rq.Header.Get("If-None-Match") != o.header.Get("Etag") {
+			return false
+		}
+		atomic.AddInt32(&conditional, 1)
+		rw.Header().Set("X-Version", "2")
+		rw.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	p := newTestProxy(&cache.Cache{}, o)
+
+	_, status := p.do(http.MethodGet, "http://example.com/", nil)
+	require.Equal(t, "MISS", status)
+
+	rw, status := p.do(http.MethodGet, "http://example.com/", nil)
+	require.Equal(t, "REVALIDATED", status)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "response 1", rw.Body.String())
+	require.Equal(t, "2", rw.Header().Get("X-Version"))
+	require.Contains(t, p.access.String(), `"status":200`)
+	require.NotContains(t, p.access.String(), `"status":304`)
+	require.EqualValues(t, 1, conditional)
+
+	// client's own validators are answered by the proxy
+	rw, status = p.do(http.MethodGet, "http://example.com/", http.Header{"If-None-Match": {`W/"v1"`}})
+	require.Equal(t, "REVALIDATED", status)
+	require.Equal(t, http.StatusNotModified, rw.Code)
+	require.Empty(t, rw.Body.String())
+
+	// changed resource replaces stored response
+	o.header.Set("Etag", `"v2"`)
+	rw, status = p.do(http.MethodGet, "http://example.com/", nil)
+	require.Equal(t, "MISS", status)
+	require.Equal(t, "response 4", rw.Body.String())
+	_, status = p.do(http.MethodGet, "http://example.com/", nil)
+	require.Equal(t, "REVALIDATED", status)
+	require.EqualValues(t, 3, conditional)
+
+	t.Run("last-modified", func(t *testing.T) {
+		lm := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		o := &origin{
+			header: http.Header{"Cache-Control": {"max-age=0"}, "Last-Modified": {lm}},
+			handler: func(rw http.ResponseWriter, rq *http.Request) bool {
+				if rq.Header.Get("If-Modified-Since") != lm {
+					return false
+				}
+				rw.WriteHeader(http.StatusNotModified)
+				return true
+			},
+		}
+		p := newTestProxy(&cache.Cache{}, o)
+		_, _ = p.do(http.MethodGet, "http://example.com/", nil)
+		rw, status := p.do(http.MethodGet, "http://example.com/", http.Header{"If-Modified-Since": {lm}})
+		require.Equal(t, "REVALIDATED", status)
+		require.Equal(t, http.StatusNotModified, rw.Code)
+	})
+}
+
+func TestCache_Vary(t *testing.T) {
+	o := &origin{
+		header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding, Accept-Language"}},
+	}
+	p := newTestProxy(&cache.Cache{}, o)
+
+	gzip := http.Header{"Accept-Encoding": {"gzip"}}
+	rw, status := p.do(http.MethodGet, "http://example.com/", gzip)
+	require.Equal(t, "MISS", status)
+	require.Equal(t, "response 1", rw.Body.String())
+	rw, status = p.do(http.MethodGet, "http://example.com/", nil)
+	require.Equal(t, "MISS", status)
+	require.Equal(t, "response 2", rw.Body.String())
+
+	rw, status = p.do(http.MethodGet, "http://example.com/", gzip)
+	require.Equal(t, "HIT", status)
+	require.Equal(t, "response 1", rw.Body.String())
+	rw, status = p.do(http.MethodGet, "http://example.com/", nil)
+	require.Equal(t, "HIT", status)
+	require.Equal(t, "response 2", rw.Body.String())
+	_, status = p.do(http.MethodGet, "http://example.com/", http.Header{"Accept-Encoding": {"gzip"}, "Accept-Language": {"en"}})
+	require.Equal(t, "MISS", status)
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	p := newTestProxy(&cache.Cache{}, o)
+
+	_, _ = p.do(http.MethodGet, "http://example.com/", nil)
+	_, status := p.do(http.MethodGet, "http://example.com/", nil)
+	require.Equal(t, "HIT", status)
+
+	rw, status := p.do(http.MethodPost, "http://example.com/", nil)
+	require.Equal(t, "", status)
+	require.Equal(t, "response 2", rw.Body.String())
+
+	_, status = p.do(http.MethodGet, "http://example.com/", nil)
+	require.Equal(t, "MISS", status)
+}
+
+func TestCache_HTTPHandler(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		rw.Header().Set("Cache-Control", "max-age=0")
+		rw.Header().Set("Etag", `"artifact"`)
+		if rq.Header.Get("If-None-Match") == `"artifact"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = rw.Write(bytes.Repeat([]byte("a"), 1000))
+	}))
+	defer server.Close()
+
+	p := newTestProxy(&cache.Cache{Storage: &cache.Dir{Path: t.TempDir()}}, &handlers.HTTPHandler{})
+	for i, expected := range []string{"MISS", "REVALIDATED", "REVALIDATED"} {
+		rw, status := p.do(http.MethodGet, server.URL+"/artifact.tar", nil)
+		require.Equal(t, expected, status, i)
+		require.Equal(t, http.StatusOK, rw.Code, i)
+		require.Len(t, rw.Body.Bytes(), 1000, i)
+		require.Contains(t, p.access.String(), `"content-length":1000`, i)
+	}
+	require.EqualValues(t, 3, hits)
+}
@@ -0,0 +1,261 @@
+package cache
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directives is a parsed Cache-Control header. Directive names are lowercase, values are unquoted.
+type directives map[string]string
+
+// parseDirectives parses Cache-Control header. Pragma: no-cache is honored if there's no Cache-Control.
+func parseDirectives(h http.Header) directives {
+	d := directives{}
+	values := h.Values("Cache-Control")
+	if len(values) == 0 {
+		for _, v := range h.Values("Pragma") {
+			if strings.EqualFold(strings.TrimSpace(v), "no-cache") {
+				d["no-cache"] = ""
+			}
+		}
+		return d
+	}
+	for _, v := range values {
+		for _, item := range splitQuoted(v) {
+			name, value := item, ""
+			if i := strings.IndexByte(item, '='); i >= 0 {
+				name, value = item[:i], strings.Trim(strings.TrimSpace(item[i+1:]), `"`)
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, ok := d[name]; !ok {
+				d[name] = value
+			}
+		}
+	}
+	return d
+}
+
+// splitQuoted splits the list by comas, except for comas in quoted strings.
+func splitQuoted(s string) []string {
+	var (
+		items  []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				items = append(items, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, s[start:])
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns value of delta-seconds directive. Invalid values are treated as zero.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	if n > maxDeltaSeconds {
+		n = maxDeltaSeconds
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// maxDeltaSeconds is the greatest delta-seconds value, greater ones are capped as recommended by RFC 9111 section 1.2.2
+const maxDeltaSeconds = 1<<31 - 1
+
+// heuristicStatus is the set of status codes cacheable by default, see RFC 9110 section 15.1
+var heuristicStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// maxHeuristicLifetime caps freshness lifetime calculated from Last-Modified.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// storable reports whether the response to the request may be stored by a shared cache, see RFC 9111 section 3.
+func storable(rq *http.Request, status int, header http.Header) bool {
+	if rq.Method != http.MethodGet || status == http.StatusPartialContent || status < 200 ||
+		status == http.StatusNotModified {
+		return false
+	}
+	var (
+		rqcc = parseDirectives(rq.Header)
+		rscc = parseDirectives(header)
+	)
+	if rqcc.has("no-store") || rscc.has("no-store") || rscc.has("private") {
+		return false
+	}
+	if rq.Header.Get("Authorization") != "" &&
+		!rscc.has("public") && !rscc.has("must-revalidate") && !rscc.has("s-maxage") {
+		return false
+	}
+	for _, name := range varyNames(header) {
+		if name == "*" {
+			return false
+		}
+	}
+	return rscc.has("public") || rscc.has("max-age") || rscc.has("s-maxage") || header.Get("Expires") != "" ||
+		heuristicStatus[status]
+}
+
+// freshnessLifetime calculates freshness lifetime of the stored response, see RFC 9111 section 4.2.1.
+func freshnessLifetime(e *Entry) time.Duration {
+	cc := parseDirectives(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date := responseDate(e)
+	if v := e.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil || expires.Before(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if !heuristicStatus[e.StatusCode] && !cc.has("public") {
+		return 0
+	}
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && lm.Before(date) {
+		d := date.Sub(lm) / 10
+		if d > maxHeuristicLifetime {
+			d = maxHeuristicLifetime
+		}
+		return d
+	}
+	return 0
+}
+
+// currentAge calculates age of the stored response, see RFC 9111 section 4.2.3.
+func currentAge(e *Entry, now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(responseDate(e))
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(strings.TrimSpace(e.Header.Get("Age")), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	correctedAgeValue := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	initialAge := apparentAge
+	if correctedAgeValue > initialAge {
+		initialAge = correctedAgeValue
+	}
+	return initialAge + now.Sub(e.ResponseTime)
+}
+
+// responseDate returns the value of Date header, or the time the response was received if Date is missing or invalid.
+func responseDate(e *Entry) time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// fresh reports whether the stored response may be served without validation, see RFC 9111 sections 4.2 and 5.2.
+func fresh(rq *http.Request, e *Entry, age time.Duration) bool {
+	var (
+		rqcc     = parseDirectives(rq.Header)
+		rscc     = parseDirectives(e.Header)
+		lifetime = freshnessLifetime(e)
+	)
+	if rqcc.has("no-cache") || rscc.has("no-cache") {
+		return false
+	}
+	if maxAge, ok := rqcc.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := rqcc.seconds("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+	if rscc.has("must-revalidate") || rscc.has("proxy-revalidate") || rscc.has("s-maxage") {
+		return false
+	}
+	if v, ok := rqcc["max-stale"]; ok {
+		if v == "" {
+			return true
+		}
+		maxStale, _ := rqcc.seconds("max-stale")
+		return age-lifetime <= maxStale
+	}
+	return false
+}
+
+// varyNames returns canonical names of header fields listed in Vary header, sorted.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// notModified reports whether the client's conditional request is satisfied by the stored response, so 304 could be
+// sent instead of it. See RFC 9110 section 13.2.2.
+func notModified(rq *http.Request, e *Entry) bool {
+	if e.StatusCode != http.StatusOK {
+		return false
+	}
+	if inm := rq.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(rq.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
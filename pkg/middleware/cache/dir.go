@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dir is a Storage which keeps entries on disk, so they survive restarts. Each entry is stored in a separate file
+// named after hash of the key. Once total size of the files exceeds the limit, least recently used ones are removed.
+//
+// The directory must not be shared with other Dir instances, they would miscount its size.
+type Dir struct {
+	// Path is the storage directory. It will be created on the first Add if doesn't exist.
+	Path string
+
+	// MaxSize defines the maximum total size of files in bytes.
+	//
+	// If 0, DefaultDirSize will be used.
+	MaxSize int64
+
+	once sync.Once
+	mu   sync.Mutex
+	size int64
+}
+
+// dirEntry is the file content, the key is kept to tell hash collisions.
+type dirEntry struct {
+	Key   string
+	Entry *Entry
+}
+
+func (d *Dir) init() {
+	if d.MaxSize == 0 {
+		d.MaxSize = DefaultDirSize
+	}
+	files, _ := ioutil.ReadDir(d.Path)
+	for _, fi := range files {
+		if isEntryFile(fi) {
+			d.size += fi.Size()
+		}
+	}
+}
+
+// Get implements Storage interface
+func (d *Dir) Get(key string) (*Entry, error) {
+	d.once.Do(d.init)
+	f, err := os.Open(d.filename(key))
+	if os.IsNotExist(err) {
+		return nil, ErrMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var de dirEntry
+	err = gob.NewDecoder(f).Decode(&de)
+	if err != nil {
+		return nil, err
+	}
+	if de.Key != key || de.Entry == nil {
+		return nil, ErrMiss
+	}
+	// modification time tells which files were used recently
+	now := time.Now()
+	_ = os.Chtimes(f.Name(), now, now)
+	return de.Entry, nil
+}
+
+// Add implements Storage interface
+func (d *Dir) Add(key string, e *Entry) error {
+	d.once.Do(d.init)
+	err := os.MkdirAll(d.Path, 0700)
+	if err != nil {
+		return err
+	}
+	// write into a temporary file first, so concurrent readers never see partially written entry
+	tmp, err := ioutil.TempFile(d.Path, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = gob.NewEncoder(tmp).Encode(dirEntry{Key: key, Entry: e})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if fi.Size() > d.MaxSize {
+		return d.Remove(key)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	filename := d.filename(key)
+	if old, err := os.Stat(filename); err == nil {
+		d.size -= old.Size()
+	}
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		return err
+	}
+	d.size += fi.Size()
+	if d.size > d.MaxSize {
+		d.evict(filename)
+	}
+	return nil
+}
+
+// Remove implements Storage interface
+func (d *Dir) Remove(key string) error {
+	d.once.Do(d.init)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	filename := d.filename(key)
+	fi, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filename)
+	if err != nil {
+		return err
+	}
+	d.size -= fi.Size()
+	return nil
+}
+
+// Size returns the total size of files in storage.
+func (d *Dir) Size() int64 {
+	d.once.Do(d.init)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
+
+// evict removes least recently used files until the total size fits the limit. The file just added is kept.
+func (d *Dir) evict(keep string) {
+	files, err := ioutil.ReadDir(d.Path)
+	if err != nil {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		if d.size <= d.MaxSize {
+			return
+		}
+		filename := filepath.Join(d.Path, fi.Name())
+		if !isEntryFile(fi) || filename == keep {
+			continue
+		}
+		if os.Remove(filename) == nil {
+			d.size -= fi.Size()
+		}
+	}
+}
+
+func (d *Dir) filename(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(d.Path, hex.EncodeToString(h[:]))
+}
+
+func isEntryFile(fi os.FileInfo) bool {
+	return fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".")
+}
+
+// DefaultDirSize defines default size limit for on-disk storage.
+const DefaultDirSize = 1 << 30
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Memory is an in-memory Storage which evicts least recently used entries once total size of entries exceeds the
+// limit.
+//
+// Zero value is a valid instance.
+type Memory struct {
+	// MaxSize defines the maximum total size of entries in bytes.
+	//
+	// If 0, DefaultMemorySize will be used.
+	MaxSize int64
+
+	once    sync.Once
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+func (m *Memory) init() {
+	if m.MaxSize == 0 {
+		m.MaxSize = DefaultMemorySize
+	}
+	m.lru = list.New()
+	m.entries = make(map[string]*list.Element)
+}
+
+// Get implements Storage interface
+func (m *Memory) Get(key string) (*Entry, error) {
+	m.once.Do(m.init)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, ErrMiss
+	}
+	m.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, nil
+}
+
+// Add implements Storage interface
+func (m *Memory) Add(key string, e *Entry) error {
+	m.once.Do(m.init)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+	item := &memoryItem{key: key, entry: e, size: e.size() + int64(len(key))}
+	if item.size > m.MaxSize {
+		return nil
+	}
+	m.entries[key] = m.lru.PushFront(item)
+	m.size += item.size
+	for m.size > m.MaxSize {
+		m.remove(m.lru.Back().Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+// Remove implements Storage interface
+func (m *Memory) Remove(key string) error {
+	m.once.Do(m.init)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+	return nil
+}
+
+func (m *Memory) remove(key string) {
+	el, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	m.lru.Remove(el)
+	delete(m.entries, key)
+	m.size -= el.Value.(*memoryItem).size
+}
+
+// Len returns the number of entries in storage.
+func (m *Memory) Len() int {
+	m.once.Do(m.init)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// Size returns the total size of entries in storage.
+func (m *Memory) Size() int64 {
+	m.once.Do(m.init)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+// DefaultMemorySize defines default size limit for in-memory storage.
+const DefaultMemorySize = 64 << 20
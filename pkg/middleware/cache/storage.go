@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Storage defines interface for cached responses storage.
+type Storage interface {
+	// Get returns entry stored under the key. Returns ErrMiss if there's no such entry.
+	Get(key string) (*Entry, error)
+
+	// Add stores entry under the key, replacing existing one.
+	Add(key string, e *Entry) error
+
+	// Remove removes entry stored under the key. Removing missing entry is not an error.
+	Remove(key string) error
+}
+
+// ErrMiss is returned by Storage.Get if there's no entry under the key.
+var ErrMiss = errors.New("response cache miss")
+
+// Entry is a stored response.
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// RequestTime and ResponseTime are the times the request which produced the response was sent and the response
+	// was received. They are used to calculate the response age.
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	// RequestHeader holds the request header fields nominated by the response Vary header.
+	RequestHeader http.Header
+
+	// Vary is only set for entries which don't hold a response but point to response variants. It lists the request
+	// header fields which select the variant. See Cache for details.
+	Vary []string
+}
+
+// size returns approximate size of the entry in bytes.
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body))
+	for _, h := range []http.Header{e.Header, e.RequestHeader} {
+		for k, vv := range h {
+			for _, v := range vv {
+				n += int64(len(k) + len(v))
+			}
+		}
+	}
+	for _, v := range e.Vary {
+		n += int64(len(v))
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package cache_test
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/middleware/cache"
+)
+
+func testEntry(size int) *cache.Entry {
+	return &cache.Entry{
+		StatusCode:   http.StatusOK,
+		Header:       http.Header{"Content-Type": {"text/plain"}},
+		Body:         bytes.Repeat([]byte("x"), size),
+		RequestTime:  time.Now().Add(-time.Second).Round(0),
+		ResponseTime: time.Now().Round(0),
+	}
+}
+
+func testStorage(t *testing.T, s cache.Storage) {
+	t.Run("miss", func(t *testing.T) {
+		_, err := s.Get("http://example.com/missing")
+		require.Equal(t, cache.ErrMiss, err)
+	})
+	t.Run("hit", func(t *testing.T) {
+		e := testEntry(10)
+		require.NoError(t, s.Add("http://example.com/", e))
+		got, err := s.Get("http://example.com/")
+		require.NoError(t, err)
+		require.Equal(t, e.StatusCode, got.StatusCode)
+		require.Equal(t, e.Header, got.Header)
+		require.Equal(t, e.Body, got.Body)
+		require.True(t, e.ResponseTime.Equal(got.ResponseTime))
+	})
+	t.Run("replace", func(t *testing.T) {
+		require.NoError(t, s.Add("http://example.com/replaced", testEntry(10)))
+		require.NoError(t, s.Add("http://example.com/replaced", &cache.Entry{Vary: []string{"Accept"}}))
+		got, err := s.Get("http://example.com/replaced")
+		require.NoError(t, err)
+		require.Equal(t, []string{"Accept"}, got.Vary)
+	})
+	t.Run("remove", func(t *testing.T) {
+		require.NoError(t, s.Add("http://example.com/removed", testEntry(10)))
+		require.NoError(t, s.Remove("http://example.com/removed"))
+		_, err := s.Get("http://example.com/removed")
+		require.Equal(t, cache.ErrMiss, err)
+		require.NoError(t, s.Remove("http://example.com/removed"))
+	})
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, &cache.Memory{})
+	t.Run("size", func(t *testing.T) {
+		s := &cache.Memory{MaxSize: 3000}
+		for _, key := range []string{"a", "b", "c"} {
+			require.NoError(t, s.Add(key, testEntry(1000)))
+		}
+		require.Equal(t, 2, s.Len())
+		require.LessOrEqual(t, s.Size(), int64(3000))
+		_, err := s.Get("a")
+		require.Equal(t, cache.ErrMiss, err)
+
+		// too large entries are not stored at all
+		require.NoError(t, s.Add("d", testEntry(5000)))
+		_, err = s.Get("d")
+		require.Equal(t, cache.ErrMiss, err)
+		require.Equal(t, 2, s.Len())
+	})
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	testStorage(t, &cache.Dir{Path: dir})
+	t.Run("persistence", func(t *testing.T) {
+		e := testEntry(10)
+		require.NoError(t, (&cache.Dir{Path: dir}).Add("http://example.com/persistent", e))
+		got, err := (&cache.Dir{Path: dir}).Get("http://example.com/persistent")
+		require.NoError(t, err)
+		require.Equal(t, e.Body, got.Body)
+	})
+	t.Run("size", func(t *testing.T) {
+		s := &cache.Dir{Path: t.TempDir(), MaxSize: 3000}
+		for _, key := range []string{"a", "b", "c"} {
+			require.NoError(t, s.Add(key, testEntry(1000)))
+			// modification times must differ to tell the least recently used file
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.LessOrEqual(t, s.Size(), int64(3000))
+		_, err := s.Get("a")
+		require.Equal(t, cache.ErrMiss, err)
+		_, err = s.Get("c")
+		require.NoError(t, err)
+
+		reopened := &cache.Dir{Path: s.Path, MaxSize: 3000}
+		require.Equal(t, s.Size(), reopened.Size())
+	})
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// recorder passes the response through to the client and keeps a copy of it to be stored. Bodies larger than the limit
+// are not kept.
+//
+// If holdNotModified is set, 304 responses are not passed through, so the stored response could be served instead.
+type recorder struct {
+	rw              http.ResponseWriter
+	limit           int64
+	holdNotModified bool
+
+	header      http.Header
+	status      int
+	held        bool
+	body        bytes.Buffer
+	overflow    bool
+	wroteHeader bool
+}
+
+func newRecorder(rw http.ResponseWriter, limit int64) *recorder {
+	return &recorder{rw: rw, limit: limit, header: http.Header{}}
+}
+
+// Header implements http.ResponseWriter interface
+func (w *recorder) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements http.ResponseWriter interface
+func (w *recorder) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 {
+		// informational responses are passed through as is
+		copyHeader(w.rw.Header(), w.header)
+		w.rw.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	w.header = w.header.Clone()
+	if n, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil && n > w.limit {
+		w.overflow = true
+	}
+	if w.holdNotModified && status == http.StatusNotModified {
+		w.held = true
+		return
+	}
+	copyHeader(w.rw.Header(), w.header)
+	w.rw.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter interface
+func (w *recorder) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held {
+		return len(p), nil
+	}
+	if !w.overflow {
+		if int64(w.body.Len()+len(p)) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.rw.Write(p)
+}
+
+// Flush implements http.Flusher interface
+func (w *recorder) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.rw.(http.Flusher); ok && !w.held {
+		f.Flush()
+	}
+}
+
+// complete reports whether the whole response body was recorded.
+func (w *recorder) complete() bool {
+	if !w.wroteHeader || w.held || w.overflow {
+		return false
+	}
+	if n, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil {
+		return n == int64(w.body.Len())
+	}
+	return true
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		dst[k] = append(dst[k][:0:0], vv...)
+	}
+}
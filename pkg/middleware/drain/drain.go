@@ -0,0 +1,157 @@
+// Package drain implements middleware tracking requests in flight, so they can be waited for on shutdown.
+package drain
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Drain tracks requests being served, including the ones which hijacked client connections. http.Server forgets
+// about hijacked connections, so http.Server.Shutdown doesn't wait for tunnels and MITM intercepted connections, Drain
+// does.
+//
+// Zero value is a valid instance.
+type Drain struct {
+	// Logger specifies optional logger for requests cut off by Shutdown.
+	Logger *zap.Logger
+
+	once   sync.Once
+	mu     sync.Mutex
+	active map[*request]struct{}
+	idle   chan struct{}
+}
+
+type request struct {
+	rq     *http.Request
+	start  time.Time
+	cancel context.CancelFunc
+	conn   net.Conn
+}
+
+func (d *Drain) init() {
+	if d.Logger == nil {
+		d.Logger = zap.NewNop()
+	}
+	d.active = make(map[*request]struct{})
+}
+
+// Middleware is a middleware constructor. It must be the outermost middleware, so it sees the connection the way
+// http.Server hands it over.
+func (d *Drain) Middleware(next http.Handler) http.Handler {
+	d.once.Do(d.init)
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		ctx, cancel := context.WithCancel(rq.Context())
+		defer cancel()
+		r := &request{rq: rq, start: time.Now(), cancel: cancel}
+		d.add(r)
+		defer d.remove(r)
+		next.ServeHTTP(&responseWriter{ResponseWriter: rw, d: d, r: r}, rq.WithContext(ctx))
+	})
+}
+
+// Len returns the number of requests being served.
+func (d *Drain) Len() int {
+	d.once.Do(d.init)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.active)
+}
+
+// Shutdown waits for the requests being served to finish. If the context expires first, Shutdown cancels contexts
+// of the remaining requests, closes hijacked connections, logs what was cut off and returns the context's error.
+//
+// Shutdown doesn't stop new requests from coming in, the server must be shut down before calling it.
+func (d *Drain) Shutdown(ctx context.Context) error {
+	d.once.Do(d.init)
+	d.mu.Lock()
+	if len(d.active) == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+	if d.idle == nil {
+		d.idle = make(chan struct{})
+	}
+	idle := d.idle
+	d.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for r := range d.active {
+		d.Logger.Warn("request cut off by shutdown",
+			zap.String("method", r.rq.Method),
+			zap.String("target", r.rq.RequestURI),
+			zap.String("client", r.rq.RemoteAddr),
+			zap.Bool("hijacked", r.conn != nil),
+			zap.Duration("duration", time.Since(r.start)),
+		)
+		r.cancel()
+		if r.conn != nil {
+			_ = r.conn.Close()
+		}
+	}
+	return ctx.Err()
+}
+
+func (d *Drain) add(r *request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active[r] = struct{}{}
+}
+
+func (d *Drain) remove(r *request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.active, r)
+	if len(d.active) == 0 && d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+}
+
+// responseWriter records the connection once the handler hijacks it.
+type responseWriter struct {
+	http.ResponseWriter
+	d *Drain
+	r *request
+}
+
+// Flush implements http.Flusher interface
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker interface
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying http.ResponseWriter doesn't implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.d.mu.Lock()
+	w.r.conn = conn
+	w.d.mu.Unlock()
+	return conn, brw, nil
+}
+
+// Unwrap returns the underlying http.ResponseWriter, see http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
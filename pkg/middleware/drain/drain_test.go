@@ -0,0 +1,145 @@
+package drain_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/middleware/drain"
+)
+
+func TestDrain_Idle(t *testing.T) {
+	d := &drain.Drain{}
+	require.NoError(t, d.Shutdown(context.Background()))
+}
+
+func TestDrain_Wait(t *testing.T) {
+	var (
+		d       = &drain.Drain{}
+		release = make(chan struct{})
+		s       = httptest.NewServer(d.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			<-release
+			rw.WriteHeader(http.StatusNoContent)
+		})))
+	)
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		rs, err := http.Get(s.URL)
+		if err == nil {
+			_ = rs.Body.Close()
+		}
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return d.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- d.Shutdown(context.Background()) }()
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned while the request is in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(t, <-shutdown)
+	require.NoError(t, <-done)
+	require.Equal(t, 0, d.Len())
+}
+
+func TestDrain_CancelRequest(t *testing.T) {
+	var (
+		core, logs = observer.New(zap.InfoLevel)
+		d          = &drain.Drain{Logger: zap.New(core)}
+		s          = httptest.NewServer(d.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			<-rq.Context().Done()
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		})))
+	)
+	defer s.Close()
+
+	go func() {
+		rs, err := http.Get(s.URL + "/download")
+		if err == nil {
+			_ = rs.Body.Close()
+		}
+	}()
+	require.Eventually(t, func() bool { return d.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, d.Shutdown(ctx))
+	require.Eventually(t, func() bool { return d.Len() == 0 }, time.Second, 10*time.Millisecond)
+
+	entries := logs.FilterMessage("request cut off by shutdown").AllUntimed()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, "/download", fields["target"])
+	require.Equal(t, false, fields["hijacked"])
+}
+
+func TestDrain_CloseHijacked(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	var (
+		core, logs = observer.New(zap.InfoLevel)
+		d          = &drain.Drain{Logger: zap.New(core)}
+		proxy      = httptest.NewServer(d.Middleware(&handlers.Tunnel{}))
+	)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	addr := echo.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	rs, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rs.StatusCode)
+
+	// http.Server is done with the connection, only Drain knows about it
+	require.NoError(t, proxy.Config.Shutdown(context.Background()))
+	require.Equal(t, 1, d.Len())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, d.Shutdown(ctx))
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = br.ReadByte()
+	require.Equal(t, io.EOF, err)
+
+	entries := logs.FilterMessage("request cut off by shutdown").AllUntimed()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, addr, fields["target"])
+	require.Equal(t, true, fields["hijacked"])
+}
@@ -0,0 +1,491 @@
+package har
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+const (
+	// DefaultMaxBodySize is the default number of bytes of request and response bodies recorded.
+	DefaultMaxBodySize = 1 << 20
+
+	// DefaultMaxEntries is the default number of entries kept.
+	DefaultMaxEntries = 1000
+)
+
+// Recorder records plain HTTP and MITM intercepted requests. The most recent entries are kept in memory and served by
+// ServeHTTP, each session may be written into a separate file as well.
+//
+// Requests are recorded as they reach Recorder, so middleware before it in the chain, e.g. one removing credentials,
+// affects what is recorded, and request changes made by middleware after it, e.g. one adding headers, do not. Recorder
+// has to be in the chain of MITM CONNECT requests as well to group intercepted requests into sessions.
+//
+// Zero value is a valid instance which keeps DefaultMaxEntries entries in memory.
+type Recorder struct {
+	// Dir specifies the directory to write HAR file of each session to. Entries are appended to the file as they
+	// complete, the file is a valid HAR document once the session ends. Files are not written if Dir is empty.
+	Dir string
+
+	// MaxBodySize specifies how many bytes of request and response bodies are recorded, the rest is dropped.
+	//
+	// If MaxBodySize is 0, DefaultMaxBodySize is used.
+	MaxBodySize int64
+
+	// MaxEntries specifies how many of the most recent entries are kept in memory, and how many entries a session file
+	// may have.
+	//
+	// If MaxEntries is 0, DefaultMaxEntries is used.
+	MaxEntries int
+
+	once    sync.Once
+	mux     sync.Mutex
+	entries []recorded // ring buffer
+	next    int
+}
+
+// recorded is the entry kept in memory with the session page it belongs to
+type recorded struct {
+	entry *Entry
+	page  *Page
+}
+
+func (r *Recorder) init() {
+	if r.MaxBodySize == 0 {
+		r.MaxBodySize = DefaultMaxBodySize
+	}
+	if r.MaxEntries == 0 {
+		r.MaxEntries = DefaultMaxEntries
+	}
+}
+
+type ctxKey struct{}
+
+// session is a MITM intercepted connection or a plain HTTP request
+type session struct {
+	page    Page
+	mux     sync.Mutex
+	file    *os.File // session file entries are written into as they complete, only if Dir is set
+	entries int
+	dropped int
+	err     error
+}
+
+// Middleware is the middleware constructor.
+func (r *Recorder) Middleware(next http.Handler) http.Handler {
+	r.once.Do(r.init)
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		s, nested := rq.Context().Value(ctxKey{}).(*session)
+		switch {
+		case nested:
+			r.record(rw, rq, next, s)
+		case rq.Method == http.MethodConnect:
+			s = newSession(rq, "CONNECT "+rq.URL.Host)
+			next.ServeHTTP(rw, rq.WithContext(context.WithValue(rq.Context(), ctxKey{}, s)))
+			r.finish(rq, s)
+		default:
+			s = newSession(rq, rq.Method+" "+rq.URL.String())
+			r.record(rw, rq, next, s)
+			r.finish(rq, s)
+		}
+	})
+}
+
+func newSession(rq *http.Request, title string) *session {
+	id := log.UID(rq)
+	if id == (uuid.UUID{}) {
+		id = uuid.New()
+	}
+	return &session{page: Page{
+		StartedDateTime: time.Now(),
+		ID:              id.String(),
+		Title:           title,
+		PageTimings:     PageTimings{OnContentLoad: -1, OnLoad: -1},
+	}}
+}
+
+// record serves the request and records the exchange into the session
+func (r *Recorder) record(rw http.ResponseWriter, rq *http.Request, next http.Handler, s *session) {
+	var (
+		start = time.Now()
+		entry = Entry{
+			Pageref:         s.page.ID,
+			StartedDateTime: start,
+			Request:         request(rq),
+		}
+		body = &capture{max: r.MaxBodySize}
+		w    = &responseWriter{ResponseWriter: rw, body: capture{max: r.MaxBodySize}}
+	)
+	if rq.Body != nil && rq.Body != http.NoBody {
+		rq.Body = &requestBody{ReadCloser: rq.Body, c: body}
+	}
+	next.ServeHTTP(w, rq)
+	end := time.Now()
+
+	entry.Request.BodySize, entry.Request.PostData = body.postData(rq.Header.Get("Content-Type"))
+	entry.Response = w.response(rq)
+	entry.Time = ms(end.Sub(start))
+	entry.Timings = Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: entry.Time}
+	if !w.headAt.IsZero() {
+		entry.Timings.Wait = ms(w.headAt.Sub(start))
+		entry.Timings.Receive = ms(end.Sub(w.headAt))
+	}
+
+	if r.Dir != "" {
+		r.write(s, &entry)
+	}
+
+	r.mux.Lock()
+	if len(r.entries) < r.MaxEntries {
+		r.entries = append(r.entries, recorded{})
+	}
+	r.entries[r.next] = recorded{entry: &entry, page: &s.page}
+	r.next = (r.next + 1) % r.MaxEntries
+	r.mux.Unlock()
+}
+
+// write appends the entry to the session file, the file is created with the first entry
+func (r *Recorder) write(s *session, entry *Entry) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.err != nil {
+		return
+	}
+	if s.entries >= r.MaxEntries {
+		s.dropped++
+		return
+	}
+	if s.file == nil {
+		filename := filepath.Join(r.Dir, fmt.Sprintf("%s-%s.har",
+			s.page.StartedDateTime.UTC().Format("20060102T150405"), s.page.ID))
+		s.file, s.err = createFile(filename)
+		if s.err != nil {
+			return
+		}
+		// the document is written up to the opening bracket of the entries, which are the last field of it
+		var head []byte
+		head, s.err = json.Marshal(document([]Page{s.page}, nil))
+		if s.err == nil {
+			_, s.err = s.file.Write(bytes.TrimSuffix(head, []byte("]}}")))
+		}
+	}
+	var b []byte
+	b, s.err = json.Marshal(entry)
+	if s.err != nil {
+		return
+	}
+	if s.entries > 0 {
+		b = append([]byte{','}, b...)
+	}
+	_, s.err = s.file.Write(b)
+	s.entries++
+}
+
+// finish completes the session file
+func (r *Recorder) finish(rq *http.Request, s *session) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.file == nil {
+		if s.err != nil {
+			log.Warn(rq, "failed to write HAR file", zap.Error(s.err))
+		}
+		return
+	}
+	if s.err == nil {
+		_, s.err = s.file.Write([]byte("]}}\n"))
+	}
+	if err := s.file.Close(); s.err == nil {
+		s.err = err
+	}
+	if s.err != nil {
+		log.Warn(rq, "failed to write HAR file", zap.String("file", s.file.Name()), zap.Error(s.err))
+	}
+	if s.dropped > 0 {
+		log.Warn(rq, "HAR session file is truncated", zap.Int("dropped", s.dropped))
+	}
+}
+
+// createFile creates the session file, the file is only readable by the owner as it may contain credentials
+func createFile(filename string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+// Archive returns HAR document with the entries kept in memory, oldest first. If session is not empty, only entries of
+// the session with the ID are returned.
+func (r *Recorder) Archive(session string) *HAR {
+	r.once.Do(r.init)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var (
+		pages   []Page
+		entries []Entry
+		seen    = make(map[*Page]bool)
+	)
+	for i := range r.entries {
+		rec := r.entries[(r.next+i)%len(r.entries)]
+		if session != "" && rec.page.ID != session {
+			continue
+		}
+		if !seen[rec.page] {
+			seen[rec.page] = true
+			pages = append(pages, *rec.page)
+		}
+		entries = append(entries, *rec.entry)
+	}
+	return document(pages, entries)
+}
+
+// ServeHTTP serves Archive for download. The `session` query parameter selects the session.
+func (r *Recorder) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Disposition", `attachment; filename="multiproxy.har"`)
+	_ = json.NewEncoder(rw).Encode(r.Archive(rq.URL.Query().Get("session")))
+}
+
+func document(pages []Page, entries []Entry) *HAR {
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	if pages == nil {
+		pages = []Page{}
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	return &HAR{Log: Log{
+		Version: "1.2",
+		Creator: Creator{Name: "multiproxy", Version: version},
+		Pages:   pages,
+		Entries: entries,
+	}}
+}
+
+// request records the request line and headers
+func request(rq *http.Request) Request {
+	r := Request{
+		Method:      rq.Method,
+		URL:         rq.URL.String(),
+		HTTPVersion: rq.Proto,
+		Cookies:     []Cookie{},
+		Headers:     headers(rq.Header),
+		QueryString: []NameValue{},
+		HeadersSize: -1,
+	}
+	for _, c := range rq.Cookies() {
+		r.Cookies = append(r.Cookies, Cookie{Name: c.Name, Value: c.Value})
+	}
+	query := rq.URL.Query()
+	for _, name := range sortedKeys(query) {
+		for _, v := range query[name] {
+			r.QueryString = append(r.QueryString, NameValue{Name: name, Value: v})
+		}
+	}
+	return r
+}
+
+func headers(h http.Header) []NameValue {
+	list := []NameValue{}
+	for _, name := range sortedKeys(h) {
+		for _, v := range h[name] {
+			list = append(list, NameValue{Name: name, Value: v})
+		}
+	}
+	return list
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ms converts duration into milliseconds
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// capture keeps the first max bytes written into it and counts the rest.
+type capture struct {
+	max  int64
+	mux  sync.Mutex
+	buf  bytes.Buffer
+	size int64
+}
+
+// Write implements io.Writer interface
+func (c *capture) Write(p []byte) (int, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.size += int64(len(p))
+	if room := c.max - int64(c.buf.Len()); room > 0 {
+		if int64(len(p)) > room {
+			c.buf.Write(p[:room])
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// text returns the captured bytes as text, base64 encoded if they are not valid UTF-8 or the content is encoded.
+func (c *capture) text(contentEncoding string) (text, encoding, comment string) {
+	b := c.buf.Bytes()
+	if int64(len(b)) < c.size {
+		comment = fmt.Sprintf("truncated to %d bytes", len(b))
+	}
+	if contentEncoding == "" && utf8.Valid(b) {
+		return string(b), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64", comment
+}
+
+func (c *capture) postData(mimeType string) (int64, *PostData) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.size == 0 {
+		return 0, nil
+	}
+	d := &PostData{MimeType: mimeType}
+	d.Text, d.Encoding, d.Comment = c.text("")
+	return c.size, d
+}
+
+// requestBody captures the request body as it's read
+type requestBody struct {
+	io.ReadCloser
+	c *capture
+}
+
+// Read implements io.Reader interface
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	_, _ = b.c.Write(p[:n])
+	return n, err
+}
+
+// responseWriter captures the response.
+type responseWriter struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	headAt   time.Time
+	body     capture
+	hijacked bool
+}
+
+// WriteHeader implements http.ResponseWriter interface
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+		w.headAt = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter interface
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	_, _ = w.body.Write(p[:n])
+	return n, err
+}
+
+// Flush implements http.Flusher interface
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker interface. Nothing is captured after the connection is hijacked.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying http.ResponseWriter doesn't implement http.Hijacker")
+	}
+	w.hijacked = true
+	return hj.Hijack()
+}
+
+// Unwrap returns the underlying http.ResponseWriter, see http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// response records the response sent to the client
+func (w *responseWriter) response(rq *http.Request) Response {
+	status, header := w.status, w.header
+	switch {
+	case status == 0 && w.hijacked:
+		// the response head was written into the hijacked connection
+		status, header = log.StatusCode(rq), w.ResponseWriter.Header()
+		if status == 0 {
+			status = http.StatusSwitchingProtocols
+		}
+	case status == 0:
+		status, header = http.StatusOK, w.ResponseWriter.Header()
+	}
+	r := Response{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HTTPVersion: rq.Proto,
+		Cookies:     []Cookie{},
+		Headers:     headers(header),
+		RedirectURL: header.Get("Location"),
+		HeadersSize: -1,
+	}
+	for _, c := range (&http.Response{Header: header}).Cookies() {
+		cookie := Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			cookie.Expires = &expires
+		}
+		r.Cookies = append(r.Cookies, cookie)
+	}
+
+	w.body.mux.Lock()
+	defer w.body.mux.Unlock()
+	r.BodySize = w.body.size
+	r.Content = Content{Size: w.body.size, MimeType: header.Get("Content-Type")}
+	if w.body.size > 0 {
+		r.Content.Text, r.Content.Encoding, r.Content.Comment = w.body.text(header.Get("Content-Encoding"))
+	}
+	return r
+}
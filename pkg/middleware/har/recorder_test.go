@@ -0,0 +1,176 @@
+package har_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/middleware/har"
+)
+
+var echo = http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+	b, _ := ioutil.ReadAll(rq.Body)
+	http.SetCookie(rw, &http.Cookie{Name: "session", Value: "42", Path: "/", HttpOnly: true})
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusCreated)
+	_, _ = rw.Write(b)
+})
+
+func TestRecorder(t *testing.T) {
+	r := &har.Recorder{}
+	rq := httptest.NewRequest(http.MethodPost, "http://example.com/echo?b=2&a=1", strings.NewReader("hello"))
+	rq.Header.Set("Content-Type", "text/plain")
+	rq.AddCookie(&http.Cookie{Name: "id", Value: "abc"})
+	r.Middleware(echo).ServeHTTP(httptest.NewRecorder(), rq)
+
+	doc := r.Archive("")
+	require.Equal(t, "1.2", doc.Log.Version)
+	require.Len(t, doc.Log.Pages, 1)
+	require.Equal(t, "POST http://example.com/echo?b=2&a=1", doc.Log.Pages[0].Title)
+	require.Len(t, doc.Log.Entries, 1)
+
+	e := doc.Log.Entries[0]
+	require.Equal(t, doc.Log.Pages[0].ID, e.Pageref)
+	require.Equal(t, http.MethodPost, e.Request.Method)
+	require.Equal(t, "http://example.com/echo?b=2&a=1", e.Request.URL)
+	require.Equal(t, []har.NameValue{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, e.Request.QueryString)
+	require.Equal(t, []har.Cookie{{Name: "id", Value: "abc"}}, e.Request.Cookies)
+	require.Contains(t, e.Request.Headers, har.NameValue{Name: "Content-Type", Value: "text/plain"})
+	require.Equal(t, &har.PostData{MimeType: "text/plain", Text: "hello"}, e.Request.PostData)
+	require.Equal(t, int64(5), e.Request.BodySize)
+
+	require.Equal(t, http.StatusCreated, e.Response.Status)
+	require.Equal(t, "Created", e.Response.StatusText)
+	require.Equal(t, []har.Cookie{{Name: "session", Value: "42", Path: "/", HTTPOnly: true}}, e.Response.Cookies)
+	require.Equal(t, har.Content{Size: 5, MimeType: "text/plain", Text: "hello"}, e.Response.Content)
+	require.True(t, e.Time >= e.Timings.Wait+e.Timings.Receive-0.001)
+}
+
+func TestRecorder_Body(t *testing.T) {
+	r := &har.Recorder{MaxBodySize: 4}
+	rq := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("\xff\xfe\xfd\xfc\xfb"))
+	r.Middleware(echo).ServeHTTP(httptest.NewRecorder(), rq)
+
+	e := r.Archive("").Log.Entries[0]
+	require.Equal(t, int64(5), e.Request.BodySize)
+	require.Equal(t, &har.PostData{Text: "//79/A==", Encoding: "base64", Comment: "truncated to 4 bytes"}, e.Request.PostData)
+	require.Equal(t, har.Content{
+		Size:     5,
+		MimeType: "text/plain",
+		Text:     "//79/A==",
+		Encoding: "base64",
+		Comment:  "truncated to 4 bytes",
+	}, e.Response.Content)
+}
+
+func TestRecorder_Archive(t *testing.T) {
+	r := &har.Recorder{MaxEntries: 2}
+	h := r.Middleware(echo)
+	for _, path := range []string{"/1", "/2", "/3"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+	}
+
+	doc := r.Archive("")
+	require.Len(t, doc.Log.Entries, 2)
+	require.Equal(t, "http://example.com/2", doc.Log.Entries[0].Request.URL)
+	require.Equal(t, "http://example.com/3", doc.Log.Entries[1].Request.URL)
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/har?session="+doc.Log.Pages[1].ID, nil))
+	require.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	var served har.HAR
+	require.NoError(t, json.NewDecoder(rw.Body).Decode(&served))
+	require.Len(t, served.Log.Pages, 1)
+	require.Len(t, served.Log.Entries, 1)
+	require.Equal(t, "http://example.com/3", served.Log.Entries[0].Request.URL)
+}
+
+func TestRecorder_Session(t *testing.T) {
+	dir, err := ioutil.TempDir("", "har")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		r = &har.Recorder{Dir: dir}
+		h http.Handler
+	)
+	// CONNECT handler serves intercepted requests in the context of the CONNECT request, the way MITMHandler does
+	h = r.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		if rq.Method != http.MethodConnect {
+			echo(rw, rq)
+			return
+		}
+		for _, path := range []string{"/1", "/2"} {
+			sub := httptest.NewRequest(http.MethodGet, "https://example.com"+path, nil).WithContext(rq.Context())
+			h.ServeHTTP(httptest.NewRecorder(), sub)
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodConnect, "example.com:443", nil))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.har"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	b, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	var doc har.HAR
+	require.NoError(t, json.Unmarshal(b, &doc))
+
+	require.Len(t, doc.Log.Pages, 1)
+	require.Equal(t, "CONNECT example.com:443", doc.Log.Pages[0].Title)
+	require.Contains(t, files[0], doc.Log.Pages[0].ID)
+	require.Len(t, doc.Log.Entries, 2)
+	archived := r.Archive(doc.Log.Pages[0].ID).Log.Entries
+	require.Len(t, archived, 2)
+	for i, e := range doc.Log.Entries {
+		require.Equal(t, doc.Log.Pages[0].ID, e.Pageref)
+		require.Equal(t, archived[i].Request.URL, e.Request.URL)
+	}
+	require.Equal(t, "https://example.com/2", archived[1].Request.URL)
+}
+
+func TestRecorder_SessionTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "har")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		r = &har.Recorder{Dir: dir, MaxEntries: 1}
+		h http.Handler
+	)
+	h = r.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		if rq.Method != http.MethodConnect {
+			echo(rw, rq)
+			return
+		}
+		for _, path := range []string{"/1", "/2"} {
+			sub := httptest.NewRequest(http.MethodGet, "https://example.com"+path, nil).WithContext(rq.Context())
+			h.ServeHTTP(httptest.NewRecorder(), sub)
+		}
+		// entries are in the file before the session ends
+		files, err := filepath.Glob(filepath.Join(dir, "*.har"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		b, err := ioutil.ReadFile(files[0])
+		require.NoError(t, err)
+		require.Contains(t, string(b), "https://example.com/1")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodConnect, "example.com:443", nil))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.har"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	b, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	var doc har.HAR
+	require.NoError(t, json.Unmarshal(b, &doc))
+	require.Len(t, doc.Log.Pages, 1)
+	require.Len(t, doc.Log.Entries, 1)
+	require.Equal(t, "https://example.com/1", doc.Log.Entries[0].Request.URL)
+}
@@ -22,8 +22,13 @@ type ctxObj struct {
 	uid    uuid.UUID
 	parent *ctxObj
 
-	status        int
-	contentLength int
+	status           int
+	contentLength    int
+	hasContentLength bool
+
+	bytesSent     int64
+	bytesReceived int64
+	hasBytes      bool
 }
 
 // DefaultAccessLogEncoderConfig returns the default configuration for access logger encoder
@@ -130,10 +135,23 @@ func Middleware(aw io.Writer, sw io.Writer, lvl zapcore.Level) func(http.Handler
 			}
 			ctx := context.WithValue(rq.Context(), ctxKey{}, obj)
 			next.ServeHTTP(rw, rq.WithContext(ctx))
-			obj.access.Info("",
+			fields := make([]zap.Field, 0, 6)
+			if obj.status != 0 {
+				fields = append(fields, zap.Int("status", obj.status))
+			}
+			if obj.hasContentLength {
+				fields = append(fields, zap.Int("content-length", obj.contentLength))
+			}
+			if obj.hasBytes {
+				fields = append(fields,
+					zap.Int64("bytes-sent", obj.bytesSent),
+					zap.Int64("bytes-received", obj.bytesReceived),
+				)
+			}
+			obj.access.Info("", append(fields,
 				zap.Duration("duration", time.Since(t)),
 				zap.Stringer("duration-human", time.Since(t).Round(time.Millisecond)),
-			)
+			)...)
 		})
 	}
 }
@@ -173,14 +191,14 @@ func Named(rq *http.Request, s string) {
 	obj.server = obj.server.Named(s)
 }
 
-// WithStatusCode pushes response status code into the access logger associated with the request.
+// WithStatusCode pushes response status code into the access logger associated with the request. If pushed more than
+// once, the last value is logged.
 func WithStatusCode(rq *http.Request, status int) {
 	obj, ok := rq.Context().Value(ctxKey{}).(*ctxObj)
 	if !ok {
 		return
 	}
 	obj.status = status
-	obj.access = obj.access.With(zap.Int("status", status))
 }
 
 // StatusCode returns status code previously pushed into the request context. Returns 0 if no status was pushed.
@@ -192,14 +210,15 @@ func StatusCode(rq *http.Request) int {
 	return obj.status
 }
 
-// WithContentLength pushes response content length into the access logger associated with the request.
+// WithContentLength pushes response content length into the access logger associated with the request. If pushed more
+// than once, the last value is logged.
 func WithContentLength(rq *http.Request, n int) {
 	obj, ok := rq.Context().Value(ctxKey{}).(*ctxObj)
 	if !ok {
 		return
 	}
 	obj.contentLength = n
-	obj.access = obj.access.With(zap.Int("content-length", n))
+	obj.hasContentLength = true
 }
 
 // ContentLength returns content length previously pushed into the request context. Returns 0 if no content length was
@@ -212,6 +231,18 @@ func ContentLength(rq *http.Request) int {
 	return obj.contentLength
 }
 
+// WithBytes pushes the number of bytes sent to and received from the client over hijacked connection into the access
+// logger associated with the request. If pushed more than once, the last values are logged.
+func WithBytes(rq *http.Request, sent, received int64) {
+	obj, ok := rq.Context().Value(ctxKey{}).(*ctxObj)
+	if !ok {
+		return
+	}
+	obj.bytesSent = sent
+	obj.bytesReceived = received
+	obj.hasBytes = true
+}
+
 // UID returns request identifier from the request context. Returns zero UUID if not found in the context.
 func UID(rq *http.Request) uuid.UUID {
 	obj, ok := rq.Context().Value(ctxKey{}).(*ctxObj)
@@ -37,6 +37,7 @@ func TestLog(t *testing.T) {
 					log.With(rq, zap.String("common-field", "yes"))
 
 					log.WithContentLength(rq, 100500)
+					log.WithBytes(rq, 3, 5)
 					log.WithStatusCode(rq, http.StatusOK)
 
 					log.Error(rq, "error message")
@@ -59,6 +60,7 @@ func TestLog(t *testing.T) {
 	assert.Contains(t, access.String(), `"url":"/"`)
 	assert.Contains(t, access.String(), `"status":200`)
 	assert.Contains(t, access.String(), `"content-length":100500`)
+	assert.Contains(t, access.String(), `"bytes-sent":3,"bytes-received":5`)
 	assert.Contains(t, access.String(), `"common-field":"yes"`)
 
 	assert.Contains(t, server.String(), `"logger":"server.test"`)
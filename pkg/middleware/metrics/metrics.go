@@ -0,0 +1,253 @@
+// Package metrics implements middleware collecting request metrics.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akabos/multiproxy/pkg/metrics"
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+const (
+	// DefaultMaxHosts is the default number of distinct target hosts metrics are collected by.
+	DefaultMaxHosts = 100
+
+	// OtherHost is the host label value of requests to hosts over MaxHosts.
+	OtherHost = "other"
+)
+
+// Metrics collects request counts and latencies by handler, status code and target host, bytes exchanged with clients
+// and the number of active CONNECT requests (tunnels).
+//
+// Status codes are taken from the log middleware for hijacked connections, so Metrics must come after it in the chain.
+// Bytes of regular requests are the request and response bodies, bytes of hijacked connections are everything sent
+// through them. Bytes of requests nested in the counted one, e.g. MITM intercepted requests, are not counted again.
+//
+// Series are never dropped, so the number of distinct host label values is limited by MaxHosts, requests to any other
+// host are counted with "other" host.
+//
+// Zero value is a valid instance which collects metrics into a private registry.
+type Metrics struct {
+	// Registry specifies the registry metrics are registered in.
+	Registry *metrics.Registry
+
+	// MaxHosts specifies the number of distinct target hosts metrics are collected by, the first ones seen are kept.
+	//
+	// If MaxHosts is 0, DefaultMaxHosts is used.
+	MaxHosts int
+
+	once     sync.Once
+	mux      sync.Mutex
+	hosts    map[string]struct{}
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+	received *metrics.CounterVec
+	sent     *metrics.CounterVec
+	active   *metrics.GaugeVec
+}
+
+func (m *Metrics) init() {
+	if m.Registry == nil {
+		m.Registry = &metrics.Registry{}
+	}
+	if m.MaxHosts == 0 {
+		m.MaxHosts = DefaultMaxHosts
+	}
+	m.hosts = make(map[string]struct{})
+	m.requests = m.Registry.Counter("multiproxy_requests_total",
+		"Number of served requests.", "handler", "code", "host")
+	m.duration = m.Registry.Histogram("multiproxy_request_duration_seconds",
+		"Time taken to serve requests, including whole lifetime of tunnels.", nil, "handler", "code", "host")
+	m.received = m.Registry.Counter("multiproxy_received_bytes_total",
+		"Bytes received from clients.", "handler")
+	m.sent = m.Registry.Counter("multiproxy_sent_bytes_total",
+		"Bytes sent to clients.", "handler")
+	m.active = m.Registry.Gauge("multiproxy_active_tunnels",
+		"Number of CONNECT requests being served.", "handler")
+}
+
+// Middleware returns middleware constructor collecting metrics of requests served by the named handler.
+func (m *Metrics) Middleware(handler string) func(http.Handler) http.Handler {
+	m.once.Do(m.init)
+	var (
+		received = m.received.With(handler)
+		sent     = m.sent.With(handler)
+		active   = m.active.With(handler)
+	)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			start := time.Now()
+			if rq.Method == http.MethodConnect {
+				active.Inc()
+				defer active.Dec()
+			}
+			w := &responseWriter{ResponseWriter: rw, received: received, sent: sent}
+			if rq.Context().Value(ctxKey{}) != nil {
+				// bytes of the nested request are counted by the request it's nested in, these counters are not registered
+				w.received, w.sent = &metrics.Counter{}, &metrics.Counter{}
+			} else {
+				if rq.Body != nil && rq.Body != http.NoBody {
+					rq.Body = &countingBody{ReadCloser: rq.Body, n: received}
+				}
+				rq = rq.WithContext(context.WithValue(rq.Context(), ctxKey{}, true))
+			}
+			next.ServeHTTP(w, rq)
+
+			status := w.status
+			if w.hijacked || status == 0 {
+				status = log.StatusCode(rq)
+			}
+			if status == 0 {
+				status = http.StatusOK
+			}
+			code, host := strconv.Itoa(status), m.host(rq.URL.Hostname())
+			m.requests.With(handler, code, host).Inc()
+			m.duration.With(handler, code, host).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// host returns the host label value, OtherHost if there are MaxHosts hosts seen already
+func (m *Metrics) host(hostname string) string {
+	hostname = strings.ToLower(hostname)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.hosts[hostname]; ok {
+		return hostname
+	}
+	if len(m.hosts) >= m.MaxHosts {
+		return OtherHost
+	}
+	m.hosts[hostname] = struct{}{}
+	return hostname
+}
+
+type ctxKey struct{}
+
+type countingBody struct {
+	io.ReadCloser
+	n *metrics.Counter
+}
+
+// Read implements io.Reader interface
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(float64(n))
+	return n, err
+}
+
+// responseWriter counts bytes written to the client and records the status code.
+type responseWriter struct {
+	http.ResponseWriter
+	received *metrics.Counter
+	sent     *metrics.Counter
+	status   int
+	hijacked bool
+}
+
+// WriteHeader implements http.ResponseWriter interface
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter interface
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.sent.Add(float64(n))
+	return n, err
+}
+
+// Flush implements http.Flusher interface
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker interface. Bytes read and written through the hijacked connection are counted.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying http.ResponseWriter doesn't implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	c := &countingConn{Conn: conn, received: w.received, sent: w.sent}
+	// whatever the client sent ahead is buffered in brw, it's counted when read from there
+	r := bufio.NewReader(&countingReader{r: brw.Reader, n: w.received})
+	return c, bufio.NewReadWriter(r, bufio.NewWriter(c)), nil
+}
+
+// Unwrap returns the underlying http.ResponseWriter, see http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type countingReader struct {
+	r io.Reader
+	n *metrics.Counter
+}
+
+// Read implements io.Reader interface
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(float64(n))
+	return n, err
+}
+
+type countingConn struct {
+	net.Conn
+	received *metrics.Counter
+	sent     *metrics.Counter
+}
+
+// Read implements net.Conn interface
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(float64(n))
+	return n, err
+}
+
+// Write implements net.Conn interface
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(float64(n))
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, so tunnels could pass half-close on.
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("underlying net.Conn doesn't support half-close")
+}
+
+// ReadFrom implements io.ReaderFrom interface, so bufio.Writer streams straight into the connection. Bytes are counted
+// as they go, not when the copy is over, to keep long-living tunnels accounted.
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{c}, r)
+}
+
+// writerOnly hides io.ReaderFrom of the writer, so io.Copy doesn't loop back into it
+type writerOnly struct {
+	io.Writer
+}
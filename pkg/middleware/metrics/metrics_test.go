@@ -0,0 +1,160 @@
+package metrics_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/metrics"
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+	mwmetrics "github.com/akabos/multiproxy/pkg/middleware/metrics"
+)
+
+func scrape(r *metrics.Registry) string {
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	return rw.Body.String()
+}
+
+func TestMetrics_HTTP(t *testing.T) {
+	var (
+		r = &metrics.Registry{}
+		m = &mwmetrics.Metrics{Registry: r}
+		h = alice.New(log.Middleware(ioutil.Discard, ioutil.Discard, zapcore.InfoLevel), m.Middleware("http")).ThenFunc(
+			func(rw http.ResponseWriter, rq *http.Request) {
+				body, _ := ioutil.ReadAll(rq.Body)
+				if len(body) == 0 {
+					http.Error(rw, "empty", http.StatusBadRequest)
+					return
+				}
+				_, _ = rw.Write(body)
+			},
+		)
+	)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://example.com/", strings.NewReader("hello")))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com:8080/", nil))
+
+	out := scrape(r)
+	require.Contains(t, out, `multiproxy_requests_total{handler="http",code="200",host="example.com"} 1`+"\n")
+	require.Contains(t, out, `multiproxy_requests_total{handler="http",code="400",host="example.com"} 1`+"\n")
+	require.Contains(t, out, `multiproxy_request_duration_seconds_count{handler="http",code="200",host="example.com"} 1`+"\n")
+	require.Contains(t, out, `multiproxy_received_bytes_total{handler="http"} 5`+"\n")
+	require.Contains(t, out, `multiproxy_sent_bytes_total{handler="http"} 11`+"\n") // "hello" + "empty\n"
+	require.Contains(t, out, `multiproxy_active_tunnels{handler="http"} 0`+"\n")
+}
+
+func TestMetrics_MaxHosts(t *testing.T) {
+	var (
+		r = &metrics.Registry{}
+		m = &mwmetrics.Metrics{Registry: r, MaxHosts: 2}
+		h = m.Middleware("http")(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {}))
+	)
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com", "A.example.com", "d.example.com"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://"+host+"/", nil))
+	}
+
+	out := scrape(r)
+	require.Contains(t, out, `multiproxy_requests_total{handler="http",code="200",host="a.example.com"} 2`+"\n")
+	require.Contains(t, out, `multiproxy_requests_total{handler="http",code="200",host="b.example.com"} 1`+"\n")
+	require.Contains(t, out, `multiproxy_requests_total{handler="http",code="200",host="other"} 2`+"\n")
+	require.NotContains(t, out, "c.example.com")
+}
+
+func TestMetrics_Nested(t *testing.T) {
+	var (
+		r     = &metrics.Registry{}
+		m     = &mwmetrics.Metrics{Registry: r}
+		inner = m.Middleware("mitm-request")(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			_, _ = ioutil.ReadAll(rq.Body)
+			_, _ = rw.Write([]byte("hello"))
+		}))
+		// outer handler serves nested requests in its context, the way MITMHandler does
+		outer = m.Middleware("mitm")(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			_, _ = ioutil.ReadAll(rq.Body)
+			sub := httptest.NewRequest("POST", "https://example.com/", strings.NewReader("hi")).WithContext(rq.Context())
+			inner.ServeHTTP(httptest.NewRecorder(), sub)
+			_, _ = rw.Write([]byte("ok"))
+		}))
+	)
+	outer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://example.com/", strings.NewReader("abc")))
+
+	out := scrape(r)
+	require.Contains(t, out, `multiproxy_requests_total{handler="mitm-request",code="200",host="example.com"} 1`+"\n")
+	require.Contains(t, out, `multiproxy_received_bytes_total{handler="mitm"} 3`+"\n")
+	require.Contains(t, out, `multiproxy_sent_bytes_total{handler="mitm"} 2`+"\n")
+	require.Contains(t, out, `multiproxy_received_bytes_total{handler="mitm-request"} 0`+"\n")
+	require.Contains(t, out, `multiproxy_sent_bytes_total{handler="mitm-request"} 0`+"\n")
+}
+
+func TestMetrics_Tunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// the tunnel only ends when both sides close
+				_, _ = io.CopyN(conn, conn, 4)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	var (
+		r     = &metrics.Registry{}
+		m     = &mwmetrics.Metrics{Registry: r}
+		proxy = httptest.NewServer(alice.New(
+			log.Middleware(ioutil.Discard, ioutil.Discard, zapcore.InfoLevel),
+			m.Middleware("tunnel"),
+		).Then(&handlers.Tunnel{}))
+	)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	addr := echo.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	rs, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rs.StatusCode)
+
+	require.Contains(t, scrape(r), `multiproxy_active_tunnels{handler="tunnel"} 1`+"\n")
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	_ = conn.Close()
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(r), `multiproxy_active_tunnels{handler="tunnel"} 0`+"\n")
+	}, time.Second, 10*time.Millisecond)
+
+	out := scrape(r)
+	require.Contains(t, out, `multiproxy_requests_total{handler="tunnel",code="200",host="127.0.0.1"} 1`+"\n")
+	require.Contains(t, out, `multiproxy_received_bytes_total{handler="tunnel"} 4`+"\n")
+	// the status line is written through the hijacked connection as well
+	require.Contains(t, out, fmt.Sprintf(`multiproxy_sent_bytes_total{handler="tunnel"} %d`+"\n", len("HTTP/1.1 200 OK\r\n\r\nping")))
+}
@@ -0,0 +1,238 @@
+// Package ratelimit implements request rate and concurrency limiting middleware.
+//
+// Each rule limits requests sharing the key: client address, authenticated user or target host. Requests over any of
+// the limits get `429 Too Many Requests` with Retry-After header, CONNECT requests are refused the same way. The rule
+// which rejected the request is recorded in the access log.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/akabos/multiproxy/pkg/middleware/auth"
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+// DefaultMaxKeys is the default number of keys a rule keeps request rates of.
+const DefaultMaxKeys = 4096
+
+// Key is what requests share a limit.
+type Key int
+
+const (
+	// ByClient limits requests of each client address.
+	ByClient Key = iota
+
+	// ByUser limits requests of each authenticated user, see auth.User. Requests of unauthenticated clients are not
+	// limited.
+	ByUser
+
+	// ByHost limits requests to each target host.
+	ByHost
+)
+
+// ParseKey converts string representation of the key ("client", "user" or "host") into Key.
+func ParseKey(s string) (Key, error) {
+	switch s {
+	case "client":
+		return ByClient, nil
+	case "user":
+		return ByUser, nil
+	case "host":
+		return ByHost, nil
+	default:
+		return 0, fmt.Errorf("unknown key: %q", s)
+	}
+}
+
+func (k Key) String() string {
+	switch k {
+	case ByUser:
+		return "user"
+	case ByHost:
+		return "host"
+	default:
+		return "client"
+	}
+}
+
+// Rule limits requests sharing the key. Zero limits are not enforced.
+type Rule struct {
+	Key Key
+
+	// Rate is the number of requests per second.
+	Rate float64
+
+	// Burst is the number of requests allowed to go at once over Rate. If Burst is 0, it's Rate rounded up.
+	Burst int
+
+	// MaxConcurrent is the number of requests served at once, tunnels and MITM intercepted connections included.
+	// Requests nested in the limited one, e.g. MITM intercepted requests, don't count, they are subject to Rate only.
+	MaxConcurrent int
+}
+
+// key returns the key of the request, false if the rule doesn't apply to the request.
+func (r *Rule) key(rq *http.Request) (string, bool) {
+	switch r.Key {
+	case ByUser:
+		return auth.User(rq)
+	case ByHost:
+		return strings.ToLower(rq.URL.Hostname()), true
+	default:
+		host, _, err := net.SplitHostPort(rq.RemoteAddr)
+		if err != nil {
+			host = rq.RemoteAddr
+		}
+		return host, true
+	}
+}
+
+// Limiter limits rate and concurrency of requests.
+//
+// The zero value of Limiter is a valid instance which limits nothing.
+type Limiter struct {
+	// Rules are all checked for every request, the request is rejected if any of them is over the limit.
+	Rules []Rule
+
+	// MaxKeys limits the number of keys each rule keeps request rates of, least recently used ones are dropped.
+	//
+	// If MaxKeys is 0, DefaultMaxKeys is used.
+	MaxKeys int
+
+	once  sync.Once
+	rules []*state
+}
+
+// state is the state of a rule
+type state struct {
+	*Rule
+	mux    sync.Mutex
+	rates  *lru.Cache
+	active map[string]int
+}
+
+func (l *Limiter) init() {
+	if l.MaxKeys == 0 {
+		l.MaxKeys = DefaultMaxKeys
+	}
+	for i := range l.Rules {
+		s := &state{Rule: &l.Rules[i], active: make(map[string]int)}
+		s.rates, _ = lru.New(l.MaxKeys)
+		l.rules = append(l.rules, s)
+	}
+}
+
+type ctxKey struct{}
+
+// Middleware is the middleware constructor.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	l.once.Do(l.init)
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		var (
+			nested       = rq.Context().Value(ctxKey{}) != nil
+			now          = time.Now()
+			reservations []*rate.Reservation
+			acquired     []func()
+		)
+		undo := func() {
+			for _, r := range reservations {
+				r.CancelAt(now)
+			}
+			for _, release := range acquired {
+				release()
+			}
+		}
+		for _, s := range l.rules {
+			key, ok := s.key(rq)
+			if !ok {
+				continue
+			}
+			if r := s.reserve(key, now); r != nil {
+				if delay := r.DelayFrom(now); delay > 0 {
+					r.CancelAt(now)
+					undo()
+					reject(rq, rw, s.Key.String()+" rate", delay)
+					return
+				}
+				reservations = append(reservations, r)
+			}
+			if s.MaxConcurrent > 0 && !nested {
+				release, ok := s.acquire(key)
+				if !ok {
+					undo()
+					// there's no telling when a request finishes, the client should try again soon
+					reject(rq, rw, s.Key.String()+" concurrency", time.Second)
+					return
+				}
+				acquired = append(acquired, release)
+			}
+		}
+		defer func() {
+			for _, release := range acquired {
+				release()
+			}
+		}()
+		if !nested {
+			rq = rq.WithContext(context.WithValue(rq.Context(), ctxKey{}, true))
+		}
+		next.ServeHTTP(rw, rq)
+	})
+}
+
+// reserve takes a token from the bucket of the key, returns nil if the rate is not limited
+func (s *state) reserve(key string, now time.Time) *rate.Reservation {
+	if s.Rate <= 0 {
+		return nil
+	}
+	s.mux.Lock()
+	x, ok := s.rates.Get(key)
+	if !ok {
+		burst := s.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(s.Rate))
+		}
+		x = rate.NewLimiter(rate.Limit(s.Rate), burst)
+		s.rates.Add(key, x)
+	}
+	s.mux.Unlock()
+	return x.(*rate.Limiter).ReserveN(now, 1)
+}
+
+// acquire counts the request of the key as active, returns false if there are MaxConcurrent active already
+func (s *state) acquire(key string) (func(), bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.active[key] >= s.MaxConcurrent {
+		return nil, false
+	}
+	s.active[key]++
+	return func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		if s.active[key]--; s.active[key] == 0 {
+			delete(s.active, key)
+		}
+	}, true
+}
+
+func reject(rq *http.Request, rw http.ResponseWriter, reason string, retry time.Duration) {
+	seconds := int(math.Ceil(retry.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	log.With(rq, zap.String("ratelimit", reason))
+	log.WithStatusCode(rq, http.StatusTooManyRequests)
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
@@ -0,0 +1,93 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+	"github.com/akabos/multiproxy/pkg/middleware/ratelimit"
+)
+
+var ok = http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {})
+
+func serve(h http.Handler, url, remoteAddr string) *httptest.ResponseRecorder {
+	rq := httptest.NewRequest(http.MethodGet, url, nil)
+	rq.RemoteAddr = remoteAddr
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, rq)
+	return rw
+}
+
+func TestParseKey(t *testing.T) {
+	for _, key := range []ratelimit.Key{ratelimit.ByClient, ratelimit.ByUser, ratelimit.ByHost} {
+		k, err := ratelimit.ParseKey(key.String())
+		require.NoError(t, err)
+		require.Equal(t, key, k)
+	}
+	_, err := ratelimit.ParseKey("path")
+	require.Error(t, err)
+}
+
+func TestLimiter_Rate(t *testing.T) {
+	var access bytes.Buffer
+	h := log.Middleware(&access, ioutil.Discard, zapcore.InfoLevel)((&ratelimit.Limiter{Rules: []ratelimit.Rule{
+		{Key: ratelimit.ByClient, Rate: 0.1, Burst: 2},
+	}}).Middleware(ok))
+
+	require.Equal(t, http.StatusOK, serve(h, "http://example.com/", "192.0.2.1:1234").Code)
+	require.Equal(t, http.StatusOK, serve(h, "http://example.com/", "192.0.2.1:5678").Code)
+	rw := serve(h, "http://example.com/", "192.0.2.1:1234")
+	require.Equal(t, http.StatusTooManyRequests, rw.Code)
+	require.Equal(t, "10", rw.Header().Get("Retry-After"))
+	require.Contains(t, access.String(), `"ratelimit":"client rate"`)
+	require.Contains(t, access.String(), `"status":429`)
+
+	// other clients have their own buckets
+	require.Equal(t, http.StatusOK, serve(h, "http://example.com/", "192.0.2.2:1234").Code)
+}
+
+func TestLimiter_Concurrency(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		finish  = make(chan struct{})
+		h       http.Handler
+	)
+	h = (&ratelimit.Limiter{Rules: []ratelimit.Rule{
+		{Key: ratelimit.ByHost, MaxConcurrent: 1},
+	}}).Middleware(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		if rq.URL.Path == "/nested" {
+			return
+		}
+		if rq.URL.Path == "/outer" {
+			// requests nested in the limited one don't count
+			nested := httptest.NewRecorder()
+			h.ServeHTTP(nested, httptest.NewRequest(http.MethodGet, rq.URL.Scheme+"://"+rq.URL.Host+"/nested", nil).
+				WithContext(rq.Context()))
+			rw.WriteHeader(nested.Code)
+			return
+		}
+		entered <- struct{}{}
+		<-finish
+	}))
+
+	done := make(chan int)
+	go func() {
+		done <- serve(h, "http://example.com/", "192.0.2.1:1234").Code
+	}()
+	<-entered
+
+	rw := serve(h, "http://Example.com/", "192.0.2.2:1234")
+	require.Equal(t, http.StatusTooManyRequests, rw.Code)
+	require.Equal(t, "1", rw.Header().Get("Retry-After"))
+	require.Equal(t, http.StatusOK, serve(h, "http://example.org/outer", "192.0.2.1:1234").Code)
+
+	close(finish)
+	require.Equal(t, http.StatusOK, <-done)
+	require.Equal(t, http.StatusOK, serve(h, "http://example.com/outer", "192.0.2.1:1234").Code)
+}
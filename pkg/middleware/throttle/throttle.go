@@ -0,0 +1,359 @@
+// Package throttle implements bandwidth throttling middleware.
+//
+// Bandwidth is limited with token buckets. Every request is subject to the global limit, the limit of its client
+// address, the limit of its authenticated user and the limit of the first host rule matching its target, traffic goes
+// as fast as all of them allow. Buckets are shared by requests of the same client, user or host rule, so concurrent
+// requests split the bandwidth between them.
+//
+// Limits apply to request and response bodies and to everything going through hijacked connections: tunnels, MITM
+// intercepted connections and upgraded connections.
+package throttle
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/time/rate"
+
+	"github.com/akabos/multiproxy/pkg/middleware/auth"
+	"github.com/akabos/multiproxy/pkg/router"
+)
+
+// DefaultMaxBuckets is the default number of per client and per user buckets kept.
+const DefaultMaxBuckets = 4096
+
+const (
+	// minBurst and maxBurst bound the bucket size, which is a tenth of second worth of traffic otherwise
+	minBurst = 1 << 10
+	maxBurst = 64 << 10
+)
+
+// Limit is the bandwidth limit in bytes per second. Zero means no limit.
+type Limit struct {
+	// Download limits data sent to the client.
+	Download int64
+
+	// Upload limits data received from the client.
+	Upload int64
+}
+
+// HostLimit is the limit of requests to target hosts matching any of the patterns.
+type HostLimit struct {
+	Hosts []*router.Pattern
+	Limit
+}
+
+// Throttle limits bandwidth of requests.
+//
+// Requests nested in the throttled one, e.g. MITM intercepted requests, are not throttled again as their traffic goes
+// through the connection which already is.
+//
+// The zero value of Throttle is a valid instance which limits nothing.
+type Throttle struct {
+	// Global limits all requests together.
+	Global Limit
+
+	// Client limits requests of each client address.
+	Client Limit
+
+	// User limits requests of each authenticated user, see auth.User. Throttle must come after auth middleware in
+	// the chain for this to work.
+	User Limit
+
+	// Hosts limit requests to target hosts, the first rule matching the target applies.
+	Hosts []HostLimit
+
+	// Latency delays every request, nested ones included, to simulate slow networks. Tunnels are delayed once, before
+	// connecting to the target.
+	Latency time.Duration
+
+	// MaxBuckets limits the number of per client and per user buckets kept, least recently used ones are dropped.
+	//
+	// If MaxBuckets is 0, DefaultMaxBuckets is used.
+	MaxBuckets int
+
+	once    sync.Once
+	global  buckets
+	hosts   []buckets
+	mux     sync.Mutex
+	clients *lru.Cache
+	users   *lru.Cache
+}
+
+func (t *Throttle) init() {
+	if t.MaxBuckets == 0 {
+		t.MaxBuckets = DefaultMaxBuckets
+	}
+	t.global = newBuckets(t.Global)
+	t.hosts = make([]buckets, len(t.Hosts))
+	for i := range t.Hosts {
+		t.hosts[i] = newBuckets(t.Hosts[i].Limit)
+	}
+	t.clients, _ = lru.New(t.MaxBuckets)
+	t.users, _ = lru.New(t.MaxBuckets)
+}
+
+type ctxKey struct{}
+
+// Middleware is the middleware constructor.
+func (t *Throttle) Middleware(next http.Handler) http.Handler {
+	t.once.Do(t.init)
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		if t.Latency > 0 {
+			timer := time.NewTimer(t.Latency)
+			select {
+			case <-timer.C:
+			case <-rq.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		if rq.Context().Value(ctxKey{}) != nil {
+			next.ServeHTTP(rw, rq)
+			return
+		}
+		download, upload := t.buckets(rq)
+		if len(download) == 0 && len(upload) == 0 {
+			next.ServeHTTP(rw, rq)
+			return
+		}
+
+		ctx := context.WithValue(rq.Context(), ctxKey{}, true)
+		rq = rq.WithContext(ctx)
+		var (
+			down = &stream{ctx: ctx, b: download}
+			up   = &stream{ctx: ctx, b: upload}
+		)
+		if rq.Body != nil && rq.Body != http.NoBody {
+			rq.Body = &body{ReadCloser: rq.Body, s: up}
+		}
+		next.ServeHTTP(&responseWriter{ResponseWriter: rw, down: down, up: up}, rq)
+	})
+}
+
+// buckets returns the buckets traffic of the request goes through in each direction.
+func (t *Throttle) buckets(rq *http.Request) (download, upload []*rate.Limiter) {
+	all := []buckets{t.global}
+	if t.Client != (Limit{}) {
+		host, _, err := net.SplitHostPort(rq.RemoteAddr)
+		if err != nil {
+			host = rq.RemoteAddr
+		}
+		all = append(all, t.keyed(t.clients, host, t.Client))
+	}
+	if user, ok := auth.User(rq); ok && t.User != (Limit{}) {
+		all = append(all, t.keyed(t.users, user, t.User))
+	}
+hosts:
+	for i := range t.Hosts {
+		for _, p := range t.Hosts[i].Hosts {
+			if p.MatchAddr(rq.URL.Host) {
+				all = append(all, t.hosts[i])
+				break hosts
+			}
+		}
+	}
+
+	for _, b := range all {
+		if b.download != nil {
+			download = append(download, b.download)
+		}
+		if b.upload != nil {
+			upload = append(upload, b.upload)
+		}
+	}
+	return download, upload
+}
+
+// keyed returns the buckets of the key, creating them if needed
+func (t *Throttle) keyed(cache *lru.Cache, key string, limit Limit) buckets {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if x, ok := cache.Get(key); ok {
+		return x.(buckets)
+	}
+	b := newBuckets(limit)
+	cache.Add(key, b)
+	return b
+}
+
+// buckets are token buckets of both directions, nil if the direction is not limited.
+type buckets struct {
+	download *rate.Limiter
+	upload   *rate.Limiter
+}
+
+func newBuckets(l Limit) buckets {
+	return buckets{download: newBucket(l.Download), upload: newBucket(l.Upload)}
+}
+
+func newBucket(bps int64) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	burst := bps / 10
+	switch {
+	case burst < minBurst:
+		burst = minBurst
+	case burst > maxBurst:
+		burst = maxBurst
+	}
+	return rate.NewLimiter(rate.Limit(bps), int(burst))
+}
+
+// stream is traffic in one direction, it's passed in chunks no bigger than the smallest of the buckets.
+type stream struct {
+	ctx context.Context
+	b   []*rate.Limiter
+}
+
+func (s *stream) chunk(n int) int {
+	for _, b := range s.b {
+		if b.Burst() < n {
+			n = b.Burst()
+		}
+	}
+	return n
+}
+
+func (s *stream) wait(n int) error {
+	for _, b := range s.b {
+		if err := b.WaitN(s.ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read reads into p, then waits for the buckets to allow the bytes read
+func (s *stream) read(r io.Reader, p []byte) (int, error) {
+	n, err := r.Read(p[:s.chunk(len(p))])
+	if n > 0 {
+		if werr := s.wait(n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// write waits for the buckets to allow each chunk of p, then writes it
+func (s *stream) write(w io.Writer, p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := s.chunk(len(p))
+		if err := s.wait(n); err != nil {
+			return written, err
+		}
+		n, err := w.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// reader throttles the reader
+type reader struct {
+	r io.Reader
+	s *stream
+}
+
+// Read implements io.Reader interface
+func (r *reader) Read(p []byte) (int, error) {
+	return r.s.read(r.r, p)
+}
+
+// body throttles request body
+type body struct {
+	io.ReadCloser
+	s *stream
+}
+
+// Read implements io.Reader interface
+func (b *body) Read(p []byte) (int, error) {
+	return b.s.read(b.ReadCloser, p)
+}
+
+// responseWriter throttles response body and hijacked connection.
+type responseWriter struct {
+	http.ResponseWriter
+	down *stream
+	up   *stream
+}
+
+// Write implements http.ResponseWriter interface
+func (w *responseWriter) Write(p []byte) (int, error) {
+	return w.down.write(w.ResponseWriter, p)
+}
+
+// Flush implements http.Flusher interface
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker interface. Everything going through the hijacked connection is throttled.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying http.ResponseWriter doesn't implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &throttledConn{Conn: conn, down: w.down, up: w.up}
+	// whatever the client sent ahead is buffered in brw, it's throttled when read from there
+	r := bufio.NewReader(&reader{r: brw.Reader, s: w.up})
+	return c, bufio.NewReadWriter(r, bufio.NewWriter(c)), nil
+}
+
+// Unwrap returns the underlying http.ResponseWriter, see http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type throttledConn struct {
+	net.Conn
+	down *stream
+	up   *stream
+}
+
+// Read implements net.Conn interface
+func (c *throttledConn) Read(p []byte) (int, error) {
+	return c.up.read(c.Conn, p)
+}
+
+// Write implements net.Conn interface
+func (c *throttledConn) Write(p []byte) (int, error) {
+	return c.down.write(c.Conn, p)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, so tunnels could pass half-close on.
+func (c *throttledConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("underlying net.Conn doesn't support half-close")
+}
+
+// ReadFrom implements io.ReaderFrom interface, so bufio.Writer passes data through as it's read instead of holding it
+// until the buffer is full, which would stall interactive protocols.
+func (c *throttledConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{c}, r)
+}
+
+// writerOnly hides io.ReaderFrom of the writer, so io.Copy doesn't loop back into it
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,169 @@
+package throttle_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/middleware/throttle"
+	"github.com/akabos/multiproxy/pkg/router"
+)
+
+const size = 16 << 10
+
+// payload responds with size bytes and consumes request body
+var payload = http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+	_, _ = ioutil.ReadAll(rq.Body)
+	_, _ = rw.Write(make([]byte, size))
+})
+
+// serve serves the request from the address and returns how long it took
+func serve(h http.Handler, url, remoteAddr string, body []byte) time.Duration {
+	rq := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	rq.RemoteAddr = remoteAddr
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(rw, rq)
+	return time.Since(start)
+}
+
+func TestThrottle_Download(t *testing.T) {
+	h := (&throttle.Throttle{Global: throttle.Limit{Download: 20 << 10}}).Middleware(payload)
+	// 2KiB burst, the rest goes at 20KiB/s
+	d := serve(h, "http://example.com/", "192.0.2.1:1234", nil)
+	require.True(t, d > 600*time.Millisecond, d)
+	require.True(t, d < 2*time.Second, d)
+}
+
+func TestThrottle_Upload(t *testing.T) {
+	h := (&throttle.Throttle{Global: throttle.Limit{Upload: 20 << 10}}).Middleware(payload)
+	d := serve(h, "http://example.com/", "192.0.2.1:1234", make([]byte, size))
+	require.True(t, d > 600*time.Millisecond, d)
+	require.True(t, d < 2*time.Second, d)
+}
+
+func TestThrottle_Client(t *testing.T) {
+	concurrently := func(h http.Handler, addrs ...string) time.Duration {
+		var wg sync.WaitGroup
+		start := time.Now()
+		for _, addr := range addrs {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				serve(h, "http://example.com/", addr, nil)
+			}(addr)
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+	h := (&throttle.Throttle{Client: throttle.Limit{Download: 20 << 10}}).Middleware(payload)
+
+	// clients have their own buckets, requests of the same client share one
+	d := concurrently(h, "192.0.2.1:1234", "192.0.2.2:1234")
+	require.True(t, d < 1100*time.Millisecond, d)
+	d = concurrently(h, "192.0.2.3:1234", "192.0.2.3:5678")
+	require.True(t, d > 1100*time.Millisecond, d)
+}
+
+func TestThrottle_Hosts(t *testing.T) {
+	h := (&throttle.Throttle{Hosts: []throttle.HostLimit{{
+		Hosts: []*router.Pattern{router.MustParsePattern(".example.com")},
+		Limit: throttle.Limit{Download: 20 << 10},
+	}}}).Middleware(payload)
+
+	d := serve(h, "http://example.org/", "192.0.2.1:1234", nil)
+	require.True(t, d < 300*time.Millisecond, d)
+	d = serve(h, "http://www.example.com/", "192.0.2.1:1234", nil)
+	require.True(t, d > 600*time.Millisecond, d)
+}
+
+func TestThrottle_Latency(t *testing.T) {
+	h := (&throttle.Throttle{Latency: 200 * time.Millisecond}).Middleware(payload)
+	d := serve(h, "http://example.com/", "192.0.2.1:1234", nil)
+	require.True(t, d >= 200*time.Millisecond, d)
+}
+
+func TestThrottle_Tunnel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write(make([]byte, size))
+	}()
+
+	p := httptest.NewServer((&throttle.Throttle{Global: throttle.Limit{Download: 20 << 10}}).Middleware(&handlers.Tunnel{}))
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	addr := l.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	rs, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rs.StatusCode)
+
+	start := time.Now()
+	b, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	require.Len(t, b, size)
+	require.True(t, time.Since(start) > 500*time.Millisecond, time.Since(start))
+}
+
+func TestThrottle_TunnelInteractive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	p := httptest.NewServer((&throttle.Throttle{Global: throttle.Limit{Download: 1 << 20, Upload: 1 << 20}}).
+		Middleware(&handlers.Tunnel{}))
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	addr := l.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	rs, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rs.StatusCode)
+
+	// small writes are echoed back at once, they are not held until the buffers fill up
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	for _, msg := range []string{"ping", "pong"} {
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+		b := make([]byte, len(msg))
+		_, err = io.ReadFull(br, b)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b))
+	}
+}
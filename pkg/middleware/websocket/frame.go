@@ -0,0 +1,226 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Opcode is WebSocket frame opcode, see RFC 6455 section 5.2.
+type Opcode byte
+
+// Opcodes defined by RFC 6455
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xa
+)
+
+var opcodeNames = map[Opcode]string{
+	OpContinuation: "continuation",
+	OpText:         "text",
+	OpBinary:       "binary",
+	OpClose:        "close",
+	OpPing:         "ping",
+	OpPong:         "pong",
+}
+
+// String implements fmt.Stringer interface
+func (o Opcode) String() string {
+	if name, ok := opcodeNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("Opcode(%d)", byte(o))
+}
+
+// IsControl reports whether the opcode is of a control frame.
+func (o Opcode) IsControl() bool {
+	return o&0x8 != 0
+}
+
+// Message is a data message reassembled from its fragments, or a control frame.
+type Message struct {
+	// FromClient is true for messages sent by the client and false for the ones sent by the server.
+	FromClient bool
+
+	// Opcode is the opcode of the message's first frame.
+	Opcode Opcode
+
+	// Compressed is the RSV1 bit of the message's first frame which is set by permessage-deflate extension (RFC 7692).
+	// Payload of compressed messages is left as is.
+	Compressed bool
+
+	// Length is the payload length.
+	Length int64
+
+	// Payload is the unmasked payload, truncated to Inspector.MaxPayload bytes.
+	Payload []byte
+}
+
+// decoder reassembles messages from a stream of frames written into it. Decoding stops at the first malformed frame,
+// Write never fails though, so the decoder could tee a connection without affecting it.
+type decoder struct {
+	fromClient bool
+	maxPayload int
+	emit       func(*Message)
+	fail       func(error)
+
+	err       error
+	hdr       []byte
+	inPayload bool
+	remaining int64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	fin       bool
+	cur       *Message // message the current frame belongs to
+	msg       *Message // fragmented data message being reassembled
+}
+
+// frameHeaderLen returns the length of frame header which starts with the two bytes
+func frameHeaderLen(b0, b1 byte) int {
+	n := 2
+	switch b1 & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if b1&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+// Write implements io.Writer interface
+func (d *decoder) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && d.err == nil {
+		if !d.inPayload {
+			want := 2
+			if len(d.hdr) >= 2 {
+				want = frameHeaderLen(d.hdr[0], d.hdr[1])
+			}
+			k := min(want-len(d.hdr), len(p))
+			d.hdr = append(d.hdr, p[:k]...)
+			p = p[k:]
+			if len(d.hdr) < 2 || len(d.hdr) < frameHeaderLen(d.hdr[0], d.hdr[1]) {
+				continue
+			}
+			if err := d.startFrame(); err != nil {
+				d.err = err
+				if d.fail != nil {
+					d.fail(err)
+				}
+				break
+			}
+			if d.remaining == 0 {
+				d.endFrame()
+			}
+			continue
+		}
+
+		k := len(p)
+		if int64(k) > d.remaining {
+			k = int(d.remaining)
+		}
+		d.payload(p[:k])
+		p = p[k:]
+		d.remaining -= int64(k)
+		if d.remaining == 0 {
+			d.endFrame()
+		}
+	}
+	return n, nil
+}
+
+// startFrame parses the frame header collected in hdr.
+func (d *decoder) startFrame() error {
+	b0, b1 := d.hdr[0], d.hdr[1]
+	rest := d.hdr[2:]
+	defer func() { d.hdr = d.hdr[:0] }()
+
+	var length int64
+	switch l := b1 & 0x7f; l {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		u := binary.BigEndian.Uint64(rest)
+		if u>>63 != 0 {
+			return errors.New("invalid payload length")
+		}
+		length = int64(u)
+		rest = rest[8:]
+	default:
+		length = int64(l)
+	}
+	d.masked = b1&0x80 != 0
+	if d.masked {
+		copy(d.mask[:], rest)
+	}
+
+	op := Opcode(b0 & 0x0f)
+	d.fin = b0&0x80 != 0
+	switch {
+	case op.IsControl():
+		if !d.fin || length > 125 {
+			return fmt.Errorf("invalid %s frame", op)
+		}
+		d.cur = &Message{FromClient: d.fromClient, Opcode: op, Length: length}
+	case op == OpContinuation:
+		if d.msg == nil {
+			return errors.New("unexpected continuation frame")
+		}
+		d.cur = d.msg
+		d.cur.Length += length
+	case op == OpText, op == OpBinary:
+		if d.msg != nil {
+			return fmt.Errorf("%s frame interrupts fragmented message", op)
+		}
+		d.msg = &Message{FromClient: d.fromClient, Opcode: op, Compressed: b0&0x40 != 0, Length: length}
+		d.cur = d.msg
+	default:
+		return fmt.Errorf("unknown opcode %d", byte(op))
+	}
+	d.inPayload = true
+	d.remaining = length
+	d.maskPos = 0
+	return nil
+}
+
+// payload appends payload bytes of the current frame to the message, as many as fit into maxPayload.
+func (d *decoder) payload(p []byte) {
+	keep := min(d.maxPayload-len(d.cur.Payload), len(p))
+	for i := 0; i < keep; i++ {
+		b := p[i]
+		if d.masked {
+			b ^= d.mask[(d.maskPos+i)%4]
+		}
+		d.cur.Payload = append(d.cur.Payload, b)
+	}
+	d.maskPos += len(p)
+}
+
+// endFrame emits the message if the current frame completes it.
+func (d *decoder) endFrame() {
+	d.inPayload = false
+	switch {
+	case d.cur.Opcode.IsControl():
+		d.emit(d.cur)
+	case d.fin:
+		d.emit(d.msg)
+		d.msg = nil
+	}
+	d.cur = nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,112 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// frame encodes a frame, masking the payload if the key is given
+func frame(fin bool, op Opcode, payload []byte, key []byte) []byte {
+	var b bytes.Buffer
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	b.WriteByte(b0)
+	var b1 byte
+	if key != nil {
+		b1 = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b.WriteByte(b1 | byte(n))
+	case n <= 0xffff:
+		b.WriteByte(b1 | 126)
+		_ = binary.Write(&b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(b1 | 127)
+		_ = binary.Write(&b, binary.BigEndian, uint64(n))
+	}
+	if key == nil {
+		b.Write(payload)
+		return b.Bytes()
+	}
+	b.Write(key)
+	for i, c := range payload {
+		b.WriteByte(c ^ key[i%4])
+	}
+	return b.Bytes()
+}
+
+func TestDecoder(t *testing.T) {
+	var (
+		key  = []byte{1, 2, 3, 4}
+		long = bytes.Repeat([]byte("x"), 70000)
+	)
+	var stream []byte
+	stream = append(stream, frame(true, OpText, []byte("hello"), key)...)
+	stream = append(stream, frame(false, OpText, []byte("frag"), key)...)
+	stream = append(stream, frame(true, OpPing, []byte("p"), key)...)
+	stream = append(stream, frame(false, OpContinuation, []byte("men"), key)...)
+	stream = append(stream, frame(true, OpContinuation, []byte("ted"), key)...)
+	stream = append(stream, frame(true, OpBinary, long, nil)...)
+	stream = append(stream, frame(true, OpBinary, make([]byte, 300), key)...)
+	stream = append(stream, frame(true, OpClose, []byte{0x03, 0xe8}, key)...)
+
+	expected := []Message{
+		{FromClient: true, Opcode: OpText, Length: 5, Payload: []byte("hello")},
+		{FromClient: true, Opcode: OpPing, Length: 1, Payload: []byte("p")},
+		{FromClient: true, Opcode: OpText, Length: 10, Payload: []byte("fragmented")},
+		{FromClient: true, Opcode: OpBinary, Length: 70000, Payload: long[:16]},
+		{FromClient: true, Opcode: OpBinary, Length: 300, Payload: make([]byte, 16)},
+		{FromClient: true, Opcode: OpClose, Length: 2, Payload: []byte{0x03, 0xe8}},
+	}
+
+	// the stream is decoded the same regardless of how it's split
+	for _, chunk := range []int{1, 3, 100, len(stream)} {
+		var messages []Message
+		d := &decoder{fromClient: true, maxPayload: 16, emit: func(m *Message) {
+			messages = append(messages, *m)
+		}}
+		for p := stream; len(p) > 0; {
+			n := min(chunk, len(p))
+			w, err := d.Write(p[:n])
+			require.NoError(t, err)
+			require.Equal(t, n, w)
+			p = p[n:]
+		}
+		require.NoError(t, d.err)
+		require.Equal(t, expected, messages, chunk)
+	}
+}
+
+func TestDecoder_Compressed(t *testing.T) {
+	var messages []Message
+	d := &decoder{emit: func(m *Message) { messages = append(messages, *m) }}
+	f := frame(true, OpText, []byte("zz"), nil)
+	f[0] |= 0x40
+	_, _ = d.Write(f)
+	require.Equal(t, []Message{{Opcode: OpText, Compressed: true, Length: 2}}, messages)
+}
+
+func TestDecoder_Malformed(t *testing.T) {
+	for name, stream := range map[string][]byte{
+		"continuation":    frame(true, OpContinuation, []byte("x"), nil),
+		"interrupted":     append(frame(false, OpText, []byte("x"), nil), frame(true, OpBinary, nil, nil)...),
+		"fragmented ping": frame(false, OpPing, nil, nil),
+		"long ping":       frame(true, OpPing, make([]byte, 126), nil),
+		"unknown opcode":  frame(true, Opcode(0x3), nil, nil),
+		"invalid length":  {0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0},
+		"after http head": []byte("HTTP/1.1 101 Switching Protocols\r\n\r\n"),
+	} {
+		var failed error
+		d := &decoder{emit: func(*Message) {}, fail: func(err error) { failed = err }}
+		n, err := d.Write(append(stream, frame(true, OpText, []byte("lost"), nil)...))
+		require.NoError(t, err, name)
+		require.Equal(t, len(stream)+6, n, name)
+		require.Error(t, failed, name)
+	}
+}
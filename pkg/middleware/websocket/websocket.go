@@ -0,0 +1,164 @@
+// Package websocket implements middleware decoding WebSocket messages of upgraded connections, so they could be logged
+// and inspected the way HTTP requests are.
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/akabos/multiproxy/pkg/middleware/log"
+)
+
+// Inspector decodes WebSocket frames passing through connections hijacked by the next handler in response to WebSocket
+// upgrade requests, e.g. by HTTPHandler forwarding 101 Switching Protocols. Traffic is only observed, never modified,
+// and malformed frames stop decoding, not the connection.
+//
+// Zero value is a valid instance which logs message types and lengths.
+type Inspector struct {
+	// OnMessage is called for every message with the upgrade request. Messages sent in the same direction are reported
+	// in order, messages of different directions are reported concurrently.
+	//
+	// If OnMessage is nil, messages are logged with log.Info, payload of text messages is logged if MaxPayload allows.
+	OnMessage func(rq *http.Request, m *Message)
+
+	// MaxPayload specifies how many bytes of the payload are kept in Message. Zero keeps none.
+	MaxPayload int
+
+	once sync.Once
+}
+
+func (i *Inspector) init() {
+	if i.OnMessage == nil {
+		i.OnMessage = logMessage
+	}
+}
+
+// Middleware is a middleware constructor.
+func (i *Inspector) Middleware(next http.Handler) http.Handler {
+	i.once.Do(i.init)
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		if !IsUpgrade(rq) {
+			next.ServeHTTP(rw, rq)
+			return
+		}
+		next.ServeHTTP(&responseWriter{ResponseWriter: rw, i: i, rq: rq}, rq)
+	})
+}
+
+// IsUpgrade reports whether the request asks to upgrade connection to WebSocket.
+func IsUpgrade(rq *http.Request) bool {
+	return headerContains(rq.Header, "Connection", "upgrade") && headerContains(rq.Header, "Upgrade", "websocket")
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, item := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// from names the side a message comes from
+func from(fromClient bool) string {
+	if fromClient {
+		return "client"
+	}
+	return "server"
+}
+
+func logMessage(rq *http.Request, m *Message) {
+	fields := []zap.Field{
+		zap.String("from", from(m.FromClient)),
+		zap.Stringer("opcode", m.Opcode),
+		zap.Int64("length", m.Length),
+	}
+	if m.Compressed {
+		fields = append(fields, zap.Bool("compressed", true))
+	}
+	switch {
+	case m.Opcode == OpClose && len(m.Payload) >= 2:
+		fields = append(fields, zap.Uint16("code", binary.BigEndian.Uint16(m.Payload)))
+	case m.Opcode == OpText && !m.Compressed && len(m.Payload) > 0 && utf8.Valid(m.Payload):
+		fields = append(fields, zap.ByteString("payload", m.Payload))
+	}
+	log.Info(rq, "websocket message", fields...)
+}
+
+// responseWriter tees hijacked connection into frame decoders.
+type responseWriter struct {
+	http.ResponseWriter
+	i  *Inspector
+	rq *http.Request
+}
+
+// Flush implements http.Flusher interface
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker interface. Only data going through the returned connection is decoded, data
+// written into the returned buffer is not, that's where the 101 response head goes.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying http.ResponseWriter doesn't implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &teeConn{Conn: conn, in: w.decoder(true), out: w.decoder(false)}
+	return c, brw, nil
+}
+
+// Unwrap returns the underlying http.ResponseWriter, see http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseWriter) decoder(fromClient bool) *decoder {
+	return &decoder{
+		fromClient: fromClient,
+		maxPayload: w.i.MaxPayload,
+		emit: func(m *Message) {
+			w.i.OnMessage(w.rq, m)
+		},
+		fail: func(err error) {
+			log.Debug(w.rq, "websocket decoding stopped", zap.String("from", from(fromClient)), zap.Error(err))
+		},
+	}
+}
+
+// teeConn decodes data read from the client and written to the client.
+type teeConn struct {
+	net.Conn
+	in  *decoder
+	out *decoder
+}
+
+// Read implements net.Conn interface
+func (c *teeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	_, _ = c.in.Write(p[:n])
+	return n, err
+}
+
+// Write implements net.Conn interface
+func (c *teeConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	_, _ = c.out.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,116 @@
+package websocket_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/middleware/websocket"
+)
+
+func TestIsUpgrade(t *testing.T) {
+	rq := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	require.False(t, websocket.IsUpgrade(rq))
+	rq.Header.Set("Connection", "keep-alive, Upgrade")
+	rq.Header.Set("Upgrade", "h2c")
+	require.False(t, websocket.IsUpgrade(rq))
+	rq.Header.Set("Upgrade", "WebSocket")
+	require.True(t, websocket.IsUpgrade(rq))
+}
+
+func TestInspector(t *testing.T) {
+	// the target server echoes whatever it gets after switching protocols
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		conn, bufrw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		_ = bufrw.Flush()
+		_, _ = io.CopyN(bufrw, bufrw, 19)
+		_ = bufrw.Flush()
+	}))
+	defer upstream.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+
+	var (
+		mux       sync.Mutex
+		messages  []websocket.Message
+		inspector = &websocket.Inspector{
+			MaxPayload: 3,
+			OnMessage: func(rq *http.Request, m *websocket.Message) {
+				mux.Lock()
+				defer mux.Unlock()
+				messages = append(messages, *m)
+			},
+		}
+		p = httptest.NewServer(&handlers.MITMHandler{
+			Handler: inspector.Middleware(&handlers.HTTPHandler{
+				Transport: &handlers.VerifyingTransport{RootCAs: roots},
+			}),
+		})
+	)
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	addr := upstream.Listener.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	require.NoError(t, err)
+	rs, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rs.StatusCode)
+
+	tlsconn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	_, err = fmt.Fprintf(tlsconn, "GET /ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", addr)
+	require.NoError(t, err)
+	br := bufio.NewReader(tlsconn)
+	rs, err = http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, rs.StatusCode)
+
+	// masked "hello" text frame and close frame with status 1000
+	frames := []byte{
+		0x81, 0x85, 1, 2, 3, 4, 'h' ^ 1, 'e' ^ 2, 'l' ^ 3, 'l' ^ 4, 'o' ^ 1,
+		0x88, 0x82, 0, 0, 0, 0, 0x03, 0xe8,
+	}
+	_, err = tlsconn.Write(frames)
+	require.NoError(t, err)
+	echo := make([]byte, len(frames))
+	_, err = io.ReadFull(br, echo)
+	require.NoError(t, err)
+	require.Equal(t, frames, echo)
+
+	require.Eventually(t, func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(messages) == 4
+	}, time.Second, 10*time.Millisecond)
+	for _, fromClient := range []bool{true, false} {
+		var got []websocket.Message
+		for _, m := range messages {
+			if m.FromClient == fromClient {
+				got = append(got, m)
+			}
+		}
+		require.Equal(t, []websocket.Message{
+			{FromClient: fromClient, Opcode: websocket.OpText, Length: 5, Payload: []byte("hel")},
+			{FromClient: fromClient, Opcode: websocket.OpClose, Length: 2, Payload: []byte{0x03, 0xe8}},
+		}, got)
+	}
+}
@@ -0,0 +1,136 @@
+package router
+
+import (
+	"net"
+	"strings"
+)
+
+// hostIndex finds the first added pattern matching the target without scanning all of them. Name patterns are kept in
+// a trie of reversed labels, IP patterns in binary radix trees, globs and regular expressions are scanned linearly.
+//
+// The zero value of hostIndex is an empty index.
+type hostIndex struct {
+	patterns []*Pattern
+	names    labelNode
+	ip4      bitNode
+	ip6      bitNode
+	other    []int
+}
+
+type labelNode struct {
+	children map[string]*labelNode
+	exact    []int // patterns matching the name exactly
+	suffix   []int // patterns matching the name and its subdomains
+	sub      []int // patterns matching subdomains only
+}
+
+type bitNode struct {
+	children [2]*bitNode
+	patterns []int
+}
+
+// add appends the pattern to the index. Patterns added earlier take precedence.
+func (x *hostIndex) add(p *Pattern) {
+	i := len(x.patterns)
+	x.patterns = append(x.patterns, p)
+
+	switch p.kind {
+	case patternExact, patternSuffix, patternSubdomains:
+		n := &x.names
+		labels := strings.Split(p.host, ".")
+		for j := len(labels) - 1; j >= 0; j-- {
+			if n.children == nil {
+				n.children = make(map[string]*labelNode)
+			}
+			child, ok := n.children[labels[j]]
+			if !ok {
+				child = &labelNode{}
+				n.children[labels[j]] = child
+			}
+			n = child
+		}
+		switch p.kind {
+		case patternExact:
+			n.exact = append(n.exact, i)
+		case patternSuffix:
+			n.suffix = append(n.suffix, i)
+		default:
+			n.sub = append(n.sub, i)
+		}
+	case patternNet:
+		n := &x.ip6
+		if len(p.net.IP) == net.IPv4len {
+			n = &x.ip4
+		}
+		ones, _ := p.net.Mask.Size()
+		for b := 0; b < ones; b++ {
+			bit := p.net.IP[b/8] >> (7 - b%8) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &bitNode{}
+			}
+			n = n.children[bit]
+		}
+		n.patterns = append(n.patterns, i)
+	default:
+		x.other = append(x.other, i)
+	}
+}
+
+// lookup returns position of the first added pattern matching the target and accepted by the filter, or -1. Nil filter
+// accepts any pattern.
+func (x *hostIndex) lookup(hostname string, port int, accept func(int) bool) int {
+	hostname = normalizeHost(hostname)
+	best := -1
+	consider := func(candidates []int) {
+		for _, i := range candidates {
+			if best >= 0 && i >= best {
+				return
+			}
+			if pp := x.patterns[i].port; (pp == 0 || pp == port) && (accept == nil || accept(i)) {
+				best = i
+				return
+			}
+		}
+	}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		n := &x.ip6
+		if ip4 := ip.To4(); ip4 != nil {
+			n, ip = &x.ip4, ip4
+		}
+		for b := 0; n != nil; b++ {
+			consider(n.patterns)
+			if b == len(ip)*8 {
+				break
+			}
+			n = n.children[ip[b/8]>>(7-b%8)&1]
+		}
+	} else {
+		n := &x.names
+		labels := strings.Split(hostname, ".")
+		for j := len(labels) - 1; j >= 0; j-- {
+			n = n.children[labels[j]]
+			if n == nil {
+				break
+			}
+			if j == 0 {
+				consider(n.exact)
+				consider(n.suffix)
+			} else {
+				consider(n.suffix)
+				consider(n.sub)
+			}
+		}
+	}
+
+	for _, i := range x.other {
+		if best >= 0 && i >= best {
+			break
+		}
+		if x.patterns[i].Match(hostname, port) && (accept == nil || accept(i)) {
+			best = i
+			break
+		}
+	}
+	return best
+}
@@ -0,0 +1,125 @@
+package router
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostIndex(t *testing.T) {
+	var x hostIndex
+	for _, s := range []string{
+		"www.example.com:8080",
+		".example.com",
+		"www.example.com",
+		"*.example.org",
+		"api-*.example.net",
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"[fd00::]/8",
+		"*:8443",
+	} {
+		x.add(MustParsePattern(s))
+	}
+
+	for _, tc := range []struct {
+		hostname string
+		port     int
+		expected int
+	}{
+		{"www.example.com", 8080, 0},
+		{"www.example.com", 80, 1},
+		{"example.com", 80, 1},
+		{"WWW.Example.COM.", 80, 1},
+		{"example.org", 80, -1},
+		{"a.b.example.org", 80, 3},
+		{"api-1.example.net", 80, 4},
+		{"api-1.example.net", 8443, 4},
+		{"10.1.2.3", 443, 5},
+		{"fd00::1", 443, 7},
+		{"192.168.0.1", 8443, 8},
+		{"192.168.0.1", 443, -1},
+	} {
+		require.Equal(t, tc.expected, x.lookup(tc.hostname, tc.port, nil), tc)
+	}
+
+	t.Run("filter", func(t *testing.T) {
+		require.Equal(t, 2, x.lookup("www.example.com", 80, func(i int) bool { return i != 1 }))
+		require.Equal(t, 6, x.lookup("10.1.2.3", 80, func(i int) bool { return i != 5 }))
+		require.Equal(t, -1, x.lookup("10.1.2.3", 80, func(i int) bool { return false }))
+	})
+}
+
+// TestHostIndex_Linear checks the index against plain linear scan on a large random rule set.
+func TestHostIndex_Linear(t *testing.T) {
+	var (
+		rnd      = rand.New(rand.NewSource(1))
+		x        hostIndex
+		patterns []*Pattern
+	)
+	name := func() string {
+		return fmt.Sprintf("h%d.d%d.example", rnd.Intn(20), rnd.Intn(50))
+	}
+	ip := func() string {
+		return fmt.Sprintf("10.%d.%d.%d", rnd.Intn(4), rnd.Intn(4), rnd.Intn(256))
+	}
+	for i := 0; i < 5000; i++ {
+		var s string
+		switch rnd.Intn(7) {
+		case 0:
+			s = name()
+		case 1:
+			s = "." + name()[4:]
+		case 2:
+			s = "*." + name()[4:]
+		case 3:
+			s = fmt.Sprintf("%s:%d", name(), 80+rnd.Intn(2))
+		case 4:
+			s = ip()
+		case 5:
+			s = fmt.Sprintf("%s/%d", ip(), 8+rnd.Intn(25))
+		case 6:
+			s = fmt.Sprintf("h%d-*.d%d.example", rnd.Intn(20), rnd.Intn(50))
+		}
+		p := MustParsePattern(s)
+		patterns = append(patterns, p)
+		x.add(p)
+	}
+
+	for i := 0; i < 5000; i++ {
+		var hostname string
+		switch rnd.Intn(3) {
+		case 0:
+			hostname = name()
+		case 1:
+			hostname = "x." + name()
+		default:
+			hostname = ip()
+		}
+		port := 80 + rnd.Intn(2)
+
+		expected := -1
+		for j, p := range patterns {
+			if p.Match(hostname, port) {
+				expected = j
+				break
+			}
+		}
+		require.Equal(t, expected, x.lookup(hostname, port, nil), "%s:%d", hostname, port)
+	}
+}
+
+func BenchmarkHostIndex(b *testing.B) {
+	var x hostIndex
+	for i := 0; i < 10000; i++ {
+		x.add(MustParsePattern(fmt.Sprintf(".d%d.example", i)))
+		x.add(MustParsePattern(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.lookup("www.d9999.example", 443, nil)
+		x.lookup("10.39.15.1", 443, nil)
+	}
+}
@@ -0,0 +1,205 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type patternKind int
+
+const (
+	patternAny        patternKind = iota // `*`
+	patternExact                         // `example.com`
+	patternSuffix                        // `.example.com`
+	patternSubdomains                    // `*.example.com`
+	patternGlob                          // `api-*.example.com`
+	patternRegexp                        // `~^api-[0-9]+\.example\.com$`
+	patternNet                           // `10.0.0.0/8`, `127.0.0.1`
+)
+
+// Pattern is a parsed target host pattern.
+//
+// Host specification:
+//  - `*` matches any host
+//  - `example.com` matches exactly the host name
+//  - `.example.com` matches both `example.com` and all of it's subdomains
+//  - `*.example.com` matches subdomains of `example.com` of any depth, but not `example.com` itself
+//  - `api-*.example.com` is a glob, `*` matches any part of a single label
+//  - `~^api-[0-9]+\.example\.com$` is a regular expression, it's matched against the whole host name
+//  - `127.0.0.1` and `::1` match exactly the IP address
+//  - `10.0.0.0/8` and `[::1]/128` match IP addresses within the network
+//
+// Any host specification but regular expression may be followed by `:port`, then the pattern only matches targets with
+// that port. IPv6 addresses must be enclosed in brackets to be followed by port, e.g. `[::1]:443`. `*:8443` matches any
+// host with port 8443.
+//
+// Host names are matched case-insensitively, trailing dot is ignored.
+type Pattern struct {
+	raw  string
+	kind patternKind
+	host string
+	re   *regexp.Regexp
+	net  *net.IPNet
+	port int
+}
+
+// ParsePattern parses target host pattern. See Pattern for the syntax.
+func ParsePattern(s string) (*Pattern, error) {
+	p := &Pattern{raw: s}
+	if strings.HasPrefix(s, "~") {
+		re, err := regexp.Compile(s[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", s, err)
+		}
+		p.kind, p.re = patternRegexp, re
+		return p, nil
+	}
+
+	host, port, err := splitPatternPort(s)
+	if err != nil {
+		return nil, err
+	}
+	if port != "" && port != "*" {
+		p.port, err = strconv.Atoi(port)
+		if err != nil || p.port <= 0 || p.port > 65535 {
+			return nil, fmt.Errorf("invalid port in host pattern %q", s)
+		}
+	}
+
+	host = normalizeHost(host)
+	switch {
+	case host == "*":
+		p.kind = patternAny
+	case strings.IndexByte(host, '/') >= 0:
+		_, n, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network in host pattern %q: %w", s, err)
+		}
+		p.kind, p.net = patternNet, n
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := net.IPv6len * 8
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, net.IPv4len*8
+		}
+		p.kind, p.net = patternNet, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(host, ".") && strings.IndexByte(host, '*') < 0:
+		p.kind, p.host = patternSuffix, host[1:]
+	case strings.HasPrefix(host, "*.") && strings.IndexByte(host[2:], '*') < 0:
+		p.kind, p.host = patternSubdomains, host[2:]
+	case strings.IndexByte(host, '*') >= 0:
+		p.kind, p.re = patternGlob, globRegexp(host)
+	case host == "":
+		return nil, fmt.Errorf("empty host pattern %q", s)
+	default:
+		p.kind, p.host = patternExact, host
+	}
+	return p, nil
+}
+
+// MustParsePattern is like ParsePattern but panics if the pattern cannot be parsed.
+func MustParsePattern(s string) *Pattern {
+	p, err := ParsePattern(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// splitPatternPort splits pattern into host and port parts. Brackets around IPv6 addresses are removed.
+func splitPatternPort(s string) (string, string, error) {
+	if strings.HasPrefix(s, "[") {
+		i := strings.IndexByte(s, ']')
+		if i < 0 {
+			return "", "", fmt.Errorf("missing ']' in host pattern %q", s)
+		}
+		host, rest := s[1:i], s[i+1:]
+		if strings.HasPrefix(rest, "/") {
+			j := strings.IndexByte(rest, ':')
+			if j < 0 {
+				j = len(rest)
+			}
+			host, rest = host+rest[:j], rest[j:]
+		}
+		switch {
+		case rest == "":
+			return host, "", nil
+		case strings.HasPrefix(rest, ":"):
+			return host, rest[1:], nil
+		default:
+			return "", "", fmt.Errorf("unexpected %q after ']' in host pattern %q", rest, s)
+		}
+	}
+	if strings.Count(s, ":") != 1 {
+		// either no port or bare IPv6 address
+		return s, "", nil
+	}
+	i := strings.IndexByte(s, ':')
+	return s[:i], s[i+1:], nil
+}
+
+// globRegexp converts glob into anchored regular expression. `*` doesn't match across labels.
+func globRegexp(glob string) *regexp.Regexp {
+	parts := strings.Split(glob, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.MustCompile(`^` + strings.Join(parts, `[^.]*`) + `$`)
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// String returns the source text of the pattern.
+func (p *Pattern) String() string {
+	return p.raw
+}
+
+// Match reports whether the target host and port match the pattern. Zero port means the port is unknown, such targets
+// don't match patterns with port.
+func (p *Pattern) Match(hostname string, port int) bool {
+	if p.port != 0 && p.port != port {
+		return false
+	}
+	hostname = normalizeHost(hostname)
+	switch p.kind {
+	case patternAny:
+		return true
+	case patternExact:
+		return hostname == p.host
+	case patternSuffix:
+		return hostname == p.host || strings.HasSuffix(hostname, "."+p.host)
+	case patternSubdomains:
+		return strings.HasSuffix(hostname, "."+p.host)
+	case patternGlob, patternRegexp:
+		return p.re.MatchString(hostname)
+	case patternNet:
+		ip := net.ParseIP(hostname)
+		return ip != nil && p.net.Contains(ip)
+	default:
+		return false
+	}
+}
+
+// MatchAddr reports whether the target address matches the pattern. The address is either `host:port` or just host.
+func (p *Pattern) MatchAddr(addr string) bool {
+	hostname, port := SplitAddr(addr)
+	return p.Match(hostname, port)
+}
+
+// SplitAddr splits `host:port` address into host name and port. Port is zero if the address has no valid port.
+func SplitAddr(addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.Trim(addr, "[]"), 0
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return host, 0
+	}
+	return host, n
+}
@@ -0,0 +1,65 @@
+package router_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/akabos/multiproxy/pkg/router"
+)
+
+func TestPattern_Match(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		match   []string
+		nomatch []string
+	}{
+		{"*", []string{"example.com", "127.0.0.1:80", "[::1]:443"}, nil},
+		{"example.com", []string{"example.com"}, []string{"www.example.com", "example.net"}},
+		{"Example.COM.", []string{"example.com", "EXAMPLE.com.", "example.com:443"}, []string{"www.example.com", "example.net"}},
+		{".example.com", []string{"example.com", "www.example.com", "a.b.example.com:80"}, []string{"myexample.com", "example.net"}},
+		{"*.corp.example", []string{"www.corp.example", "a.b.corp.example"}, []string{"corp.example", "mycorp.example"}},
+		{"api-*.example.com", []string{"api-1.example.com", "api-.example.com"}, []string{"api.example.com", "api-1.eu.example.com", "x.api-1.example.com"}},
+		{`~^api-[0-9]+\.example\.com$`, []string{"api-42.example.com", "api-42.example.com:443"}, []string{"api-x.example.com"}},
+		{"10.0.0.0/8", []string{"10.1.2.3", "10.1.2.3:443"}, []string{"11.0.0.1", "example.com", "::1"}},
+		{"[::1]/128", []string{"::1", "[::1]:443"}, []string{"::2", "127.0.0.1"}},
+		{"fd00::/8", []string{"fd12::1", "[fdff::]:80"}, []string{"fe80::1"}},
+		{"127.0.0.1", []string{"127.0.0.1", "127.0.0.1:8080"}, []string{"127.0.0.2", "localhost", "example.com"}},
+		{"::1", []string{"::1", "[::1]:443"}, []string{"::2"}},
+		{"[::1]:443", []string{"[::1]:443"}, []string{"[::1]:80", "::1"}},
+		{"example.com:443", []string{"example.com:443"}, []string{"example.com:80", "example.com"}},
+		{"*:8443", []string{"example.com:8443", "10.0.0.1:8443"}, []string{"example.com:443", "example.com"}},
+		{".example.com:*", []string{"www.example.com:1", "example.com"}, []string{"example.net:1"}},
+		{"10.0.0.0/8:22", []string{"10.0.0.1:22"}, []string{"10.0.0.1:23"}},
+		{"[fd00::]/8:22", []string{"[fd00::1]:22"}, []string{"[fd00::1]:23"}},
+	} {
+		p, err := router.ParsePattern(tc.pattern)
+		require.NoError(t, err, tc.pattern)
+		require.Equal(t, tc.pattern, p.String())
+		for _, addr := range tc.match {
+			require.True(t, p.MatchAddr(addr), "%s should match %s", tc.pattern, addr)
+		}
+		for _, addr := range tc.nomatch {
+			require.False(t, p.MatchAddr(addr), "%s should not match %s", tc.pattern, addr)
+		}
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	for _, s := range []string{
+		"",
+		":443",
+		"example.com:http",
+		"example.com:0",
+		"example.com:70000",
+		"10.0.0.0/33",
+		"example.com/8",
+		"[::1",
+		"[::1]x",
+		"~[",
+	} {
+		_, err := router.ParsePattern(s)
+		require.Error(t, err, s)
+	}
+	require.Panics(t, func() { router.MustParsePattern("~[") })
+}
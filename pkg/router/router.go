@@ -3,6 +3,7 @@ package router
 import (
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
 // Router is a router to dispatch proxy requests to proper handlers according to method and host rules.
@@ -10,7 +11,8 @@ import (
 // Zero value of Router is a usable proxy server in the sense it will return valid HTTP responses. It will not forward
 // any requests to upstream or target servers though.
 type Router struct {
-	// Default specifies handler to serve non-CONNECT proxy requests. If not set, NotFound will be used.
+	// Default specifies handler to serve non-CONNECT proxy requests if no host matches. If not set, NotFound will be
+	// used.
 	Default http.Handler
 
 	// Connect sets fallback CONNECT handler which will be used if no host matches. If no fallback handler specified,
@@ -21,6 +23,7 @@ type Router struct {
 	NotFound http.Handler
 
 	matchers []matcher
+	index    hostIndex
 
 	once sync.Once
 }
@@ -39,10 +42,8 @@ func (r *Router) init() {
 
 // HandleConnectHost sets handler to serve CONNECT requests for target hosts.
 //
-// Hostname specification:
-//  - `example.com` matches exactly the host name
-//  - `www.example.com` matches exactly the host name as well
-//  - `.example.com` matches both `example.com` and all of it's subdomains
+// See Pattern for the host specification. Invalid pattern causes panic, use HandleConnectPattern with ParsePattern to
+// handle the error instead.
 //
 // Patterns will be matched exactly in the order they were added. The pattern that matches aborts matching cycle. E.g.
 //
@@ -52,10 +53,68 @@ func (r *Router) init() {
 //  would match handler A for the target host `example.com`
 //
 func (r *Router) HandleConnectHost(host string, handler http.Handler) {
-	r.matchers = append(r.matchers, matcher{
-		tpl:     host,
-		handler: handler,
+	r.HandleConnectPattern(MustParsePattern(host), handler)
+}
+
+// HandleHost sets handler to serve non-CONNECT proxy requests for target hosts. If no host matches, Default is used.
+// See HandleConnectHost for the hostname specification and matching order. Invalid pattern causes panic.
+func (r *Router) HandleHost(host string, handler http.Handler) {
+	r.HandleHostPattern(MustParsePattern(host), handler)
+}
+
+// Handle sets handler to serve both CONNECT and non-CONNECT proxy requests for target hosts. It's the same as calling
+// both HandleConnectHost and HandleHost, but keeps a single position in the matching order. Invalid pattern causes
+// panic.
+func (r *Router) Handle(host string, handler http.Handler) {
+	r.HandlePattern(MustParsePattern(host), handler)
+}
+
+// HandleConnectPattern is like HandleConnectHost, but takes parsed pattern.
+func (r *Router) HandleConnectPattern(p *Pattern, handler http.Handler) {
+	r.handle(p, handler, routeConnect)
+}
+
+// HandleHostPattern is like HandleHost, but takes parsed pattern.
+func (r *Router) HandleHostPattern(p *Pattern, handler http.Handler) {
+	r.handle(p, handler, routeHTTP)
+}
+
+// HandlePattern is like Handle, but takes parsed pattern.
+func (r *Router) HandlePattern(p *Pattern, handler http.Handler) {
+	r.handle(p, handler, routeConnect|routeHTTP)
+}
+
+// route is the set of request kinds a matcher applies to
+type route int
+
+const (
+	routeConnect route = 1 << iota
+	routeHTTP
+)
+
+func (r *Router) handle(p *Pattern, handler http.Handler, kind route) {
+	r.matchers = append(r.matchers, matcher{handler: handler, route: kind})
+	r.index.add(p)
+}
+
+// match returns handler of the first matcher of the kind matching the target address, or nil if nothing matches
+func (r *Router) match(rq *http.Request, kind route) http.Handler {
+	hostname, port := SplitAddr(rq.URL.Host)
+	if port == 0 {
+		switch rq.URL.Scheme {
+		case "http":
+			port = 80
+		case "https":
+			port = 443
+		}
+	}
+	i := r.index.lookup(hostname, port, func(i int) bool {
+		return r.matchers[i].route&kind != 0
 	})
+	if i < 0 {
+		return nil
+	}
+	return r.matchers[i].handler
 }
 
 func (r *Router) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
@@ -63,17 +122,15 @@ func (r *Router) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
 	var h http.Handler
 	switch {
 	case rq.Method == http.MethodConnect:
-		h = r.Connect
-		if r.matchers != nil {
-			for i := range r.matchers {
-				if r.matchers[i].matches(rq.URL.Hostname()) {
-					h = r.matchers[i].handler
-					break
-				}
-			}
+		h = r.match(rq, routeConnect)
+		if h == nil {
+			h = r.Connect
 		}
 	case rq.URL.Host != "":
-		h = r.Default
+		h = r.match(rq, routeHTTP)
+		if h == nil {
+			h = r.Default
+		}
 	default:
 		h = r.NotFound
 	}
@@ -87,3 +144,31 @@ var NotFound = http.HandlerFunc(http.NotFound)
 var MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 })
+
+// Swappable is a handler dispatching requests to the router stored last. Routers are swapped atomically, requests in
+// flight, including hijacked connections, are served by the router they were dispatched to until they are done.
+//
+// Zero value of Swappable serves requests the way zero value of Router does.
+type Swappable struct {
+	v atomic.Value
+}
+
+// Store replaces the router serving new requests.
+func (s *Swappable) Store(r *Router) {
+	s.v.Store(r)
+}
+
+// Load returns the router serving new requests.
+func (s *Swappable) Load() *Router {
+	if r, ok := s.v.Load().(*Router); ok {
+		return r
+	}
+	return &empty
+}
+
+// empty is the router Swappable uses until a router is stored
+var empty Router
+
+func (s *Swappable) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	s.Load().ServeHTTP(rw, rq)
+}
@@ -2,6 +2,7 @@ package router_test
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"net"
 	"net/http"
@@ -63,7 +64,14 @@ func testTransport(proxy string) *http.Transport {
 }
 
 func TestRouter_ServeHTTP(t *testing.T) {
-	d := &handlers.HTTPHandler{}
+	roots := x509.NewCertPool()
+	roots.AddCert(testTLSServer.Certificate())
+	d := &handlers.HTTPHandler{
+		Transport: &handlers.VerifyingTransport{
+			RootCAs:    roots,
+			SkipVerify: []string{"localhost"},
+		},
+	}
 	router := &router2.Router{
 		Default: d,
 		Connect: &handlers.MITMHandler{
@@ -129,3 +137,71 @@ func TestRouter_ServeHTTP(t *testing.T) {
 		require.Equal(t, "custom", data.Headers.Get("x-test-route"))
 	})
 }
+
+func TestRouter_HandleHost(t *testing.T) {
+	route := func(name string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			_, _ = rw.Write([]byte(name))
+		})
+	}
+	router := &router2.Router{
+		Default: route("default"),
+		Connect: route("connect"),
+	}
+	router.HandleHost(".internal.example", route("internal"))
+	router.HandleConnectHost("tunnel.example", route("tunnel"))
+	router.Handle(".example", route("both"))
+	router.HandleConnectPattern(router2.MustParsePattern("*:8443"), route("alt"))
+	router.HandleHost("10.0.0.0/8", route("private"))
+
+	for _, tc := range []struct {
+		method, target, expected string
+	}{
+		{http.MethodGet, "http://internal.example/", "internal"},
+		{http.MethodGet, "http://www.internal.example:8080/", "internal"},
+		{http.MethodGet, "http://tunnel.example/", "both"},
+		{http.MethodGet, "http://www.example/", "both"},
+		{http.MethodGet, "http://www.example.org/", "default"},
+		{http.MethodConnect, "internal.example:443", "both"},
+		{http.MethodConnect, "tunnel.example:443", "tunnel"},
+		{http.MethodConnect, "www.example.org:443", "connect"},
+		{http.MethodConnect, "www.example.org:8443", "alt"},
+		{http.MethodConnect, "tunnel.example:8443", "tunnel"},
+		{http.MethodGet, "http://10.1.2.3:8443/", "private"},
+		{http.MethodConnect, "10.1.2.3:443", "connect"},
+	} {
+		rq := &http.Request{Method: tc.method, Header: http.Header{}}
+		if tc.method == http.MethodConnect {
+			rq.URL = &url.URL{Host: tc.target}
+		} else {
+			rq.URL, _ = url.Parse(tc.target)
+		}
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, rq)
+		require.Equal(t, tc.expected, rw.Body.String(), tc)
+	}
+}
+
+func TestRouter_HandleHostInvalid(t *testing.T) {
+	router := &router2.Router{}
+	require.Panics(t, func() { router.HandleHost("~[", router2.NotFound) })
+	require.Panics(t, func() { router.HandleConnectHost("10.0.0.0/33", router2.NotFound) })
+	require.Panics(t, func() { router.Handle("", router2.NotFound) })
+}
+
+func TestSwappable(t *testing.T) {
+	s := &router2.Swappable{}
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	require.Equal(t, http.StatusNotFound, rw.Code)
+
+	for _, name := range []string{"first", "second"} {
+		name := name
+		s.Store(&router2.Router{Default: http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			_, _ = rw.Write([]byte(name))
+		})})
+		rw = httptest.NewRecorder()
+		s.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		require.Equal(t, name, rw.Body.String())
+	}
+}
@@ -0,0 +1,165 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// maxHeadSize limits the size of HTTP response head written by a handler into hijacked connection.
+const maxHeadSize = 4096
+
+var errReplyFailed = errors.New("socks: request failed")
+
+// responseWriter is http.ResponseWriter passed to the handler. It replies to the client with SOCKS reply instead of
+// HTTP response.
+type responseWriter struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	header   http.Header
+	status   int
+	hijacked bool
+}
+
+// Header implements http.ResponseWriter interface
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+// WriteHeader implements http.ResponseWriter interface
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status != 0 || rw.hijacked {
+		return
+	}
+	rw.status = status
+}
+
+// Write implements http.ResponseWriter interface. There's no way to pass response body to SOCKS client, so it's
+// discarded.
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.hijacked {
+		return 0, http.ErrHijacked
+	}
+	rw.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+// Hijack implements http.Hijacker interface
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	rw.hijacked = true
+	conn := &hijackedConn{Conn: rw.conn, br: rw.br}
+	return conn, bufio.NewReadWriter(rw.br, bufio.NewWriter(conn)), nil
+}
+
+// finish replies to the client if the handler didn't hijack the connection.
+func (rw *responseWriter) finish() {
+	if rw.hijacked {
+		return
+	}
+	code := ReplyCode(rw.status)
+	if rw.status == 0 || code == ReplySucceeded {
+		// the handler neither failed nor took over the connection
+		code = ReplyGeneralFailure
+	}
+	_ = writeReply(rw.conn, code)
+}
+
+// hijackedConn translates HTTP response head into SOCKS reply and passes everything else through.
+type hijackedConn struct {
+	net.Conn
+	br      *bufio.Reader
+	head    []byte
+	replied bool
+	failed  bool
+}
+
+// Read wraps net.Conn, data buffered during handshake is read first
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// Write wraps net.Conn
+func (c *hijackedConn) Write(p []byte) (int, error) {
+	if c.failed {
+		return 0, errReplyFailed
+	}
+	if c.replied {
+		return c.Conn.Write(p)
+	}
+
+	c.head = append(c.head, p...)
+	i := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if i < 0 {
+		if len(c.head) > maxHeadSize {
+			c.failed = true
+			_ = writeReply(c.Conn, ReplyGeneralFailure)
+			return 0, errReplyFailed
+		}
+		return len(p), nil
+	}
+	rest := c.head[i+4:]
+	code := ReplyCode(parseStatus(c.head[:i]))
+	c.head = nil
+	err := writeReply(c.Conn, code)
+	if err != nil {
+		return 0, err
+	}
+	if code != ReplySucceeded {
+		c.failed = true
+		return 0, errReplyFailed
+	}
+	c.replied = true
+	if len(rest) > 0 {
+		_, err = c.Conn.Write(rest)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, so tunnels could pass half-close on.
+func (c *hijackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("underlying net.Conn doesn't support half-close")
+}
+
+// ReadFrom implements io.ReaderFrom interface. Besides efficiency, it makes bufio.Writer pass data through immediately
+// instead of accumulating it until the buffer is full, the same way it does for hijacked *net.TCPConn.
+func (c *hijackedConn) ReadFrom(r io.Reader) (int64, error) {
+	if !c.replied {
+		return io.Copy(writerOnly{c}, r)
+	}
+	return io.Copy(c.Conn, r)
+}
+
+// writerOnly hides io.ReaderFrom implementation of the writer from io.Copy
+type writerOnly struct {
+	io.Writer
+}
+
+// parseStatus returns status code from HTTP response head or 0 if it's malformed.
+func parseStatus(head []byte) int {
+	line := head
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := bytes.Fields(line)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return 0
+	}
+	status, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0
+	}
+	return status
+}
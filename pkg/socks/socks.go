@@ -0,0 +1,359 @@
+// Package socks implements SOCKS5 (RFC 1928) front-end for proxy handlers.
+//
+// The server performs SOCKS handshake and turns CONNECT command into HTTP CONNECT request which is dispatched to
+// http.Handler, usually router.Router. So SOCKS clients are served by the same handlers HTTP clients are, e.g. by tunnel
+// or MITM proxy depending on the target host.
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	socksVersion = 0x05
+
+	authNone     = 0x00
+	authPassword = 0x02
+	authNoMethod = 0xff
+
+	authPasswordVersion = 0x01
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Reply codes
+const (
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyNotAllowed          = 0x02
+	ReplyNetworkUnreachable  = 0x03
+	ReplyHostUnreachable     = 0x04
+	ReplyConnectionRefused   = 0x05
+	ReplyTTLExpired          = 0x06
+	ReplyCommandNotSupported = 0x07
+	ReplyAddressNotSupported = 0x08
+)
+
+// DefaultHandshakeTimeout is the default time limit for a client to complete SOCKS handshake.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// ErrServerClosed is returned by Serve after Close call.
+var ErrServerClosed = errors.New("socks: server closed")
+
+// Server is SOCKS5 proxy server.
+//
+// The zero value of Server is a valid instance which refuses all the connections.
+type Server struct {
+	// Handler serves CONNECT requests. It must hijack the connection to serve the client, the HTTP response head it
+	// writes into hijacked connection is translated into SOCKS reply. Error responses written without hijacking are
+	// translated into SOCKS replies as well, see ReplyCode.
+	//
+	// Synthesized requests carry client credentials, if any, in Proxy-Authorization header.
+	//
+	// If Handler is nil, all the CONNECT commands are refused.
+	Handler http.Handler
+
+	// Authenticate enables username/password authentication (RFC 1929). Clients which don't support it are refused.
+	//
+	// If Authenticate is nil, clients are not required to authenticate.
+	Authenticate func(user, password string) bool
+
+	// HandshakeTimeout specifies time limit for a client to complete SOCKS handshake.
+	//
+	// If HandshakeTimeout is zero, DefaultHandshakeTimeout is used.
+	HandshakeTimeout time.Duration
+
+	// Logger specifies optional logger for connection level errors.
+	Logger *zap.Logger
+
+	once      sync.Once
+	mux       sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+func (s *Server) init() {
+	if s.Handler == nil {
+		s.Handler = http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.WriteHeader(http.StatusForbidden)
+		})
+	}
+	if s.HandshakeTimeout == 0 {
+		s.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if s.Logger == nil {
+		s.Logger = zap.NewNop()
+	}
+	s.listeners = make(map[net.Listener]struct{})
+}
+
+// ListenAndServe listens on the TCP network address and calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts incoming connections on the listener and serves them in separate goroutines. Serve always returns
+// a non-nil error and closes the listener.
+func (s *Server) Serve(l net.Listener) error {
+	s.once.Do(s.init)
+
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mux.Unlock()
+
+	defer func() {
+		s.mux.Lock()
+		delete(s.listeners, l)
+		s.mux.Unlock()
+		_ = l.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mux.Lock()
+			closed := s.closed
+			s.mux.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.Logger.Warn("accept error", zap.Error(err), zap.Duration("retry", delay))
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go s.ServeConn(conn)
+	}
+}
+
+// Close closes all the listeners. Connections being served are not interrupted.
+func (s *Server) Close() error {
+	s.once.Do(s.init)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ServeConn serves a single client connection and closes it.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.once.Do(s.init)
+
+	defer func() {
+		if err := recover(); err != nil {
+			s.Logger.Error("panic serving connection", zap.String("client", conn.RemoteAddr().String()),
+				zap.Any("error", err), zap.Stack("stack"))
+		}
+	}()
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	br := bufio.NewReader(conn)
+	user, password, err := s.negotiate(conn, br)
+	if err != nil {
+		s.Logger.Debug("handshake failed", zap.String("client", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	addr, err := s.readRequest(conn, br)
+	if err != nil {
+		s.Logger.Debug("bad request", zap.String("client", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rq := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Host:       addr,
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: addr,
+	}).WithContext(ctx)
+	if user != "" {
+		rq.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+
+	rw := &responseWriter{conn: conn, br: br, header: http.Header{}}
+	s.Handler.ServeHTTP(rw, rq)
+	rw.finish()
+}
+
+// negotiate selects authentication method and authenticates the client.
+func (s *Server) negotiate(conn net.Conn, br *bufio.Reader) (string, string, error) {
+	var hdr [2]byte
+	_, err := io.ReadFull(br, hdr[:])
+	if err != nil {
+		return "", "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	_, err = io.ReadFull(br, methods)
+	if err != nil {
+		return "", "", err
+	}
+
+	method := byte(authNone)
+	if s.Authenticate != nil {
+		method = authPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		_, _ = conn.Write([]byte{socksVersion, authNoMethod})
+		return "", "", errors.New("no acceptable authentication method")
+	}
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil || method == authNone {
+		return "", "", err
+	}
+
+	// RFC 1929 username/password sub-negotiation
+	_, err = io.ReadFull(br, hdr[:])
+	if err != nil {
+		return "", "", err
+	}
+	if hdr[0] != authPasswordVersion {
+		return "", "", fmt.Errorf("unsupported authentication version %d", hdr[0])
+	}
+	user := make([]byte, hdr[1])
+	_, err = io.ReadFull(br, user)
+	if err != nil {
+		return "", "", err
+	}
+	plen, err := br.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	password := make([]byte, plen)
+	_, err = io.ReadFull(br, password)
+	if err != nil {
+		return "", "", err
+	}
+	if !s.Authenticate(string(user), string(password)) {
+		_, _ = conn.Write([]byte{authPasswordVersion, 0x01})
+		return "", "", fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err = conn.Write([]byte{authPasswordVersion, 0x00})
+	return string(user), string(password), err
+}
+
+// readRequest reads client request and returns target address. Unsupported requests are replied to.
+func (s *Server) readRequest(conn net.Conn, br *bufio.Reader) (string, error) {
+	var hdr [4]byte
+	_, err := io.ReadFull(br, hdr[:])
+	if err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+
+	var host string
+	switch hdr[3] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(br, ip)
+		host = ip.String()
+	case atypDomain:
+		var n byte
+		n, err = br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, n)
+		_, err = io.ReadFull(br, domain)
+		host = string(domain)
+	default:
+		_ = writeReply(conn, ReplyAddressNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", hdr[3])
+	}
+	if err != nil {
+		return "", err
+	}
+	var port [2]byte
+	_, err = io.ReadFull(br, port[:])
+	if err != nil {
+		return "", err
+	}
+
+	if hdr[1] != cmdConnect {
+		_ = writeReply(conn, ReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported command %d", hdr[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// writeReply writes SOCKS reply. Bound address is always reported as unspecified.
+func writeReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// ReplyCode maps HTTP status code of CONNECT response into SOCKS reply code.
+func ReplyCode(status int) byte {
+	switch {
+	case status >= 200 && status < 300:
+		return ReplySucceeded
+	case status == http.StatusForbidden, status == http.StatusProxyAuthRequired, status == http.StatusUnauthorized:
+		return ReplyNotAllowed
+	case status == http.StatusMethodNotAllowed, status == http.StatusNotImplemented:
+		return ReplyCommandNotSupported
+	case status == http.StatusBadGateway:
+		return ReplyHostUnreachable
+	case status == http.StatusGatewayTimeout:
+		return ReplyTTLExpired
+	default:
+		return ReplyGeneralFailure
+	}
+}
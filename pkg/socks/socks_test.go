@@ -0,0 +1,177 @@
+package socks_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"github.com/akabos/multiproxy/pkg/handlers"
+	"github.com/akabos/multiproxy/pkg/router"
+	"github.com/akabos/multiproxy/pkg/socks"
+)
+
+func testServer(t *testing.T, s *socks.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(func() { _ = s.Close() })
+	return l.Addr().String()
+}
+
+func testGet(t *testing.T, socksAddr string, auth *proxy.Auth, target string) (*http.Response, error) {
+	d, err := proxy.SOCKS5("tcp", socksAddr, auth, proxy.Direct)
+	require.NoError(t, err)
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+		},
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	rq, _ := http.NewRequest(http.MethodGet, target, nil)
+	return tr.RoundTrip(rq)
+}
+
+func TestServer(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		_, _ = rw.Write([]byte("hello"))
+	}))
+	defer target.Close()
+
+	mux := &router.Router{}
+	mux.HandleConnectHost("127.0.0.1", &handlers.Tunnel{})
+	mux.HandleConnectHost("::1", &handlers.Tunnel{})
+
+	t.Run("connect", func(t *testing.T) {
+		addr := testServer(t, &socks.Server{Handler: mux})
+		rs, err := testGet(t, addr, nil, target.URL)
+		require.NoError(t, err)
+		defer rs.Body.Close()
+		data, _ := ioutil.ReadAll(rs.Body)
+		require.Equal(t, "hello", string(data))
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		l, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Skip("IPv6 is not available")
+		}
+		target := httptest.NewUnstartedServer(target.Config.Handler)
+		target.Listener = l
+		target.Start()
+		defer target.Close()
+
+		addr := testServer(t, &socks.Server{Handler: mux})
+		rs, err := testGet(t, addr, nil, target.URL)
+		require.NoError(t, err)
+		defer rs.Body.Close()
+		require.Equal(t, http.StatusOK, rs.StatusCode)
+	})
+
+	t.Run("domain", func(t *testing.T) {
+		var requested string
+		addr := testServer(t, &socks.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			requested = rq.RequestURI
+			rw.WriteHeader(http.StatusBadGateway)
+		})})
+		_, err := testGet(t, addr, nil, "http://www.example.invalid:8080/")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "host unreachable")
+		require.Equal(t, "www.example.invalid:8080", requested)
+	})
+
+	t.Run("no route", func(t *testing.T) {
+		addr := testServer(t, &socks.Server{Handler: mux})
+		_, err := testGet(t, addr, nil, "http://192.0.2.1/")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "command not supported")
+	})
+
+	t.Run("authentication", func(t *testing.T) {
+		var header string
+		addr := testServer(t, &socks.Server{
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+				header = rq.Header.Get("Proxy-Authorization")
+				mux.ServeHTTP(rw, rq)
+			}),
+			Authenticate: func(user, password string) bool {
+				return user == "user" && password == "secret"
+			},
+		})
+
+		rs, err := testGet(t, addr, &proxy.Auth{User: "user", Password: "secret"}, target.URL)
+		require.NoError(t, err)
+		_ = rs.Body.Close()
+		require.Equal(t, "Basic dXNlcjpzZWNyZXQ=", header)
+
+		_, err = testGet(t, addr, &proxy.Auth{User: "user", Password: "wrong"}, target.URL)
+		require.Error(t, err)
+
+		_, err = testGet(t, addr, nil, target.URL)
+		require.Error(t, err)
+	})
+}
+
+func TestServer_HalfClose(t *testing.T) {
+	// target greets the client and half-closes, then reads until the client is done sending
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("hello"))
+		_ = c.(*net.TCPConn).CloseWrite()
+		data, _ := ioutil.ReadAll(c)
+		received <- string(data)
+	}()
+
+	mux := &router.Router{}
+	mux.HandleConnectHost("127.0.0.1", &handlers.Tunnel{})
+	conn, err := net.Dial("tcp", testServer(t, &socks.Server{Handler: mux}))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+
+	port := l.Addr().(*net.TCPAddr).Port
+	_, err = conn.Write([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	require.NoError(t, err)
+	reply := make([]byte, 12)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 0, 5, 0}, reply[:4])
+
+	// the client gets EOF, while the other direction of the tunnel is still open
+	data, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	_, err = conn.Write([]byte("bye"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	require.Equal(t, "bye", <-received)
+}
+
+func TestReplyCode(t *testing.T) {
+	for status, code := range map[int]byte{
+		http.StatusOK:                  socks.ReplySucceeded,
+		http.StatusForbidden:           socks.ReplyNotAllowed,
+		http.StatusProxyAuthRequired:   socks.ReplyNotAllowed,
+		http.StatusMethodNotAllowed:    socks.ReplyCommandNotSupported,
+		http.StatusBadGateway:          socks.ReplyHostUnreachable,
+		http.StatusGatewayTimeout:      socks.ReplyTTLExpired,
+		http.StatusInternalServerError: socks.ReplyGeneralFailure,
+	} {
+		require.Equal(t, code, socks.ReplyCode(status), status)
+	}
+}
@@ -0,0 +1,259 @@
+// Package upstream implements chaining to parent proxies.
+//
+// Parent proxy is specified with an URL. Supported schemes are `http` and `https` for HTTP proxies (CONNECT method is
+// used to establish connections through them) and `socks5` for SOCKS5 proxies. Credentials are taken from the URL user
+// info. The special value `direct` means connecting to target servers directly.
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/akabos/multiproxy/pkg/router"
+)
+
+// Direct is the parent proxy specification which means no parent proxy.
+const Direct = "direct"
+
+// ErrUnsupportedScheme is returned for parent proxy URLs with unknown scheme.
+var ErrUnsupportedScheme = errors.New("unsupported parent proxy scheme")
+
+// ParseURL parses parent proxy specification. Returns nil URL for Direct.
+func ParseURL(s string) (*url.URL, error) {
+	if s == Direct {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("parent proxy %q: port is required", s)
+	}
+	return u, nil
+}
+
+// Rules selects parent proxy for target host. It's shared by http.Transport (see ProxyFunc) and handlers dialing
+// target servers directly (see DialContext), so all the traffic leaves through the same parent.
+//
+// The zero value of Rules connects to all target servers directly.
+type Rules struct {
+	// Default specifies the parent proxy used if no rule matches. Nil means direct connection, unless Environment is
+	// set.
+	Default *url.URL
+
+	// Environment instructs to use parent proxy specified by environment variables (see http.ProxyFromEnvironment) if
+	// no rule matches and Default is nil.
+	Environment bool
+
+	// Dial specifies the dial function for connecting to parent proxies and to target servers directly.
+	//
+	// If Dial is nil then package net is used.
+	Dial func(context.Context, string, string) (net.Conn, error)
+
+	// TLSClientConfig specifies optional TLS configuration for connecting to HTTPS parent proxies.
+	TLSClientConfig *tls.Config
+
+	rules []rule
+	once  sync.Once
+}
+
+type rule struct {
+	pattern *router.Pattern
+	proxy   *url.URL
+}
+
+func (r *Rules) init() {
+	if r.Dial == nil {
+		d := net.Dialer{}
+		r.Dial = d.DialContext
+	}
+}
+
+// Handle sets parent proxy for target hosts matching the pattern. Nil proxy means direct connection. See
+// router.Pattern for the pattern syntax.
+//
+// Patterns are matched in the order they were added, the first one matching wins.
+func (r *Rules) Handle(pattern string, proxy *url.URL) error {
+	p, err := router.ParsePattern(pattern)
+	if err != nil {
+		return err
+	}
+	r.rules = append(r.rules, rule{pattern: p, proxy: proxy})
+	return nil
+}
+
+// Match returns parent proxy for the target address. The scheme is the scheme of requested URL, it's only used to pick
+// the right environment variable. Returns nil for direct connection.
+func (r *Rules) Match(scheme, addr string) (*url.URL, error) {
+	for i := range r.rules {
+		if r.rules[i].pattern.MatchAddr(addr) {
+			return r.rules[i].proxy, nil
+		}
+	}
+	if r.Default != nil || !r.Environment {
+		return r.Default, nil
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+}
+
+// ProxyFunc is the function to be used as http.Transport Proxy.
+func (r *Rules) ProxyFunc(rq *http.Request) (*url.URL, error) {
+	return r.Match(rq.URL.Scheme, rq.URL.Host)
+}
+
+// DialContext connects to the address through the parent proxy matching the address.
+func (r *Rules) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	r.once.Do(r.init)
+	u, err := r.Match("https", addr)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return r.Dial(ctx, network, addr)
+	}
+	return r.dialProxy(ctx, u, network, addr)
+}
+
+func (r *Rules) dialProxy(ctx context.Context, u *url.URL, network, addr string) (net.Conn, error) {
+	switch u.Scheme {
+	case "http", "https":
+		return r.dialConnect(ctx, u, addr)
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, contextDialer(r.Dial))
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+}
+
+// dialConnect establishes connection to the address through HTTP proxy using CONNECT method.
+func (r *Rules) dialConnect(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	conn, err := r.Dial(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		conf := r.TLSClientConfig.Clone()
+		if conf == nil {
+			conf = &tls.Config{}
+		}
+		if conf.ServerName == "" {
+			conf.ServerName = u.Hostname()
+		}
+		conn = tls.Client(conn, conf)
+	}
+
+	// the handshake must not outlive the context
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	rq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		rq.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString(
+			[]byte(u.User.Username()+":"+password),
+		))
+	}
+	err = rq.Write(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	rs, err := http.ReadResponse(br, rq)
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	_ = rs.Body.Close()
+	if rs.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, &ConnectError{Proxy: u.Host, Addr: addr, StatusCode: rs.StatusCode}
+	}
+	if br.Buffered() > 0 {
+		// the proxy is not supposed to send anything before the client does, but just in case
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// ConnectError is returned when parent HTTP proxy refuses CONNECT request.
+type ConnectError struct {
+	Proxy      string
+	Addr       string
+	StatusCode int
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("parent proxy %s refused to connect to %s: %d %s",
+		e.Proxy, e.Addr, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+type contextDialer func(context.Context, string, string) (net.Conn, error)
+
+// Dial implements proxy.Dialer interface
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer interface
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read wraps net.Conn
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, so tunnels could pass half-close on.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("underlying net.Conn doesn't support half-close")
+}